@@ -0,0 +1,133 @@
+package gateway
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/nautilus/graphql"
+)
+
+// WithAccessLog returns an Option that logs a line for every operation handled by GraphQLHandler
+// with its name, type, the hash of its query, whether it succeeded, how long it took, how many
+// steps it needed, and how many errors it ran into. The lines are logged at the info level which
+// the default logger hides, so call SetLevel("info") on the gateway's logger to see them.
+func WithAccessLog() Option {
+	return func(g *Gateway) {
+		g.accessLog = true
+	}
+}
+
+// WithSlowQueryLog returns an Option that logs every operation that takes at least the given amount
+// of time. The lines are logged at the warning level and have the same fields as the access log
+// along with the plan of the operation.
+func WithSlowQueryLog(threshold time.Duration) Option {
+	return func(g *Gateway) {
+		g.slowQueryThreshold = threshold
+	}
+}
+
+// WithSlowQueryText returns an Option that adds the full query of an operation and the documents of
+// each step of its plan to the slow query log. Queries can hold sensitive values passed as literals
+// so only the services and shape of the plan are logged by default.
+func WithSlowQueryText() Option {
+	return func(g *Gateway) {
+		g.slowQueryText = true
+	}
+}
+
+// logOperation writes the access log and slow query log for an operation. The plan is the one that
+// was executed and is nil if the operation failed before we got that far.
+func (g *Gateway) logOperation(ctx *RequestContext, plan *QueryPlan, err error, start time.Time) {
+	duration := time.Since(start)
+	slow := g.slowQueryThreshold > 0 && duration >= g.slowQueryThreshold
+
+	// most requests don't have to pay for any of this
+	if !g.accessLog && !slow {
+		return
+	}
+
+	status := "success"
+	if err != nil {
+		status = "error"
+	}
+
+	operationType := ""
+	steps := 0
+	if plan != nil {
+		if plan.Operation != nil {
+			operationType = string(plan.Operation.Operation)
+		}
+		if plan.RootStep != nil {
+			steps = queryPlanStepCount(plan.RootStep.Then)
+		}
+	}
+
+	fields := LoggerFields{
+		"operationType": operationType,
+		"queryHash":     accessLogQueryHash(ctx),
+		"status":        status,
+		"durationMs":    float64(duration) / float64(time.Millisecond),
+		"steps":         steps,
+		"errors":        accessLogErrorCount(err),
+	}
+
+	logger := ctx.Logger
+	if logger == nil {
+		logger = g.logger
+	}
+
+	if g.accessLog {
+		logger.WithFields(fields).Info("Handled operation")
+	}
+
+	if slow {
+		if plan != nil {
+			description := DescribeQueryPlan(plan)
+			// the documents sent to the services can hold the same literals as the query
+			if !g.slowQueryText {
+				accessLogHideStepQueries(description.Steps)
+			}
+
+			// the plan is serialized here so it reads the same with any formatter
+			if serialized, err := json.Marshal(description); err == nil {
+				fields["plan"] = string(serialized)
+			}
+		}
+		if g.slowQueryText {
+			fields["query"] = ctx.Query
+		}
+
+		logger.WithFields(fields).Warn("Slow operation")
+	}
+}
+
+// accessLogQueryHash returns the hash that identifies the query of the request
+func accessLogQueryHash(ctx *RequestContext) string {
+	// persisted queries already have one
+	if ctx.CacheKey != "" {
+		return ctx.CacheKey
+	}
+
+	return queryHash(ctx.Query)
+}
+
+// accessLogHideStepQueries removes the documents from the steps of a plan description
+func accessLogHideStepQueries(steps []*QueryPlanStepDescription) {
+	for _, step := range steps {
+		step.Query = ""
+		accessLogHideStepQueries(step.Then)
+	}
+}
+
+// accessLogErrorCount returns the number of errors that will be in the response
+func accessLogErrorCount(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	if list, ok := err.(graphql.ErrorList); ok {
+		return len(list)
+	}
+
+	return 1
+}
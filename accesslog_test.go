@@ -0,0 +1,155 @@
+package gateway
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// logMessages returns the log lines with the given message
+func logMessages(t *testing.T, output *bytes.Buffer, message string) []map[string]interface{} {
+	lines := []map[string]interface{}{}
+	for _, line := range logLines(t, output) {
+		if line["msg"] == message {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func TestGraphQLHandler_accessLog(t *testing.T) {
+	output := &bytes.Buffer{}
+	logger := NewJSONLogger(output)
+	if !assert.Nil(t, logger.SetLevel("info")) {
+		return
+	}
+
+	gateway := inspectTestGateway(t, WithLogger(logger), WithAccessLog())
+
+	query := "query Ratings { posts { title rating } }"
+	for _, body := range []string{
+		`{"query": "` + query + `", "operationName": "Ratings"}`,
+		`{"operationName": "Missing"}`,
+	} {
+		request := httptest.NewRequest("POST", "/graphql", strings.NewReader(body))
+		request.Header.Set("X-Request-ID", "my-request")
+		gateway.GraphQLHandler(httptest.NewRecorder(), request)
+	}
+
+	lines := logMessages(t, output, "Handled operation")
+	if !assert.Len(t, lines, 2) {
+		return
+	}
+
+	hash := sha256.Sum256([]byte(query))
+
+	// the operation that worked
+	assert.Equal(t, "my-request", lines[0]["requestId"])
+	assert.Equal(t, "Ratings", lines[0]["operationName"])
+	assert.Equal(t, "query", lines[0]["operationType"])
+	assert.Equal(t, hex.EncodeToString(hash[:]), lines[0]["queryHash"])
+	assert.Equal(t, "success", lines[0]["status"])
+	assert.Equal(t, float64(2), lines[0]["steps"])
+	assert.Equal(t, float64(0), lines[0]["errors"])
+	assert.NotNil(t, lines[0]["durationMs"])
+
+	// and the one that didn't
+	assert.Equal(t, "Missing", lines[1]["operationName"])
+	assert.Equal(t, "error", lines[1]["status"])
+	assert.Equal(t, float64(0), lines[1]["steps"])
+	assert.Equal(t, float64(1), lines[1]["errors"])
+
+	// nothing was slow enough to log
+	assert.Empty(t, logMessages(t, output, "Slow operation"))
+}
+
+func TestGraphQLHandler_slowQueryLog(t *testing.T) {
+	testCases := []struct {
+		Message   string
+		Threshold time.Duration
+		Logged    bool
+	}{
+		{"over the threshold", time.Nanosecond, true},
+		{"under the threshold", time.Hour, false},
+	}
+
+	for _, row := range testCases {
+		t.Run(row.Message, func(t *testing.T) {
+			output := &bytes.Buffer{}
+			gateway := inspectTestGateway(t, WithLogger(NewJSONLogger(output)), WithSlowQueryLog(row.Threshold), WithSlowQueryText())
+
+			query := "{ posts { title rating } }"
+			request := httptest.NewRequest("POST", "/graphql", strings.NewReader(`{"query": "`+query+`"}`))
+			gateway.GraphQLHandler(httptest.NewRecorder(), request)
+
+			// the access log is off
+			assert.Empty(t, logMessages(t, output, "Handled operation"))
+
+			lines := logMessages(t, output, "Slow operation")
+			if !row.Logged {
+				assert.Empty(t, lines)
+				return
+			}
+			if !assert.Len(t, lines, 1) {
+				return
+			}
+
+			assert.Equal(t, query, lines[0]["query"])
+
+			// the plan is logged as it's shown by the plan endpoint
+			plan := &QueryPlanDescription{}
+			if !assert.Nil(t, json.Unmarshal([]byte(lines[0]["plan"].(string)), plan)) {
+				return
+			}
+			if assert.Len(t, plan.Steps, 1) {
+				assert.Equal(t, "posts", plan.Steps[0].URL)
+				assert.NotEmpty(t, plan.Steps[0].Query)
+			}
+		})
+	}
+}
+
+func TestGraphQLHandler_slowQueryLogWithoutText(t *testing.T) {
+	output := &bytes.Buffer{}
+	gateway := inspectTestGateway(t, WithLogger(NewJSONLogger(output)), WithSlowQueryLog(time.Nanosecond))
+
+	request := httptest.NewRequest("POST", "/graphql", strings.NewReader(`{"query": "{ posts { title rating } }"}`))
+	gateway.GraphQLHandler(httptest.NewRecorder(), request)
+
+	// the query could hold something sensitive so only its hash is logged unless we ask for it
+	lines := logMessages(t, output, "Slow operation")
+	if !assert.Len(t, lines, 1) {
+		return
+	}
+	assert.Equal(t, queryHash("{ posts { title rating } }"), lines[0]["queryHash"])
+	assert.Nil(t, lines[0]["query"])
+
+	// the plan still says where the time went without the documents sent to the services
+	plan := &QueryPlanDescription{}
+	if !assert.Nil(t, json.Unmarshal([]byte(lines[0]["plan"].(string)), plan)) {
+		return
+	}
+	if assert.Len(t, plan.Steps, 1) {
+		assert.Equal(t, "posts", plan.Steps[0].URL)
+		assert.Equal(t, "Query", plan.Steps[0].ParentType)
+		assert.Empty(t, plan.Steps[0].Query)
+	}
+}
+
+func TestAccessLog_hiddenLevel(t *testing.T) {
+	// the default level would hide every line of the access log so we say so when the gateway starts
+	output := &bytes.Buffer{}
+	inspectTestGateway(t, WithLogger(NewJSONLogger(output)), WithAccessLog())
+
+	lines := logLines(t, output)
+	if assert.Len(t, lines, 1) {
+		assert.Contains(t, lines[0]["msg"], "access log")
+	}
+}
@@ -1,12 +1,24 @@
 package gateway
 
 import (
+	"container/list"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"crypto/sha256"
 	"encoding/hex"
+
+	"github.com/nautilus/graphql"
+	"github.com/vektah/gqlparser/ast"
+	"github.com/vektah/gqlparser/parser"
 )
 
 // In general, "query persistance" is a term for a family of optimizations that involve
@@ -23,16 +35,18 @@ import (
 //		- if the client sees the known value, resend the query with the full query body
 // 		- the server will then calculate the plan and save it for later use
 //      - if the client sends a known hash along with the query body, the query body is ignored
+//      - the query bodies can be kept in a QueryStore so that every gateway knows about every hash
 //
 //      pros/cons:
 //		- no need for a build step
 // 		- the client can send any queries they want
 //
-// StaticPersistedQueries (not implemented here):
+// StaticPersistedQueries:
 //		- as part of a build step, the gateway is given the list of queries and associated
 //			hashes
 //		- the client only sends the hash with queries
 // 		- if the server recognizes the hash, execute the query. Otherwise, return with en error
+//		- in strict mode, the server also refuses to execute queries that are sent without a hash
 //
 //		pros/cons:
 //		- need for a separate build step that prepares the queries and shares it with the server
@@ -42,21 +56,99 @@ import (
 // a caches query plan
 const MessageMissingCachedQuery = "PersistedQueryNotFound"
 
+// MessageUnknownStaticQuery is the string that the server sends when the user asks for a query that is not
+// in the list of static persisted queries
+const MessageUnknownStaticQuery = "PersistedQueryNotAllowed"
+
+// MessageStaticQueriesOnly is the string that the server sends when the user sends a query body to a gateway
+// that only accepts static persisted queries
+const MessageStaticQueriesOnly = "PersistedQueryRequired"
+
+// MessagePersistedQueriesNotSupported is the string that the server sends when the user only sends the hash of a
+// query to a gateway that doesn't persist queries
+const MessagePersistedQueriesNotSupported = "PersistedQueryNotSupported"
+
+// the codes in the extensions of the errors for persisted queries. Clients like Apollo's persisted query
+// link look for these to decide when to send the full query.
+const (
+	// ErrorCodePersistedQueryNotFound marks errors for hashes that the gateway doesn't know about
+	ErrorCodePersistedQueryNotFound = "PERSISTED_QUERY_NOT_FOUND"
+	// ErrorCodePersistedQueryNotSupported marks errors for hashes sent to a gateway that doesn't persist queries
+	ErrorCodePersistedQueryNotSupported = "PERSISTED_QUERY_NOT_SUPPORTED"
+	// ErrorCodePersistedQueryNotAllowed marks errors for hashes that aren't in the list of static queries
+	ErrorCodePersistedQueryNotAllowed = "PERSISTED_QUERY_NOT_ALLOWED"
+	// ErrorCodePersistedQueryRequired marks errors for query bodies sent to a gateway that only accepts static queries
+	ErrorCodePersistedQueryRequired = "PERSISTED_QUERY_REQUIRED"
+)
+
+// persistedQueryError returns the error to send the client with the given message and code
+func persistedQueryError(message string, code string) error {
+	return &graphql.Error{
+		Message:    message,
+		Extensions: map[string]interface{}{"code": code},
+	}
+}
+
+// isPersistedQueryMiss returns true if the error asks the client to send the full query
+func isPersistedQueryMiss(err error) bool {
+	gqlErr, ok := err.(*graphql.Error)
+	if !ok {
+		return false
+	}
+
+	code := gqlErr.Extensions["code"]
+	return code == ErrorCodePersistedQueryNotFound || code == ErrorCodePersistedQueryNotSupported
+}
+
 // QueryPlanCache decides when to compute a plan
 type QueryPlanCache interface {
 	Retrieve(ctx *PlanningContext, hash *string, planner QueryPlanner) ([]*QueryPlan, error)
 }
 
+// QueryPlanCacheWithWarmUp is a QueryPlanCache that computes plans before the gateway starts handling requests
+type QueryPlanCacheWithWarmUp interface {
+	WarmUp(ctx *PlanningContext, planner QueryPlanner) error
+}
+
+// QueryPlanCacheWithInvalidation is a QueryPlanCache that has to drop its plans when the
+// gateway's schema changes
+type QueryPlanCacheWithInvalidation interface {
+	Invalidate()
+}
+
+// queryPlanCacheWithGeneration is a cache that counts the times its plans were thrown away. The
+// gateway reads the count along with the schema so the plans computed for a schema that was
+// replaced while they were being computed aren't saved.
+type queryPlanCacheWithGeneration interface {
+	currentGeneration() uint64
+}
+
 // WithNoQueryPlanCache is the default option and disables any persisted query behavior
 func WithNoQueryPlanCache() Option {
 	return WithQueryPlanCache(&NoQueryPlanCache{})
 }
 
 // NoQueryPlanCache will always compute the plan for a query, regardless of the value passed as `hash`
-type NoQueryPlanCache struct{}
+type NoQueryPlanCache struct {
+	// every retrieval is a miss
+	misses uint64
+}
 
-// Retrieve just computes the query plan
+// Stats returns the current counters of the cache. Since nothing is saved, every plan is a miss.
+func (p *NoQueryPlanCache) Stats() QueryPlanCacheStats {
+	return QueryPlanCacheStats{
+		Misses: atomic.LoadUint64(&p.misses),
+	}
+}
+
+// Retrieve just computes the query plan. Since nothing is saved, a hash without a query can't be executed.
 func (p *NoQueryPlanCache) Retrieve(ctx *PlanningContext, hash *string, planner QueryPlanner) ([]*QueryPlan, error) {
+	atomic.AddUint64(&p.misses, 1)
+
+	if ctx != nil && ctx.Query == "" && *hash != "" {
+		return nil, persistedQueryError(MessagePersistedQueriesNotSupported, ErrorCodePersistedQueryNotSupported)
+	}
+
 	return planner.Plan(ctx)
 }
 
@@ -72,123 +164,374 @@ func WithAutomaticQueryPlanCache() Option {
 	return WithQueryPlanCache(NewAutomaticQueryPlanCache())
 }
 
+// WithStaticQueryPlanCache enables the "static persisted query" technique with the given manifest
+// of hashes and queries
+func WithStaticQueryPlanCache(manifest map[string]string) Option {
+	return WithQueryPlanCache(NewStaticQueryPlanCache(manifest))
+}
+
+// StaticQueryPlanCache is a QueryPlanCache that only executes the queries in a manifest that maps
+// hashes to query bodies. The plans for every query are computed when the gateway is created and
+// computed again the next time they are used after the cache is invalidated.
+type StaticQueryPlanCache struct {
+	manifest map[string]string
+	plans    map[string][]*QueryPlan
+	strict   bool
+
+	// the plans are recomputed when the gateway reloads its sources
+	lock sync.RWMutex
+	// bumped every time the plans are replaced so that plans computed before then aren't saved
+	generation uint64
+
+	// counters
+	hits   uint64
+	misses uint64
+}
+
+// NewStaticQueryPlanCache returns a StaticQueryPlanCache for the given manifest
+func NewStaticQueryPlanCache(manifest map[string]string) *StaticQueryPlanCache {
+	return &StaticQueryPlanCache{
+		manifest: manifest,
+		plans:    map[string][]*QueryPlan{},
+	}
+}
+
+// LoadQueryManifest reads a manifest of static persisted queries from a JSON file that
+// maps each hash to its query
+func LoadQueryManifest(path string) (map[string]string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := map[string]string{}
+	if err := json.Unmarshal(contents, &manifest); err != nil {
+		return nil, fmt.Errorf("could not parse query manifest: %s", err.Error())
+	}
+
+	return manifest, nil
+}
+
+// WithStrictMode updates and returns the cache so that it rejects any request that
+// sends a query body instead of a hash
+func (c *StaticQueryPlanCache) WithStrictMode() *StaticQueryPlanCache {
+	c.strict = true
+	return c
+}
+
+// WarmUp computes the plans for every query in the manifest. An error planning any of
+// the queries is returned so that a bad manifest is caught when the gateway starts. The
+// queries have to be saved under the sha256 hash of their body since that's what clients
+// send along with them.
+func (c *StaticQueryPlanCache) WarmUp(ctx *PlanningContext, planner QueryPlanner) error {
+	plans := map[string][]*QueryPlan{}
+
+	for hash, query := range c.manifest {
+		if hash != queryHash(query) {
+			return fmt.Errorf("persisted query %s is not saved under the sha256 hash of its query", hash)
+		}
+
+		plan, err := c.plan(ctx, planner, query)
+		if err != nil {
+			return fmt.Errorf("could not plan persisted query %s: %s", hash, err.Error())
+		}
+
+		plans[hash] = plan
+	}
+
+	c.lock.Lock()
+	c.plans = plans
+	c.generation++
+	c.lock.Unlock()
+
+	return nil
+}
+
+// Invalidate drops the plans of the manifest so that they are computed again the next time they are used
+func (c *StaticQueryPlanCache) Invalidate() {
+	c.lock.Lock()
+	c.plans = map[string][]*QueryPlan{}
+	c.generation++
+	c.lock.Unlock()
+}
+
+// Stats returns the current counters of the cache. Only the plans of the manifest are kept so
+// every request without a hash is a miss.
+func (c *StaticQueryPlanCache) Stats() QueryPlanCacheStats {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return QueryPlanCacheStats{
+		Hits:    atomic.LoadUint64(&c.hits),
+		Misses:  atomic.LoadUint64(&c.misses),
+		Entries: len(c.plans),
+	}
+}
+
+func (c *StaticQueryPlanCache) currentGeneration() uint64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.generation
+}
+
+// Retrieve returns the plan for the hash if it is in the manifest. Requests without a hash
+// are planned like normal unless the cache is in strict mode.
+func (c *StaticQueryPlanCache) Retrieve(ctx *PlanningContext, hash *string, planner QueryPlanner) ([]*QueryPlan, error) {
+	// if we were given a hash, it has to be one we know about
+	if *hash != "" {
+		query, ok := c.manifest[*hash]
+		if !ok {
+			atomic.AddUint64(&c.misses, 1)
+			return nil, persistedQueryError(MessageUnknownStaticQuery, ErrorCodePersistedQueryNotAllowed)
+		}
+
+		c.lock.RLock()
+		plan, ok := c.plans[*hash]
+		generation := c.generation
+		c.lock.RUnlock()
+		if ctx.cacheGeneration != nil {
+			generation = *ctx.cacheGeneration
+		}
+		if ok {
+			atomic.AddUint64(&c.hits, 1)
+			return plan, nil
+		}
+		atomic.AddUint64(&c.misses, 1)
+
+		// the plan was thrown away when the cache was invalidated
+		plan, err := c.plan(ctx, planner, query)
+		if err != nil {
+			return nil, err
+		}
+
+		// unless the plans were replaced while we were computing this one
+		c.lock.Lock()
+		if generation == c.generation {
+			c.plans[*hash] = plan
+		}
+		c.lock.Unlock()
+
+		return plan, nil
+	}
+
+	// queries without a hash are never saved
+	atomic.AddUint64(&c.misses, 1)
+
+	// in strict mode, the only queries we can execute are the ones in the manifest
+	if c.strict {
+		return nil, persistedQueryError(MessageStaticQueriesOnly, ErrorCodePersistedQueryRequired)
+	}
+
+	// if we were not given a query string
+	if ctx.Query == "" {
+		return nil, persistedQueryError(MessageMissingCachedQuery, ErrorCodePersistedQueryNotFound)
+	}
+
+	return planner.Plan(ctx)
+}
+
+// plan computes the plans for a query in the manifest. The planner checks that the document has the
+// requested operation so we ask for the first one. The plans for the rest of the operations are computed too.
+func (c *StaticQueryPlanCache) plan(ctx *PlanningContext, planner QueryPlanner, query string) ([]*QueryPlan, error) {
+	queryCtx := *ctx
+	queryCtx.Query = query
+	queryCtx.OperationName = ""
+
+	// the planner reports the documents that can't be parsed
+	if document, err := parser.ParseQuery(&ast.Source{Input: query}); err == nil && len(document.Operations) > 0 {
+		queryCtx.OperationName = document.Operations[0].Name
+	}
+
+	return planner.Plan(&queryCtx)
+}
+
 type queryPlanCacheItem struct {
+	Key      string
 	LastUsed time.Time
 	Value    []*QueryPlan
+	Size     int
+}
+
+// QueryPlanCacheStats holds the counters of a query plan cache
+type QueryPlanCacheStats struct {
+	// Hits is the number of times a plan was found in the cache
+	Hits uint64
+	// Misses is the number of times a plan had to be computed (or the query was unknown)
+	Misses uint64
+	// Evictions is the number of plans that were removed to keep the cache within its bounds
+	Evictions uint64
+	// Expirations is the number of plans that were removed because they weren't used within the TTL
+	Expirations uint64
+	// Entries is the number of plans currently in the cache
+	Entries int
+	// Size is the approximate size of the plans currently in the cache
+	Size int
 }
 
 // AutomaticQueryPlanCache is a QueryPlanCache that will use the hash if it points to a known query plan,
 // otherwise it will compute the plan and save it for later, to be referenced by the designated hash.
+// The cache is safe for concurrent use and can be bounded by the number of entries or the approximate
+// size of the plans it holds, in which case the least recently used plans are evicted first.
 type AutomaticQueryPlanCache struct {
-	cache map[string]*queryPlanCacheItem
-	ttl   time.Duration
-	// the automatic query plan cache needs to clear itself of query plans that have been used
-	// recently. This coordination requires a channel over which events can be trigger whenever
-	// a query is fired, triggering a check to clean up other queries.
-	retrievedPlan chan bool
-	// a boolean to track if there is a timer that needs to be reset
-	resetTimer bool
-	// a mutex on the timer bool
-	timeMutex sync.Mutex
+	// the cached plans, indexed by their hash and ordered from most to least recently used
+	entries map[string]*list.Element
+	lru     *list.List
+	size    int
+	lock    sync.Mutex
+
+	// configuration
+	ttl        time.Duration
+	maxEntries int
+	maxSize    int
+	// the store holds on to the query bodies so that hashes registered with one gateway
+	// can be used with another
+	store QueryStore
+
+	// a single janitor cleans up plans that haven't been used within the TTL. It is only
+	// running while there are plans in the cache.
+	janitorRunning bool
+
+	// bumped every time the cache is invalidated so that plans computed before then aren't saved
+	generation uint64
+
+	// counters
+	hits        uint64
+	misses      uint64
+	evictions   uint64
+	expirations uint64
 }
 
 // WithCacheTTL updates and returns the cache with the new cache lifetime. Queries that haven't been
-// used in that long are cleaned up on the next query.
+// used in that long are cleaned up.
 func (c *AutomaticQueryPlanCache) WithCacheTTL(duration time.Duration) *AutomaticQueryPlanCache {
-	return &AutomaticQueryPlanCache{
-		cache:         c.cache,
-		ttl:           duration,
-		retrievedPlan: c.retrievedPlan,
-		resetTimer:    c.resetTimer,
-	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.ttl = duration
+	return c
+}
+
+// WithMaxEntries updates and returns the cache so that it holds at most the given number of plans.
+// A value of 0 means there is no limit.
+func (c *AutomaticQueryPlanCache) WithMaxEntries(entries int) *AutomaticQueryPlanCache {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.maxEntries = entries
+	c.evict()
+	return c
+}
+
+// WithMaxSize updates and returns the cache so that the approximate size of the plans it holds, measured
+// by the length of the queries they send, stays under the given number of bytes. A value of 0 means there
+// is no limit.
+func (c *AutomaticQueryPlanCache) WithMaxSize(size int) *AutomaticQueryPlanCache {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.maxSize = size
+	c.evict()
+	return c
+}
+
+// WithQueryStore updates and returns the cache with a store that keeps track of the query bodies
+// behind each hash. When the cache doesn't have a plan for a hash, it will look for the query in
+// the store before asking the client for it.
+func (c *AutomaticQueryPlanCache) WithQueryStore(store QueryStore) *AutomaticQueryPlanCache {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.store = store
+	return c
 }
 
 // NewAutomaticQueryPlanCache returns a fresh instance of
 func NewAutomaticQueryPlanCache() *AutomaticQueryPlanCache {
 	return &AutomaticQueryPlanCache{
-		cache: map[string]*queryPlanCacheItem{},
-		// default cache lifetime of 3 days
-		ttl:           10 * 24 * time.Hour,
-		retrievedPlan: make(chan bool),
-		resetTimer:    false,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+		// default cache lifetime of 10 days
+		ttl: 10 * 24 * time.Hour,
+	}
+}
+
+// Stats returns the current counters of the cache
+func (c *AutomaticQueryPlanCache) Stats() QueryPlanCacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return QueryPlanCacheStats{
+		Hits:        atomic.LoadUint64(&c.hits),
+		Misses:      atomic.LoadUint64(&c.misses),
+		Evictions:   atomic.LoadUint64(&c.evictions),
+		Expirations: atomic.LoadUint64(&c.expirations),
+		Entries:     c.lru.Len(),
+		Size:        c.size,
 	}
 }
 
+// Invalidate drops every plan in the cache. The query store is left alone since the
+// queries it holds are still valid, they just have to be planned again.
+func (c *AutomaticQueryPlanCache) Invalidate() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.entries = map[string]*list.Element{}
+	c.lru.Init()
+	c.size = 0
+	c.generation++
+}
+
+func (c *AutomaticQueryPlanCache) currentGeneration() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.generation
+}
+
 // Retrieve follows the "automatic query persistance" technique. If the hash is known, it will use the referenced query plan.
 // If the hash is not know but the query is provided, it will compute the plan, return it, and save it for later use.
 // If the hash is not known and the query is not provided, it will return with an error prompting the client to provide the hash and query
 func (c *AutomaticQueryPlanCache) Retrieve(ctx *PlanningContext, hash *string, planner QueryPlanner) ([]*QueryPlan, error) {
-
-	// when we're done with retrieving the value we have to clear the cache
-	defer func() {
-		// spawn a goroutine that might be responsible for clearing the cache
-		go func() {
-			// check if there is a timer to reset
-			c.timeMutex.Lock()
-			resetTimer := c.resetTimer
-			c.timeMutex.Unlock()
-
-			// if there is already a goroutine that's waiting to clean things up
-			if resetTimer {
-				// just reset their time
-				c.retrievedPlan <- true
-				// and we're done
-				return
-			}
-			c.timeMutex.Lock()
-			c.resetTimer = true
-			c.timeMutex.Unlock()
-
-			// otherwise this is the goroutine responsible for cleaning up the cache
-			timer := time.NewTimer(c.ttl)
-
-			// we will have to consume more than one input
-		TRUE_LOOP:
-			for {
-				select {
-				// if another plan was retrieved
-				case <-c.retrievedPlan:
-					// reset the time
-					timer.Reset(c.ttl)
-
-				// if the timer dinged
-				case <-timer.C:
-					// there is no longer a timer to reset
-					c.timeMutex.Lock()
-					c.resetTimer = false
-					c.timeMutex.Unlock()
-
-					// loop over every time in the cache
-					for key, cacheItem := range c.cache {
-						// if the cached query hasn't been used recently enough
-						if cacheItem.LastUsed.Before(time.Now().Add(-c.ttl)) {
-							// delete it from the cache
-							delete(c.cache, key)
-						}
-					}
-
-					// stop consuming
-					break TRUE_LOOP
-				}
-			}
-
-		}()
-	}()
-
 	// if we have a cached value for the hash
-	if cached, hasCachedValue := c.cache[*hash]; hasCachedValue {
-		// update the last used
-		cached.LastUsed = time.Now()
-		// return it
-		return cached.Value, nil
+	if cached, hasCachedValue := c.get(*hash); hasCachedValue {
+		atomic.AddUint64(&c.hits, 1)
+		return cached, nil
 	}
 
 	// we dont have a cached value
+	atomic.AddUint64(&c.misses, 1)
+
+	c.lock.Lock()
+	store := c.store
+	generation := c.generation
+	c.lock.Unlock()
+	if ctx.cacheGeneration != nil {
+		generation = *ctx.cacheGeneration
+	}
+
+	// if we were not given a query string, another gateway might know about it
+	if ctx.Query == "" && *hash != "" && store != nil {
+		query, found, err := store.Get(strings.ToLower(*hash))
+		if err != nil {
+			// if we can't reach the store, treat the hash as unknown
+			ctx.logger().Warn("Encountered error looking up persisted query: ", err.Error())
+		} else if found && queryHash(query) != strings.ToLower(*hash) {
+			// a store that hands back the wrong query can't be trusted with this hash
+			ctx.logger().Warn("Persisted query does not match its hash: ", *hash)
+		} else if found {
+			// plan the stored query without touching the caller's context
+			storedCtx := *ctx
+			storedCtx.Query = query
+			ctx = &storedCtx
+		}
+	}
 
 	// if we were not given a query string
 	if ctx.Query == "" {
 		// return an error with the magic string
-		return nil, errors.New(MessageMissingCachedQuery)
+		return nil, persistedQueryError(MessageMissingCachedQuery, ErrorCodePersistedQueryNotFound)
 	}
 
 	// compute the plan
@@ -199,17 +542,257 @@ func (c *AutomaticQueryPlanCache) Retrieve(ctx *PlanningContext, hash *string, p
 
 	// if there is no hash
 	if *hash == "" {
-		hashString := sha256.Sum256([]byte(ctx.Query))
 		// generate a hash that will identify the query for later use
-		*hash = hex.EncodeToString(hashString[:])
+		*hash = queryHash(ctx.Query)
+	}
+
+	// share the query with everyone else using the store. other gateways trust the store so it
+	// only gets queries that match their hash
+	if store != nil && strings.EqualFold(*hash, queryHash(ctx.Query)) {
+		if err := store.Set(strings.ToLower(*hash), ctx.Query); err != nil {
+			// the plan is still good for this gateway
+			ctx.logger().Warn("Encountered error saving persisted query: ", err.Error())
+		}
 	}
 
 	// save it for later
-	c.cache[*hash] = &queryPlanCacheItem{
+	c.set(*hash, ctx.Query, plan, generation)
+
+	// we're done
+	return plan, nil
+}
+
+// get returns the plan for the hash if it's in the cache and hasn't expired
+func (c *AutomaticQueryPlanCache) get(hash string) ([]*QueryPlan, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, ok := c.entries[hash]
+	if !ok {
+		return nil, false
+	}
+	item := element.Value.(*queryPlanCacheItem)
+
+	// the janitor might not have gotten to this one yet
+	if time.Since(item.LastUsed) > c.ttl {
+		c.remove(element)
+		atomic.AddUint64(&c.expirations, 1)
+		return nil, false
+	}
+
+	// this plan is now the most recently used
+	item.LastUsed = time.Now()
+	c.lru.MoveToFront(element)
+
+	return item.Value, true
+}
+
+// set saves the plan under the hash and evicts old plans if the cache has grown too big
+func (c *AutomaticQueryPlanCache) set(hash string, query string, plan []*QueryPlan, generation uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// the plan could have been computed against a schema we no longer serve
+	if generation != c.generation {
+		return
+	}
+
+	item := &queryPlanCacheItem{
+		Key:      hash,
 		LastUsed: time.Now(),
 		Value:    plan,
+		Size:     queryPlanSize(query, plan),
 	}
 
-	// we're done
-	return plan, nil
+	// replace any existing plan for the hash
+	if element, ok := c.entries[hash]; ok {
+		c.remove(element)
+	}
+	c.entries[hash] = c.lru.PushFront(item)
+	c.size += item.Size
+
+	c.evict()
+
+	// make sure there is someone to clean up the plan when it expires
+	if !c.janitorRunning && c.lru.Len() > 0 {
+		c.janitorRunning = true
+		go c.janitor()
+	}
+}
+
+// evict removes the least recently used plans until the cache is within its bounds. The caller must hold the lock.
+func (c *AutomaticQueryPlanCache) evict() {
+	for c.lru.Len() > 0 && ((c.maxEntries > 0 && c.lru.Len() > c.maxEntries) || (c.maxSize > 0 && c.size > c.maxSize)) {
+		c.remove(c.lru.Back())
+		atomic.AddUint64(&c.evictions, 1)
+	}
+}
+
+// remove takes the element out of the cache. The caller must hold the lock.
+func (c *AutomaticQueryPlanCache) remove(element *list.Element) {
+	item := element.Value.(*queryPlanCacheItem)
+
+	c.lru.Remove(element)
+	delete(c.entries, item.Key)
+	c.size -= item.Size
+}
+
+// janitor periodically removes the plans that haven't been used within the TTL. It stops once the
+// cache is empty and is started again when the next plan is added.
+func (c *AutomaticQueryPlanCache) janitor() {
+	for {
+		c.lock.Lock()
+		ttl := c.ttl
+		c.lock.Unlock()
+
+		time.Sleep(ttl)
+
+		c.lock.Lock()
+		// the least recently used plans are at the back of the list
+		for element := c.lru.Back(); element != nil; element = c.lru.Back() {
+			if time.Since(element.Value.(*queryPlanCacheItem).LastUsed) <= c.ttl {
+				break
+			}
+
+			c.remove(element)
+			atomic.AddUint64(&c.expirations, 1)
+		}
+
+		// if there's nothing left to clean up then we're done
+		if c.lru.Len() == 0 {
+			c.janitorRunning = false
+			c.lock.Unlock()
+			return
+		}
+		c.lock.Unlock()
+	}
+}
+
+// queryPlanSize approximates the amount of memory used by a plan with the length of the query
+// along with the queries it sends to each service
+func queryPlanSize(query string, plans []*QueryPlan) int {
+	size := len(query)
+
+	// walk every step in every plan
+	steps := []*QueryPlanStep{}
+	for _, plan := range plans {
+		if plan.RootStep != nil {
+			steps = append(steps, plan.RootStep)
+		}
+	}
+	for len(steps) > 0 {
+		step := steps[0]
+		steps = append(steps[1:], step.Then...)
+
+		size += len(step.QueryString)
+	}
+
+	return size
+}
+
+// QueryStore holds the body of queries by their hash so that they can be shared between multiple
+// instances of the gateway. Plans hold on to the queryers used to execute them so the store only
+// keeps track of the query text and each gateway computes the plan when it first sees a hash.
+// Hashes are the lowercase hex encoding of the sha256 of the query. Implementations must be safe
+// for concurrent use and should refuse queries that don't match their hash.
+type QueryStore interface {
+	Get(hash string) (query string, found bool, err error)
+	Set(hash string, query string) error
+}
+
+// FileQueryStore is a QueryStore that saves each query in its own file inside of a directory. The
+// directory can be shared between gateways with a network filesystem or mounted volume.
+type FileQueryStore struct {
+	Dir string
+}
+
+// NewFileQueryStore returns a FileQueryStore that saves queries in the given directory, creating it
+// if necessary
+func NewFileQueryStore(dir string) (*FileQueryStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &FileQueryStore{Dir: dir}, nil
+}
+
+// Get returns the query associated with the hash
+func (s *FileQueryStore) Get(hash string) (string, bool, error) {
+	hash = strings.ToLower(hash)
+
+	// hashes that could point outside of the directory are never stored
+	if !validQueryHash(hash) {
+		return "", false, nil
+	}
+
+	contents, err := ioutil.ReadFile(s.path(hash))
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	// someone else could have written to the directory
+	if queryHash(string(contents)) != hash {
+		return "", false, errors.New("stored query does not match its hash")
+	}
+
+	return string(contents), true, nil
+}
+
+// Set saves the query under the hash
+func (s *FileQueryStore) Set(hash string, query string) error {
+	hash = strings.ToLower(hash)
+
+	if !validQueryHash(hash) {
+		return errors.New("invalid query hash")
+	}
+
+	// the other gateways will run whatever is saved under the hash
+	if queryHash(query) != hash {
+		return errors.New("query does not match its hash")
+	}
+
+	// write to a temporary file first so that other gateways never read part of a query
+	tmpFile, err := ioutil.TempFile(s.Dir, hash+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.WriteString(query); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), s.path(hash))
+}
+
+func (s *FileQueryStore) path(hash string) string {
+	return filepath.Join(s.Dir, hash+".graphql")
+}
+
+// queryHash returns the hash that identifies the query in a QueryStore
+func queryHash(query string) string {
+	hash := sha256.Sum256([]byte(query))
+	return hex.EncodeToString(hash[:])
+}
+
+// validQueryHash returns true if the hash is safe to use as a key in a store
+func validQueryHash(hash string) bool {
+	if hash == "" {
+		return false
+	}
+
+	for _, char := range hash {
+		if !(char >= 'a' && char <= 'z') && !(char >= 'A' && char <= 'Z') && !(char >= '0' && char <= '9') {
+			return false
+		}
+	}
+
+	return true
 }
@@ -2,11 +2,18 @@ package gateway
 
 import (
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/nautilus/graphql"
 	"github.com/stretchr/testify/assert"
+	"github.com/vektah/gqlparser/ast"
 )
 
 // MockPlanner always returns the provided list of plans. Useful in testing.
@@ -191,3 +198,406 @@ func TestAutomaticQueryPlanCache_garbageCollection(t *testing.T) {
 	// we should have only generated the plan twice now (once more than before)
 	assert.Equal(t, 2, planner.Count)
 }
+
+// testQueryStore is an in-memory QueryStore
+type testQueryStore struct {
+	queries map[string]string
+	lock    sync.Mutex
+}
+
+func (s *testQueryStore) Get(hash string) (string, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	query, ok := s.queries[hash]
+	return query, ok, nil
+}
+
+func (s *testQueryStore) Set(hash string, query string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.queries[hash] = query
+	return nil
+}
+
+func TestAutomaticQueryPlanCache_queryStore(t *testing.T) {
+	cacheKey := queryHash("hello")
+	// the store shared by both caches
+	store := &testQueryStore{queries: map[string]string{}}
+
+	// two gateways sharing the same store
+	planner1 := &testPlannerCounter{Plans: []*QueryPlan{}}
+	cache1 := NewAutomaticQueryPlanCache().WithQueryStore(store)
+	planner2 := &testPlannerCounter{Plans: []*QueryPlan{}}
+	cache2 := NewAutomaticQueryPlanCache().WithQueryStore(store)
+
+	// register the query with the first cache
+	_, err := cache1.Retrieve(&PlanningContext{Query: "hello"}, &cacheKey, planner1)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, map[string]string{cacheKey: "hello"}, store.queries)
+
+	// the second cache should be able to plan the query with just the hash
+	ctx := &PlanningContext{}
+	_, err = cache2.Retrieve(ctx, &cacheKey, planner2)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, 1, planner2.Count)
+	// without modifying the context it was given
+	assert.Equal(t, "", ctx.Query)
+
+	// and the plan should be cached after that
+	_, err = cache2.Retrieve(&PlanningContext{}, &cacheKey, planner2)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, 1, planner2.Count)
+
+	// unknown hashes are still unknown
+	unknownKey := "unknown"
+	_, err = cache2.Retrieve(&PlanningContext{}, &unknownKey, planner2)
+	if !assert.NotNil(t, err) {
+		return
+	}
+	assert.Equal(t, MessageMissingCachedQuery, err.Error())
+
+	// queries that don't match their hash are never shared
+	otherKey := "asdf"
+	_, err = cache1.Retrieve(&PlanningContext{Query: "goodbye"}, &otherKey, planner1)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, map[string]string{cacheKey: "hello"}, store.queries)
+
+	// and the store can't hand back a different query for a hash
+	store.queries[otherKey] = "goodbye"
+	_, err = cache2.Retrieve(&PlanningContext{}, &otherKey, planner2)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, MessageMissingCachedQuery, err.Error())
+	}
+}
+
+// testInvalidatingPlanner invalidates the cache while it is computing a plan, like a reload would
+type testInvalidatingPlanner struct {
+	cache QueryPlanCacheWithInvalidation
+}
+
+func (p *testInvalidatingPlanner) Plan(*PlanningContext) ([]*QueryPlan, error) {
+	p.cache.Invalidate()
+	return []*QueryPlan{}, nil
+}
+
+func TestAutomaticQueryPlanCache_invalidatedWhilePlanning(t *testing.T) {
+	cache := NewAutomaticQueryPlanCache()
+	cacheKey := "asdf"
+
+	// the plan is still handed back to the request that computed it
+	_, err := cache.Retrieve(&PlanningContext{Query: "{ hello }"}, &cacheKey, &testInvalidatingPlanner{cache: cache})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// but it was computed before the invalidation so it shouldn't have been saved
+	_, err = cache.Retrieve(&PlanningContext{}, &cacheKey, &testPlannerCounter{})
+	if assert.NotNil(t, err) {
+		assert.Equal(t, MessageMissingCachedQuery, err.Error())
+	}
+}
+
+func TestFileQueryStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "query-store")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// create a store in a directory that doesn't exist yet
+	store, err := NewFileQueryStore(filepath.Join(dir, "queries"))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	hash := queryHash("{ hello }")
+
+	// unknown hashes aren't found
+	_, found, err := store.Get(hash)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.False(t, found)
+
+	// save a query and read it back
+	if !assert.Nil(t, store.Set(hash, "{ hello }")) {
+		return
+	}
+	query, found, err := store.Get(hash)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.True(t, found)
+	assert.Equal(t, "{ hello }", query)
+
+	// a second store pointed at the same directory sees the same queries
+	otherStore, err := NewFileQueryStore(filepath.Join(dir, "queries"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	query, found, _ = otherStore.Get(strings.ToUpper(hash))
+	assert.True(t, found)
+	assert.Equal(t, "{ hello }", query)
+
+	// queries have to match their hash
+	assert.NotNil(t, store.Set(hash, "{ goodbye }"))
+	assert.NotNil(t, store.Set(queryHash("{ goodbye }"), "{ hello }"))
+
+	// hashes that could point outside of the directory are rejected
+	assert.NotNil(t, store.Set("../hello", "{ hello }"))
+	_, found, err = store.Get("../queries/" + hash)
+	assert.Nil(t, err)
+	assert.False(t, found)
+}
+
+func TestStaticQueryPlanCache(t *testing.T) {
+	// instantiate a planner that can count how many times it was invoked
+	planner := &testPlannerCounter{
+		Plans: []*QueryPlan{},
+	}
+
+	cache := NewStaticQueryPlanCache(map[string]string{
+		queryHash("{ hello }"):   "{ hello }",
+		queryHash("{ goodbye }"): "{ goodbye }",
+	})
+
+	// warming up the cache should compute every plan
+	if !assert.Nil(t, cache.WarmUp(&PlanningContext{}, planner)) {
+		return
+	}
+	assert.Equal(t, 2, planner.Count)
+
+	// known hashes use the computed plan
+	cacheKey := queryHash("{ hello }")
+	plans, err := cache.Retrieve(&PlanningContext{}, &cacheKey, planner)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, planner.Plans, plans)
+	assert.Equal(t, 2, planner.Count)
+
+	// unknown hashes are rejected, even with a query
+	unknownKey := "unknown"
+	_, err = cache.Retrieve(&PlanningContext{Query: "{ hello }"}, &unknownKey, planner)
+	if !assert.NotNil(t, err) {
+		return
+	}
+	assert.Equal(t, MessageUnknownStaticQuery, err.Error())
+
+	// queries without a hash are planned like usual
+	emptyKey := ""
+	_, err = cache.Retrieve(&PlanningContext{Query: "{ hello }"}, &emptyKey, planner)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, 3, planner.Count)
+
+	// unless the cache is in strict mode
+	strictCache := cache.WithStrictMode()
+	_, err = strictCache.Retrieve(&PlanningContext{Query: "{ hello }"}, &emptyKey, planner)
+	if !assert.NotNil(t, err) {
+		return
+	}
+	assert.Equal(t, MessageStaticQueriesOnly, err.Error())
+
+	// which is the same cache so invalidating one of them can't leave the other behind
+	assert.True(t, strictCache == cache)
+
+	// strict mode still knows about the hashes in the manifest
+	_, err = strictCache.Retrieve(&PlanningContext{}, &cacheKey, planner)
+	assert.Nil(t, err)
+
+	// once the cache is invalidated, the plans are computed again when they are used
+	cache.Invalidate()
+	_, err = cache.Retrieve(&PlanningContext{}, &cacheKey, planner)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, 4, planner.Count)
+	_, err = cache.Retrieve(&PlanningContext{}, &cacheKey, planner)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, 4, planner.Count)
+}
+
+func TestStaticQueryPlanCache_gateway(t *testing.T) {
+	schema, _ := graphql.LoadSchema(`
+		type Query {
+			value: String!
+		}
+	`)
+	sources := []*graphql.RemoteSchema{{URL: "url1", Schema: schema}}
+
+	// a manifest with a bad query should fail when the gateway starts up
+	_, err := New(sources, WithStaticQueryPlanCache(map[string]string{
+		queryHash("{ notAField }"): "{ notAField }",
+	}))
+	assert.NotNil(t, err)
+
+	// and so should one that doesn't save the queries under their hash
+	_, err = New(sources, WithStaticQueryPlanCache(map[string]string{
+		"hash1": "{ value }",
+	}))
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "persisted query hash1 is not saved under the sha256 hash of its query", err.Error())
+	}
+
+	// a valid manifest lets us retrieve plans by hash
+	gw, err := New(sources, WithStaticQueryPlanCache(map[string]string{
+		queryHash("{ value }"): "{ value }",
+	}))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	plans, err := gw.GetPlan(&RequestContext{CacheKey: queryHash("{ value }")})
+	if !assert.Nil(t, err) || !assert.Len(t, plans, 1) {
+		return
+	}
+	assert.Equal(t, "value", plans[0].Operation.SelectionSet[0].(*ast.Field).Name)
+
+	// documents with more than one operation can be in the manifest too
+	multiple := "query First { value } query Second { other: value }"
+	gw, err = New(sources, WithStaticQueryPlanCache(map[string]string{
+		queryHash(multiple): multiple,
+	}))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	plans, err = gw.GetPlan(&RequestContext{CacheKey: queryHash(multiple), OperationName: "Second"})
+	if !assert.Nil(t, err) {
+		return
+	}
+	plan, err := selectPlan(plans, "Second")
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, "other", plan.Operation.SelectionSet[0].(*ast.Field).Alias)
+}
+
+func TestLoadQueryManifest(t *testing.T) {
+	file, err := ioutil.TempFile("", "manifest")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.Remove(file.Name())
+
+	file.WriteString(`{"hash1": "{ value }"}`)
+	file.Close()
+
+	manifest, err := LoadQueryManifest(file.Name())
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, map[string]string{"hash1": "{ value }"}, manifest)
+}
+
+func TestAutomaticQueryPlanCache_lru(t *testing.T) {
+	// instantiate a planner that can count how many times it was invoked
+	planner := &testPlannerCounter{
+		Plans: []*QueryPlan{},
+	}
+
+	// a cache that can only hold 2 plans
+	cache := NewAutomaticQueryPlanCache().WithMaxEntries(2)
+
+	retrieve := func(hash string, query string) {
+		_, err := cache.Retrieve(&PlanningContext{Query: query}, &hash, planner)
+		assert.Nil(t, err)
+	}
+
+	// fill up the cache
+	retrieve("a", "{ a }")
+	retrieve("b", "{ b }")
+	// use a so that b is the least recently used
+	retrieve("a", "")
+	// adding a third plan should evict b
+	retrieve("c", "{ c }")
+	assert.Equal(t, 3, planner.Count)
+
+	// a is still around
+	retrieve("a", "")
+	assert.Equal(t, 3, planner.Count)
+
+	// but b is not
+	hash := "b"
+	_, err := cache.Retrieve(&PlanningContext{}, &hash, planner)
+	if !assert.NotNil(t, err) {
+		return
+	}
+	assert.Equal(t, MessageMissingCachedQuery, err.Error())
+
+	assert.Equal(t, QueryPlanCacheStats{
+		Hits:      2,
+		Misses:    4,
+		Evictions: 1,
+		Entries:   2,
+		Size:      len("{ a }") + len("{ c }"),
+	}, cache.Stats())
+}
+
+func TestAutomaticQueryPlanCache_maxSize(t *testing.T) {
+	// instantiate a planner that can count how many times it was invoked
+	planner := &testPlannerCounter{
+		Plans: []*QueryPlan{
+			{RootStep: &QueryPlanStep{Then: []*QueryPlanStep{{QueryString: "{ value }"}}}},
+		},
+	}
+
+	// each plan takes up the length of the query plus the query it sends
+	planSize := len("{ a }") + len("{ value }")
+	cache := NewAutomaticQueryPlanCache().WithMaxSize(2 * planSize)
+
+	for _, hash := range []string{"a", "b", "c"} {
+		key := hash
+		_, err := cache.Retrieve(&PlanningContext{Query: "{ " + hash + " }"}, &key, planner)
+		if !assert.Nil(t, err) {
+			return
+		}
+	}
+
+	stats := cache.Stats()
+	assert.Equal(t, 2, stats.Entries)
+	assert.Equal(t, 2*planSize, stats.Size)
+	assert.Equal(t, uint64(1), stats.Evictions)
+}
+
+func TestAutomaticQueryPlanCache_concurrentAccess(t *testing.T) {
+	// a planner that is safe to call from multiple goroutines
+	planner := &MockPlanner{Plans: []*QueryPlan{}}
+
+	// a small cache so that we are constantly evicting plans
+	cache := NewAutomaticQueryPlanCache().WithMaxEntries(5).WithCacheTTL(10 * time.Millisecond)
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 50; j++ {
+				hash := fmt.Sprintf("hash-%d", (i+j)%10)
+				_, err := cache.Retrieve(&PlanningContext{Query: "{ value }"}, &hash, planner)
+				assert.Nil(t, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// every request was either a hit or a miss
+	stats := cache.Stats()
+	assert.Equal(t, uint64(20*50), stats.Hits+stats.Misses)
+	assert.True(t, stats.Entries <= 5)
+}
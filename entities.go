@@ -0,0 +1,192 @@
+package gateway
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/vektah/gqlparser/ast"
+)
+
+// EntityResolver is a field on the Query type of a service that looks up an object by its key. Services
+// that don't implement the Node interface can use one to add fields to types from other services.
+type EntityResolver struct {
+	// Field is the name of the field that looks up the object, like "postById". If the argument
+	// takes a list, like products(ids:), the object is the first entry of the result.
+	Field string
+	// Argument is the name of the argument that takes the key. It defaults to "id".
+	Argument string
+	// Key is the field of the object that holds the value of the argument. It defaults to "id".
+	Key string
+}
+
+// EntityResolvers holds the resolvers of each service by its url and then the name of the type
+type EntityResolvers map[string]map[string]EntityResolver
+
+// PlannerWithEntityResolvers is an interface for planners that can look up objects with something
+// other than node(id:)
+type PlannerWithEntityResolvers interface {
+	WithEntityResolvers(EntityResolvers) QueryPlanner
+}
+
+// WithEntityResolver returns an Option that makes the gateway look up objects of the given type at the
+// service with the resolver instead of node(id:)
+func WithEntityResolver(url string, typeName string, resolver EntityResolver) Option {
+	return func(g *Gateway) {
+		if g.entityResolvers == nil {
+			g.entityResolvers = EntityResolvers{}
+		}
+		if g.entityResolvers[url] == nil {
+			g.entityResolvers[url] = map[string]EntityResolver{}
+		}
+
+		g.entityResolvers[url][typeName] = resolver
+	}
+}
+
+// WithEntityResolvers returns a version of the planner that looks up objects with the given resolvers
+func (p *MinQueriesPlanner) WithEntityResolvers(resolvers EntityResolvers) QueryPlanner {
+	p.Planner.EntityResolvers = resolvers
+	return p
+}
+
+// entityResolver returns the resolver that the service at the location looks up objects of the type
+// with. nil means the service looks them up with node(id:).
+func (p *Planner) entityResolver(federation Federation, location string, typeName string) *EntityResolver {
+	// the key of the type in the schema of the service is the default for its resolvers
+	key := "id"
+	federated := federation.typeAt(location, typeName)
+	if federated != nil && federated.Key != "" {
+		key = federated.Key
+	}
+
+	resolver, ok := p.EntityResolvers[location][typeName]
+	if !ok {
+		// services that declare a key for the type can look it up with _entities
+		if federated == nil || federated.Key == "" || !federation.entities(location) {
+			return nil
+		}
+
+		return &EntityResolver{Field: federationEntitiesField, Argument: "representations", Key: key}
+	}
+
+	if resolver.Argument == "" {
+		resolver.Argument = "id"
+	}
+	if resolver.Key == "" {
+		resolver.Key = key
+	}
+
+	return &resolver
+}
+
+// entityKey returns the field that the service at the location needs to look up objects of the type
+func (p *Planner) entityKey(federation Federation, location string, typeName string) string {
+	if resolver := p.entityResolver(federation, location, typeName); resolver != nil {
+		return resolver.Key
+	}
+
+	return "id"
+}
+
+// entityKeyType returns the type of the argument that the resolver takes the key with
+func entityKeyType(schema *ast.Schema, resolver *EntityResolver) (*ast.Type, error) {
+	// _entities isn't part of the schema we serve but its argument is always the same
+	if resolver.Field == federationEntitiesField {
+		return ast.NonNullListType(ast.NonNullNamedType("_Any", &ast.Position{}), &ast.Position{}), nil
+	}
+
+	if schema.Query != nil {
+		if field := schema.Query.Fields.ForName(resolver.Field); field != nil {
+			if argument := field.Arguments.ForName(resolver.Argument); argument != nil {
+				return argument.Type, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("could not find argument %s of Query.%s to look up objects with", resolver.Argument, resolver.Field)
+}
+
+// executorEntityField returns the field that the step looked up its object with
+func executorEntityField(step *QueryPlanStep) string {
+	if step.Entity != nil {
+		return step.Entity.Field
+	}
+
+	return "node"
+}
+
+// executorEntityKey returns the field that holds the key the step needs to look up its object
+func executorEntityKey(step *QueryPlanStep) string {
+	if step.Entity != nil {
+		return step.Entity.Key
+	}
+
+	return "id"
+}
+
+// executorEntityKeyType returns the type of the variable that the step sends the key with
+func executorEntityKeyType(step *QueryPlanStep) *ast.Type {
+	if step.QueryDocument == nil || len(step.QueryDocument.Operations) == 0 {
+		return nil
+	}
+
+	if definition := step.QueryDocument.Operations[0].VariableDefinitions.ForName("id"); definition != nil {
+		return definition.Type
+	}
+
+	return nil
+}
+
+// executorEntityList returns true if the step looked up its object with a list of keys
+func executorEntityList(step *QueryPlanStep) bool {
+	keyType := executorEntityKeyType(step)
+	return step.Entity != nil && keyType != nil && keyType.Elem != nil
+}
+
+// executorEntityKeyValue turns the key found in the insertion point into the value of the variable
+// that the step sends it with
+func executorEntityKeyValue(step *QueryPlanStep, key string) interface{} {
+	// the insertion point only holds strings so numbers have to be turned back
+	var value interface{} = key
+	if keyType := executorEntityKeyType(step); step.Entity != nil && keyType != nil && keyType.Name() == "Int" {
+		if number, err := strconv.ParseInt(key, 10, 64); err == nil {
+			value = number
+		}
+	}
+
+	if executorEntityList(step) {
+		return []interface{}{value}
+	}
+
+	return value
+}
+
+// executorEntityRepresentations returns true if the step looks up its object with _entities
+func executorEntityRepresentations(step *QueryPlanStep) bool {
+	return step.Entity != nil && step.Entity.Field == federationEntitiesField
+}
+
+// executorEntityRepresentation returns the representation that _entities looks up the object with. It
+// holds the type and key of the object along with the fields the step requires.
+func executorEntityRepresentation(step *QueryPlanStep, key string, object map[string]interface{}) map[string]interface{} {
+	typeName := step.ParentType
+	if name, ok := object["__typename"].(string); ok {
+		typeName = name
+	}
+
+	representation := map[string]interface{}{
+		"__typename":    typeName,
+		step.Entity.Key: key,
+	}
+
+	// ids have to be the one the service knows but other keys can be sent as they were returned
+	if value, ok := object[step.Entity.Key]; ok && step.Entity.Key != "id" {
+		representation[step.Entity.Key] = value
+	}
+
+	for _, field := range step.Requires {
+		representation[field] = object[field]
+	}
+
+	return representation
+}
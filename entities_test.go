@@ -0,0 +1,148 @@
+package gateway
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nautilus/graphql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGateway_entityResolver(t *testing.T) {
+	widgetSchema, _ := graphql.LoadSchema(`
+		type Widget {
+			upc: String!
+			name: String!
+		}
+
+		type Query {
+			widgets: [Widget!]!
+		}
+	`)
+	reviewSchema, _ := graphql.LoadSchema(`
+		type Widget {
+			upc: String!
+			rating: Int!
+		}
+
+		type Query {
+			widgetsByUpc(upcs: [String!]!): [Widget]!
+		}
+	`)
+
+	// the requests sent to the review service
+	lock := &sync.Mutex{}
+	requests := []*graphql.QueryInput{}
+
+	factory := QueryerFactory(func(ctx *PlanningContext, url string) graphql.Queryer {
+		if url == "reviews" {
+			return graphql.QueryerFunc(func(input *graphql.QueryInput) (interface{}, error) {
+				lock.Lock()
+				requests = append(requests, input)
+				lock.Unlock()
+
+				ratings := map[string]int{"a": 4, "b": 2}
+				upc := input.Variables["id"].([]interface{})[0].(string)
+
+				return map[string]interface{}{
+					"widgetsByUpc": []interface{}{map[string]interface{}{"rating": ratings[upc]}},
+				}, nil
+			})
+		}
+
+		return &graphql.MockSuccessQueryer{map[string]interface{}{
+			"widgets": []interface{}{
+				map[string]interface{}{"upc": "a", "name": "hammer"},
+				map[string]interface{}{"upc": "b", "name": "wrench"},
+			},
+		}}
+	})
+
+	gateway, err := New([]*graphql.RemoteSchema{
+		{Schema: widgetSchema, URL: "widgets"},
+		{Schema: reviewSchema, URL: "reviews"},
+	},
+		WithQueryerFactory(&factory),
+		WithEntityResolver("reviews", "Widget", EntityResolver{Field: "widgetsByUpc", Argument: "upcs", Key: "upc"}),
+	)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	reqCtx := &RequestContext{
+		Context: context.Background(),
+		Query:   "{ widgets { name rating } }",
+	}
+
+	plans, err := gateway.GetPlan(reqCtx)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// the reviews are looked up by the upc of the widget
+	if !assert.Len(t, plans[0].RootStep.Then, 1) || !assert.Len(t, plans[0].RootStep.Then[0].Then, 1) {
+		return
+	}
+	step := plans[0].RootStep.Then[0].Then[0]
+	assert.Equal(t,
+		"query ($id: [String!]!) { widgetsByUpc(upcs: $id) { ... on Widget { rating } } }",
+		strings.Join(strings.Fields(step.QueryString), " "),
+	)
+	assert.Equal(t, "upc", step.Entity.Key)
+
+	result, err := gateway.Execute(reqCtx, plans)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// the upc was only there to look up the reviews
+	assert.Equal(t, map[string]interface{}{
+		"widgets": []interface{}{
+			map[string]interface{}{"name": "hammer", "rating": 4},
+			map[string]interface{}{"name": "wrench", "rating": 2},
+		},
+	}, result)
+	assert.Len(t, requests, 2)
+}
+
+func TestGateway_entityResolverMissingField(t *testing.T) {
+	widgetSchema, _ := graphql.LoadSchema(`
+		type Widget {
+			upc: String!
+			name: String!
+		}
+
+		type Query {
+			widgets: [Widget!]!
+		}
+	`)
+	reviewSchema, _ := graphql.LoadSchema(`
+		type Widget {
+			upc: String!
+			rating: Int!
+		}
+
+		type Query {
+			widgetByUpc(upc: String!): Widget
+		}
+	`)
+
+	gateway, err := New([]*graphql.RemoteSchema{
+		{Schema: widgetSchema, URL: "widgets"},
+		{Schema: reviewSchema, URL: "reviews"},
+	}, WithEntityResolver("reviews", "Widget", EntityResolver{Field: "widgetByUpc", Key: "upc"}))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// the argument defaults to id which the field doesn't have
+	_, err = gateway.GetPlan(&RequestContext{
+		Context: context.Background(),
+		Query:   "{ widgets { name rating } }",
+	})
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "could not find argument id of Query.widgetByUpc to look up objects with", err.Error())
+	}
+}
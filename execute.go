@@ -7,6 +7,8 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/nautilus/graphql"
 	"github.com/vektah/gqlparser/ast"
@@ -20,7 +22,26 @@ type Executor interface {
 
 // ParallelExecutor executes the given query plan by starting at the root of the plan and
 // walking down the path stitching the results together
-type ParallelExecutor struct{}
+type ParallelExecutor struct {
+	// BatchNodeQueries sends a single request for every object that a dependent step has to
+	// look up instead of one node(id:) query per object.
+	BatchNodeQueries bool
+	// NodesField is the name of a root field that looks up a list of objects by id, for example
+	// nodes(ids: [ID!]!): [Node]!. If it's set, batched requests use this field instead of
+	// aliasing a node field for each object.
+	NodesField string
+	// MaxRequests is the number of requests a single execution can send to the services. Once it
+	// has been spent, the remaining steps fail and the response holds what was resolved so far.
+	// Zero means no limit.
+	MaxRequests int
+	// MaxConcurrency is the number of requests a single execution can have in flight at once.
+	// Zero means no limit.
+	MaxConcurrency int
+}
+
+// ErrRequestBudgetExceeded is the error for steps that were skipped because the execution
+// already sent as many requests as the executor allows
+var ErrRequestBudgetExceeded = errors.New("the query requires too many requests to resolve")
 
 type queryExecutionResult struct {
 	InsertionPoint []string
@@ -40,6 +61,14 @@ type ExecutionContext struct {
 	Variables          map[string]interface{}
 	RequestContext     context.Context
 	RequestMiddlewares []graphql.NetworkMiddleware
+	Trace              *Trace
+	Metrics            *Metrics
+	// Logger holds the fields that identify the request in the logs
+	Logger *Logger
+	// NodeIDCodec namespaces the ids of nodes with their service if the gateway was configured to
+	NodeIDCodec NodeIDCodec
+	// Locations holds the services that can resolve each field of the schema
+	Locations FieldURLMap
 }
 
 // Execute returns the result of the query plan
@@ -71,15 +100,25 @@ func (executor *ParallelExecutor) Execute(ctx *ExecutionContext) (map[string]int
 		return nil, errors.New("was given empty plan")
 	}
 
-	// the root step could have multiple steps that have to happen
-	for _, step := range ctx.Plan.RootStep.Then {
-		stepWg.Add(1)
-		go executeStep(ctx, ctx.Plan, step, []string{}, resultLock, ctx.Variables, resultCh, errCh, stepWg)
+	// the state shared by every step
+	state := &executionState{
+		ctx:         ctx,
+		resultLock:  resultLock,
+		resultCh:    resultCh,
+		errCh:       errCh,
+		stepWg:      stepWg,
+		maxRequests: int64(executor.MaxRequests),
+	}
+	if executor.MaxConcurrency > 0 {
+		state.inFlight = make(chan bool, executor.MaxConcurrency)
 	}
 
 	// the list of errors we have encountered while executing the plan
 	errs := graphql.ErrorList{}
 
+	// the steps that failed leave holes in the response that we have to fill in once we're done
+	failures := []*executionStepError{}
+
 	// start a goroutine to add results to the list
 	go func() {
 		for {
@@ -89,26 +128,29 @@ func (executor *ParallelExecutor) Execute(ctx *ExecutionContext) (map[string]int
 				if payload == nil {
 					continue
 				}
-				log.Debug("Inserting result into ", payload.InsertionPoint)
-				log.Debug("Result: ", payload.Result)
+				ctx.Logger.Debug("Inserting result into ", payload.InsertionPoint)
+				ctx.Logger.Debug("Result: ", payload.Result)
 
 				// we have to grab the value in the result and write it to the appropriate spot in the
 				// acumulator.
-				err := executorInsertObject(result, resultLock, payload.InsertionPoint, payload.Result)
+				err := executorInsertObject(ctx.Logger, result, resultLock, payload.InsertionPoint, payload.Result)
 				if err != nil {
 					errCh <- err
 					continue
 				}
 
-				log.Debug("Done. ", result)
+				ctx.Logger.Debug("Done. ", result)
 				// one of the queries is done
 				stepWg.Done()
 
 			case err := <-errCh:
 				if err != nil {
 					errMutex.Lock()
-					// if the error was a list
-					if errList, ok := err.(graphql.ErrorList); ok {
+					// if the error came from a step, we need to remember where it happened
+					if failure, ok := err.(*executionStepError); ok {
+						failures = append(failures, failure)
+					} else if errList, ok := err.(graphql.ErrorList); ok {
+						// if the error was a list
 						errs = append(errs, errList...)
 					} else {
 						errs = append(errs, err)
@@ -123,15 +165,47 @@ func (executor *ParallelExecutor) Execute(ctx *ExecutionContext) (map[string]int
 		}
 	}()
 
+	// the root step could have multiple steps that have to happen
+	for _, step := range ctx.Plan.RootStep.Then {
+		// the top-level fields of a mutation have to finish before the next ones can start. the
+		// steps that depend on them are spawned like any other and can run in parallel
+		if step.Ordered {
+			executor.runStep(state, step, []string{}, nil)
+			continue
+		}
+
+		executor.spawnStep(state, step, []string{}, nil)
+	}
+
 	// when the wait group is finished
 	stepWg.Wait()
+	ctx.Metrics.observePlan(ctx.Plan, int(atomic.LoadInt64(&state.insertionPoints)))
 
 	// if we encountered any errors
 	errMutex.Lock()
-	nErrs := len(errs)
 	defer errMutex.Unlock()
 
-	if nErrs > 0 {
+	if len(errs) > 0 || len(failures) > 0 {
+		// running out of budget fails every step that was left so we only report it once
+		reportedBudget := false
+
+		// the fields that failed steps were responsible for have to be null
+		for _, failure := range failures {
+			if result != nil && !executorNullFailedStep(ctx.Plan, result, failure) {
+				// the null bubbled all the way up so there is no data to return
+				result = nil
+			}
+
+			if failure.Err == ErrRequestBudgetExceeded {
+				if reportedBudget {
+					continue
+				}
+				reportedBudget = true
+			}
+
+			errs = append(errs, failure.Errors()...)
+		}
+
 		return result, errs
 	}
 
@@ -139,86 +213,203 @@ func (executor *ParallelExecutor) Execute(ctx *ExecutionContext) (map[string]int
 	return result, nil
 }
 
-// TODO: ugh... so... many... variables...
-func executeStep(
-	ctx *ExecutionContext,
-	plan *QueryPlan,
-	step *QueryPlanStep,
-	insertionPoint []string,
-	resultLock *sync.Mutex,
-	queryVariables map[string]interface{},
-	resultCh chan *queryExecutionResult,
-	errCh chan error,
-	stepWg *sync.WaitGroup,
-) {
-	log.Debug("")
-	log.Debug("Executing step to be inserted in ", step.ParentType, ". Insertion point: ", insertionPoint)
+// executionState holds the state that is shared by every step of a single execution
+type executionState struct {
+	ctx        *ExecutionContext
+	resultLock *sync.Mutex
+	resultCh   chan *queryExecutionResult
+	errCh      chan error
+	stepWg     *sync.WaitGroup
+
+	// the number of requests the execution has sent (or is about to) and how many it can send
+	requests    int64
+	maxRequests int64
+	// holds a value for every request in flight if the concurrency is limited
+	inFlight chan bool
+
+	// the number of insertion points that were sent to a service
+	insertionPoints int64
+	// the last id given to a step so each one can be told apart in the logs
+	stepIDs int64
+}
 
-	log.Debug(fmt.Sprintf("%q", step.SelectionSet))
+// reserveRequest returns false if the execution can't send another request
+func (state *executionState) reserveRequest() bool {
+	if state.maxRequests <= 0 {
+		return true
+	}
 
-	// log the query
-	log.QueryPlanStep(step)
+	return atomic.AddInt64(&state.requests, 1) <= state.maxRequests
+}
 
-	// the list of variables and their definitions that pertain to this query
-	variables := map[string]interface{}{}
+// acquire waits until another request can be in flight and returns a function to call when it's done
+func (state *executionState) acquire() (func(), error) {
+	if state.inFlight == nil {
+		return func() {}, nil
+	}
 
-	// we need to grab the variable definitions and values for each variable in the step
-	for variable := range step.Variables {
-		// and the value if it exists
-		if value, ok := queryVariables[variable]; ok {
-			variables[variable] = value
+	// the request context is optional
+	var done <-chan struct{}
+	if state.ctx.RequestContext != nil {
+		done = state.ctx.RequestContext.Done()
+	}
+
+	select {
+	case state.inFlight <- true:
+		return func() { <-state.inFlight }, nil
+	case <-done:
+		return nil, state.ctx.RequestContext.Err()
+	}
+}
+
+// stepLogger returns a logger that identifies the step that is executing
+func (state *executionState) stepLogger(step *QueryPlanStep) *Logger {
+	return state.ctx.Logger.WithFields(LoggerFields{
+		"stepId":  atomic.AddInt64(&state.stepIDs, 1),
+		"service": step.URL,
+	})
+}
+
+// skip lets the executor know that the step doesn't add anything to the object at the insertion point
+func (state *executionState) skip(insertionPoint []string) {
+	state.resultCh <- &queryExecutionResult{
+		InsertionPoint: insertionPoint,
+		Result:         map[string]interface{}{},
+	}
+}
+
+// nodeID returns the id that the service of the step knows the object at the insertion point by. If
+// the ids are namespaced and the service that gave out the id doesn't define any of the types the
+// step looks for, the object can't be one of them and ok is false.
+func (state *executionState) nodeID(step *QueryPlanStep, insertionPoint []string) (id string, ok bool, err error) {
+	id, err = executorInsertionPointID(insertionPoint)
+	// only the ids of nodes are namespaced, not the other keys of objects
+	if err != nil || state.ctx.NodeIDCodec == nil || executorEntityKey(step) != "id" {
+		return id, true, err
+	}
+
+	service, id, err := state.ctx.NodeIDCodec.Decode(id)
+	if err != nil {
+		return "", false, err
+	}
+
+	// without the locations we can't tell so we have to ask
+	if state.ctx.Locations == nil {
+		return id, true, nil
+	}
+
+	for _, typeName := range nodeIDsStepTypes(step) {
+		locations, _ := state.ctx.Locations.URLFor(typeName, "__typename")
+		for _, location := range locations {
+			if location == service {
+				return id, true, nil
+			}
 		}
 	}
 
+	return id, false, nil
+}
+
+// stepVariables returns the variables to send along with the step. ids are decoded for everything
+// but the gateway itself.
+func (state *executionState) stepVariables(step *QueryPlanStep) map[string]interface{} {
+	variables := executorStepVariables(step, state.ctx.Variables)
+	if state.ctx.NodeIDCodec == nil || state.ctx.Plan.Operation == nil {
+		return variables
+	}
+
+	decode := step.URL != internalSchemaLocation
+	nodeIDsDecodeVariables(state.ctx.NodeIDCodec, state.ctx.Plan.Operation.VariableDefinitions, step.Variables, variables, decode)
+	return variables
+}
+
+// encodeNodeIDs namespaces the ids of the nodes in the result of the step with its service
+func (state *executionState) encodeNodeIDs(step *QueryPlanStep, result map[string]interface{}) {
+	// the gateway only hands back the ids it was given
+	if state.ctx.NodeIDCodec == nil || step.URL == internalSchemaLocation {
+		return
+	}
+
+	nodeIDsEncode(state.ctx.NodeIDCodec, step.URL, step.SelectionSet, step.FragmentDefinitions, result)
+}
+
+// fail lets the executor know that the step could not be inserted at the given point
+func (state *executionState) fail(step *QueryPlanStep, insertionPoint []string, err error) {
+	state.errCh <- &executionStepError{
+		Step:           step,
+		InsertionPoint: insertionPoint,
+		Err:            err,
+	}
+}
+
+// executeStep sends the query of the step for the object at the insertion point. The object is the
+// result of the parent step at that point which holds the fields the step requires, if it has any.
+func (executor *ParallelExecutor) executeStep(state *executionState, step *QueryPlanStep, insertionPoint []string, object map[string]interface{}) {
+	logger := state.stepLogger(step)
+
+	logger.Debug("")
+	logger.Debug("Executing step to be inserted in ", step.ParentType, ". Insertion point: ", insertionPoint)
+
+	logger.Debug(fmt.Sprintf("%q", step.SelectionSet))
+
+	// log the query
+	logger.QueryPlanStep(step)
+
+	// the list of variables and their definitions that pertain to this query
+	variables := state.stepVariables(step)
+
 	// the id of the object we are query is defined by the last step in the realized insertion point
 	if len(insertionPoint) > 0 {
-		head := insertionPoint[max(len(insertionPoint)-1, 0)]
-
-		// get the data of the point
-		pointData, err := executorGetPointData(head)
+		id, ok, err := state.nodeID(step, insertionPoint)
 		if err != nil {
-			errCh <- err
+			state.fail(step, insertionPoint, err)
 			return
 		}
-
-		// if we dont have an id
-		if pointData.ID == "" {
-			errCh <- fmt.Errorf("Could not find id in path")
+		if !ok {
+			logger.Debug("Skipping step for object from another service")
+			state.skip(insertionPoint)
 			return
 		}
 
-		// save the id as a variable to the query
-		variables["id"] = pointData.ID
+		// save the id as a variable to the query. _entities looks up the object with its representation
+		if executorEntityRepresentations(step) {
+			variables["id"] = []interface{}{executorEntityRepresentation(step, id, object)}
+		} else {
+			variables["id"] = executorEntityKeyValue(step, id)
+		}
 	}
 
 	// if there is no queryer
 	if step.Queryer == nil {
-		errCh <- errors.New(" could not find queryer for step")
+		state.fail(step, insertionPoint, errors.New("could not find queryer for step"))
 		return
 	}
 
-	// the query we will use
-	queryer := step.Queryer
 	// a place to save the result
 	queryResult := map[string]interface{}{}
 
-	// if we have middlewares
-	if len(ctx.RequestMiddlewares) > 0 {
-		// if the queryer is a network queryer
-		if nQueryer, ok := queryer.(graphql.QueryerWithMiddlewares); ok {
-			queryer = nQueryer.WithMiddlewares(ctx.RequestMiddlewares)
-		}
+	// wait for our turn to send a request
+	release, err := state.acquire()
+	if err != nil {
+		state.fail(step, insertionPoint, err)
+		return
 	}
 
 	// fire the query
-	err := queryer.Query(ctx.RequestContext, &graphql.QueryInput{
+	span := state.ctx.Trace.startStep(step, insertionPoint)
+	start := time.Now()
+	atomic.AddInt64(&state.insertionPoints, 1)
+	err = executorQueryer(state.ctx, step, span).Query(state.ctx.RequestContext, &graphql.QueryInput{
 		Query:         step.QueryString,
 		QueryDocument: step.QueryDocument,
 		Variables:     variables,
 	}, &queryResult)
+	state.ctx.Metrics.observeServiceRequest(step.URL, time.Since(start), err)
+	state.ctx.Trace.finishSpan(span, err)
+	release()
 	if err != nil {
-		log.Debug("Network Error: ", err)
-		errCh <- err
+		logger.Debug("Network Error: ", err)
+		state.fail(step, insertionPoint, err)
 		return
 	}
 
@@ -227,55 +418,801 @@ func executeStep(
 	//       InsertionPoint as the right place to insert this result.
 
 	// if this is a query that falls underneath a `node(id: ???)` query then we only want to consider the object
-	// underneath the `node` field as the result for the query
-	stripNode := step.ParentType != "Query" && step.ParentType != "Subscription" && step.ParentType != "Mutation"
-	if stripNode {
-		log.Debug("Should strip node")
+	// underneath the `node` field (or the field of the entity resolver) as the result for the query
+	if executorStripNode(step) {
+		logger.Debug("Should strip node")
 		// get the result from the response that we have to stitch there
-		extractedResult, err := executorExtractValue(queryResult, resultLock, []string{"node"})
+		extractedResult, err := executorExtractValue(logger, queryResult, state.resultLock, []string{executorEntityField(step)})
 		if err != nil {
-			errCh <- err
+			state.fail(step, insertionPoint, err)
 			return
 		}
 
+		// resolvers that take a list of keys return a list with our object in it
+		if list, ok := extractedResult.([]interface{}); ok && executorEntityList(step) && len(list) == 1 {
+			extractedResult = list[0]
+		}
+
 		resultObj, ok := extractedResult.(map[string]interface{})
 		if !ok {
-			errCh <- fmt.Errorf("Query result of node query was not an object: %v", queryResult)
+			state.fail(step, insertionPoint, fmt.Errorf("Query result of node query was not an object: %v", queryResult))
 			return
 		}
 
 		queryResult = resultObj
 	}
 
+	state.encodeNodeIDs(step, queryResult)
+
+	if err := executor.finishStep(state, logger, step, insertionPoint, queryResult); err != nil {
+		state.fail(step, insertionPoint, err)
+	}
+}
+
+// executeBatchedStep looks up the objects at every insertion point of the step with a single request
+// and then splits the response back up so each object is handled like it came from its own query.
+func (executor *ParallelExecutor) executeBatchedStep(state *executionState, step *QueryPlanStep, insertionPoints [][]string) {
+	logger := state.stepLogger(step)
+
+	logger.Debug("")
+	logger.Debug("Executing batched step to be inserted in ", step.ParentType, ". Insertion points: ", insertionPoints)
+
+	// log the query
+	logger.QueryPlanStep(step)
+
+	// the ids of the objects we are looking up
+	ids := []interface{}{}
+	lookups := [][]string{}
+	for _, insertionPoint := range insertionPoints {
+		id, ok, err := state.nodeID(step, insertionPoint)
+		if err != nil {
+			state.fail(step, insertionPoint, err)
+			continue
+		}
+		if !ok {
+			state.skip(insertionPoint)
+			continue
+		}
+
+		ids = append(ids, id)
+		lookups = append(lookups, insertionPoint)
+	}
+
+	// the rest of the objects are the ones we have to look up
+	if len(lookups) == 0 {
+		return
+	}
+
+	executor.lookUpBatch(state, logger, step, lookups, ids)
+}
+
+// lookUpBatch sends the request that looks up the objects with the given ids and finishes the step for
+// each of them. If the service only fails to resolve some of the objects, the rest are still inserted.
+func (executor *ParallelExecutor) lookUpBatch(state *executionState, logger *Logger, step *QueryPlanStep, insertionPoints [][]string, ids []interface{}) {
+	// if the request can't be sent then none of the insertion points get a value
+	failAll := func(err error) {
+		for _, insertionPoint := range insertionPoints {
+			state.fail(step, insertionPoint, err)
+		}
+	}
+
+	// if there is no queryer
+	if step.Queryer == nil {
+		failAll(errors.New("could not find queryer for step"))
+		return
+	}
+
+	// build up the query that looks up every object at once
+	queryDocument := executorBatchQuery(step, len(ids), executor.NodesField)
+	queryString, err := graphql.PrintQuery(queryDocument)
+	if err != nil {
+		failAll(err)
+		return
+	}
+
+	// the variables for the step along with the ids of the objects
+	variables := state.stepVariables(step)
+	if executor.NodesField != "" {
+		variables["ids"] = ids
+	} else {
+		for i, id := range ids {
+			variables[fmt.Sprintf("id%d", i)] = id
+		}
+	}
+
+	// wait for our turn to send a request
+	release, err := state.acquire()
+	if err != nil {
+		failAll(err)
+		return
+	}
+
+	// fire the query
+	spans := []*TraceSpan{}
+	for _, insertionPoint := range insertionPoints {
+		spans = append(spans, state.ctx.Trace.startStep(step, insertionPoint))
+	}
+	queryResult := map[string]interface{}{}
+	start := time.Now()
+	atomic.AddInt64(&state.insertionPoints, int64(len(insertionPoints)))
+	// the service sees the batch as part of the first object's span
+	err = executorQueryer(state.ctx, step, spans[0]).Query(state.ctx.RequestContext, &graphql.QueryInput{
+		Query:         queryString,
+		QueryDocument: queryDocument,
+		Variables:     variables,
+	}, &queryResult)
+	state.ctx.Metrics.observeServiceRequest(step.URL, time.Since(start), err)
+	// every object was looked up by the same request
+	for _, span := range spans {
+		state.ctx.Trace.finishSpan(span, err)
+	}
+	release()
+
+	// pull out the object for each insertion point
+	nodes := executorBatchNodes(queryResult, ids, executor.NodesField)
+
+	// the objects that have to be looked up again
+	retryPoints := [][]string{}
+	retryIDs := []interface{}{}
+
+	if err != nil {
+		logger.Debug("Network Error: ", err)
+
+		// if we can't tell which objects the errors belong to then none of them can be trusted
+		errs, unmatched := executorSplitBatchErrors(err, len(ids), executor.NodesField)
+		if len(unmatched) > 0 {
+			for i, insertionPoint := range insertionPoints {
+				state.fail(step, insertionPoint, append(append(graphql.ErrorList{}, errs[i]...), unmatched...))
+			}
+			return
+		}
+
+		// only the objects named by the errors are lost
+		for i, insertionPoint := range insertionPoints {
+			if len(errs[i]) > 0 {
+				state.fail(step, insertionPoint, errs[i])
+				continue
+			}
+
+			// queryers usually throw away the data when there are errors so we have to ask again
+			if _, ok := nodes[i].(map[string]interface{}); !ok {
+				retryPoints = append(retryPoints, insertionPoint)
+				retryIDs = append(retryIDs, ids[i])
+				continue
+			}
+
+			executor.finishBatchedObject(state, logger, step, insertionPoint, ids[i], nodes[i])
+		}
+	} else {
+		for i, insertionPoint := range insertionPoints {
+			executor.finishBatchedObject(state, logger, step, insertionPoint, ids[i], nodes[i])
+		}
+	}
+
+	if len(retryPoints) == 0 {
+		return
+	}
+
+	if !state.reserveRequest() {
+		for _, insertionPoint := range retryPoints {
+			state.fail(step, insertionPoint, ErrRequestBudgetExceeded)
+		}
+		return
+	}
+
+	executor.lookUpBatch(state, logger, step, retryPoints, retryIDs)
+}
+
+// finishBatchedObject finishes the step for a single object of a batch
+func (executor *ParallelExecutor) finishBatchedObject(state *executionState, logger *Logger, step *QueryPlanStep, insertionPoint []string, id interface{}, node interface{}) {
+	if node == nil {
+		state.fail(step, insertionPoint, fmt.Errorf("Could not find result for object with id %v", id))
+		return
+	}
+
+	resultObj, ok := node.(map[string]interface{})
+	if !ok {
+		state.fail(step, insertionPoint, fmt.Errorf("Query result of node query was not an object: %v", node))
+		return
+	}
+
+	state.encodeNodeIDs(step, resultObj)
+
+	if err := executor.finishStep(state, logger, step, insertionPoint, resultObj); err != nil {
+		state.fail(step, insertionPoint, err)
+	}
+}
+
+// finishStep kicks off the steps that depend on the result of the step and then sends the result off
+// to be stitched into the response
+func (executor *ParallelExecutor) finishStep(state *executionState, logger *Logger, step *QueryPlanStep, insertionPoint []string, queryResult map[string]interface{}) error {
 	// if there are next steps
 	if len(step.Then) > 0 {
-		log.Debug("Kicking off child queries")
+		logger.Debug("Kicking off child queries")
 		// we need to find the ids of the objects we are inserting into and then kick of the worker with the right
 		// insertion point. For lists, insertion points look like: ["user", "friends:0", "catPhotos:0", "owner"]
 		for _, dependent := range step.Then {
-			log.Debug("Looking for insertion points for ", dependent.InsertionPoint, "\n\n")
+			logger.Debug("Looking for insertion points for ", dependent.InsertionPoint, "\n\n")
 
-			insertPoints, err := executorFindInsertionPoints(resultLock, dependent.InsertionPoint, step.SelectionSet, queryResult, [][]string{insertionPoint}, step.FragmentDefinitions)
+			insertPoints, err := executorFindInsertionPointsByKey(logger, state.resultLock, dependent.InsertionPoint, step.SelectionSet, queryResult, [][]string{insertionPoint}, step.FragmentDefinitions, executorEntityKey(dependent))
 			if err != nil {
-				errCh <- err
-				return
+				return err
+			}
+
+			// if we are supposed to, look up every object with a single request
+			if executor.BatchNodeQueries && executorStripNode(dependent) && dependent.Entity == nil && len(insertPoints) > 1 {
+				logger.Info("Spawn batch ", insertPoints)
+				executor.spawnBatchedStep(state, dependent, insertPoints)
+				continue
 			}
 
 			// this dependent needs to fire for every object that the insertion point references
-			for _, insertionPoint := range insertPoints {
-				log.Info("Spawn ", insertionPoint)
-				stepWg.Add(1)
-				go executeStep(ctx, plan, dependent, insertionPoint, resultLock, queryVariables, resultCh, errCh, stepWg)
+			for _, point := range insertPoints {
+				// services that look up objects with _entities need the fields of the object we found
+				var object map[string]interface{}
+				if executorEntityRepresentations(dependent) {
+					value, err := executorExtractValue(logger, queryResult, state.resultLock, point[len(insertionPoint):])
+					if err != nil {
+						return err
+					}
+					object, _ = value.(map[string]interface{})
+				}
+
+				logger.Info("Spawn ", point)
+				executor.spawnStep(state, dependent, point, object)
 			}
 		}
 	}
 
-	log.Debug("Pushing Result. Insertion point: ", insertionPoint, ". Value: ", queryResult)
+	logger.Debug("Pushing Result. Insertion point: ", insertionPoint, ". Value: ", queryResult)
 	// send the result to be stitched in with our accumulator
-	resultCh <- &queryExecutionResult{
+	state.resultCh <- &queryExecutionResult{
 		InsertionPoint: insertionPoint,
 		Result:         queryResult,
 	}
+
+	return nil
+}
+
+// spawnStep starts executing the step at the insertion point if the execution can still send a request
+func (executor *ParallelExecutor) spawnStep(state *executionState, step *QueryPlanStep, insertionPoint []string, object map[string]interface{}) {
+	state.stepWg.Add(1)
+
+	if !state.reserveRequest() {
+		state.fail(step, insertionPoint, ErrRequestBudgetExceeded)
+		return
+	}
+
+	go executor.executeStep(state, step, insertionPoint, object)
+}
+
+// runStep executes the step at the insertion point and waits for its result to be sent off before
+// returning
+func (executor *ParallelExecutor) runStep(state *executionState, step *QueryPlanStep, insertionPoint []string, object map[string]interface{}) {
+	state.stepWg.Add(1)
+
+	if !state.reserveRequest() {
+		state.fail(step, insertionPoint, ErrRequestBudgetExceeded)
+		return
+	}
+
+	executor.executeStep(state, step, insertionPoint, object)
+}
+
+// spawnBatchedStep starts looking up the objects at every insertion point if the execution can
+// still send a request
+func (executor *ParallelExecutor) spawnBatchedStep(state *executionState, step *QueryPlanStep, insertionPoints [][]string) {
+	state.stepWg.Add(len(insertionPoints))
+
+	if !state.reserveRequest() {
+		for _, insertionPoint := range insertionPoints {
+			state.fail(step, insertionPoint, ErrRequestBudgetExceeded)
+		}
+		return
+	}
+
+	go executor.executeBatchedStep(state, step, insertionPoints)
+}
+
+// executorStepVariables returns the values of the variables that the step uses
+func executorStepVariables(step *QueryPlanStep, queryVariables map[string]interface{}) map[string]interface{} {
+	variables := map[string]interface{}{}
+
+	// we need to grab the variable definitions and values for each variable in the step
+	for variable := range step.Variables {
+		// and the value if it exists
+		if value, ok := queryVariables[variable]; ok {
+			variables[variable] = value
+		}
+	}
+
+	return variables
+}
+
+// executorInsertionPointID returns the id of the object that the insertion point refers to, which
+// is defined by the last entry in the realized insertion point
+func executorInsertionPointID(insertionPoint []string) (string, error) {
+	head := insertionPoint[max(len(insertionPoint)-1, 0)]
+
+	// get the data of the point
+	pointData, err := executorGetPointData(head)
+	if err != nil {
+		return "", err
+	}
+
+	// if we dont have an id
+	if pointData.ID == "" {
+		return "", errors.New("Could not find id in path")
+	}
+
+	return pointData.ID, nil
+}
+
+// executorQueryer returns the queryer to use for the step with the request middlewares applied. If the
+// step is traced, the request points the service to the span of the step.
+func executorQueryer(ctx *ExecutionContext, step *QueryPlanStep, span *TraceSpan) graphql.Queryer {
+	queryer := step.Queryer
+
+	middlewares := ctx.RequestMiddlewares
+	if span != nil {
+		// copy the list so we don't write to the one that's shared between requests
+		middlewares = append(append([]graphql.NetworkMiddleware{}, middlewares...), span.traceParentMiddleware())
+	}
+
+	// if we have middlewares
+	if len(middlewares) > 0 {
+		// if the queryer is a network queryer
+		if nQueryer, ok := queryer.(graphql.QueryerWithMiddlewares); ok {
+			queryer = nQueryer.WithMiddlewares(middlewares)
+		}
+	}
+
+	return queryer
+}
+
+// executorBatchQuery builds the query that looks up count objects for the step in a single request. If a
+// nodes field is provided the objects are looked up with nodes(ids: $ids), otherwise the query looks like
+// { n0: node(id: $id0) { ... } n1: node(id: $id1) { ... } }
+func executorBatchQuery(step *QueryPlanStep, count int, nodesField string) *ast.QueryDocument {
+	// the variables used by the step, except for the id of the single object
+	variables := ast.VariableDefinitionList{}
+	if step.QueryDocument != nil && len(step.QueryDocument.Operations) > 0 {
+		for _, definition := range step.QueryDocument.Operations[0].VariableDefinitions {
+			if definition.Variable != "id" {
+				variables = append(variables, definition)
+			}
+		}
+	}
+
+	// every lookup gets the same selection
+	selectionSet := ast.SelectionSet{
+		&ast.InlineFragment{
+			TypeCondition: step.ParentType,
+			SelectionSet:  step.SelectionSet,
+		},
+	}
+
+	operation := &ast.OperationDefinition{
+		Operation: ast.Query,
+	}
+
+	if nodesField != "" {
+		variables = append(variables, &ast.VariableDefinition{
+			Variable: "ids",
+			Type:     ast.NonNullListType(ast.NonNullNamedType("ID", &ast.Position{}), &ast.Position{}),
+		})
+
+		// the service doesn't have to return the nodes in the order of the ids so we need the id of each one
+		selectionSet = append(ast.SelectionSet{&ast.Field{Alias: executorBatchIDAlias, Name: "id"}}, selectionSet...)
+
+		operation.SelectionSet = ast.SelectionSet{
+			&ast.Field{
+				Name: nodesField,
+				Arguments: ast.ArgumentList{
+					&ast.Argument{
+						Name: "ids",
+						Value: &ast.Value{
+							Kind: ast.Variable,
+							Raw:  "ids",
+						},
+					},
+				},
+				SelectionSet: selectionSet,
+			},
+		}
+	} else {
+		for i := 0; i < count; i++ {
+			variable := fmt.Sprintf("id%d", i)
+
+			variables = append(variables, &ast.VariableDefinition{
+				Variable: variable,
+				Type:     ast.NonNullNamedType("ID", &ast.Position{}),
+			})
+
+			operation.SelectionSet = append(operation.SelectionSet, &ast.Field{
+				Alias: fmt.Sprintf("n%d", i),
+				Name:  "node",
+				Arguments: ast.ArgumentList{
+					&ast.Argument{
+						Name: "id",
+						Value: &ast.Value{
+							Kind: ast.Variable,
+							Raw:  variable,
+						},
+					},
+				},
+				SelectionSet: selectionSet,
+			})
+		}
+	}
+	operation.VariableDefinitions = variables
+
+	return &ast.QueryDocument{
+		Operations: ast.OperationList{operation},
+		Fragments:  step.FragmentDefinitions,
+	}
+}
+
+// executorBatchIDAlias is the alias of the id that nodes(ids:) is asked for to match up the nodes with their ids
+const executorBatchIDAlias = "_batchID"
+
+// executorBatchNodes returns the object that the batched request found for each id, in the order of the ids
+func executorBatchNodes(queryResult map[string]interface{}, ids []interface{}, nodesField string) []interface{} {
+	nodes := make([]interface{}, len(ids))
+
+	if nodesField == "" {
+		for i := range ids {
+			nodes[i] = queryResult[fmt.Sprintf("n%d", i)]
+		}
+		return nodes
+	}
+
+	// find the node for each id. the id was only there for us so it has to go
+	found := map[string]interface{}{}
+	list, _ := queryResult[nodesField].([]interface{})
+	for _, node := range list {
+		if obj, ok := node.(map[string]interface{}); ok {
+			if id, ok := obj[executorBatchIDAlias]; ok {
+				delete(obj, executorBatchIDAlias)
+				found[fmt.Sprint(id)] = obj
+			}
+		}
+	}
+	for i, id := range ids {
+		nodes[i] = found[fmt.Sprint(id)]
+	}
+
+	return nodes
+}
+
+// executorSplitBatchErrors assigns the errors from a batched request to the objects they belong to. Errors
+// from the service are matched by the start of their path and have it rewritten to look like it came from
+// a single node query. Objects without any errors get an empty list. The errors that can't be matched to
+// an object are returned separately since they could belong to any of them.
+func executorSplitBatchErrors(err error, count int, nodesField string) ([]graphql.ErrorList, graphql.ErrorList) {
+	errs := make([]graphql.ErrorList, count)
+	for i := range errs {
+		errs[i] = graphql.ErrorList{}
+	}
+	unmatched := graphql.ErrorList{}
+
+	// the error could be a list of errors
+	list := graphql.ErrorList{err}
+	if errList, ok := err.(graphql.ErrorList); ok {
+		list = errList
+	}
+
+	for _, err := range list {
+		gqlErr, ok := err.(*graphql.Error)
+		if !ok {
+			unmatched = append(unmatched, err)
+			continue
+		}
+
+		// look for the index of the object in the path
+		path := gqlErr.Path
+		found := -1
+		if nodesField != "" && len(path) > 1 && path[0] == nodesField {
+			if i, ok := path[1].(int); ok {
+				found = i
+			} else if i, ok := path[1].(float64); ok {
+				found = int(i)
+			}
+			if found >= 0 {
+				path = path[2:]
+			}
+		} else if len(path) > 0 {
+			if alias, ok := path[0].(string); ok && strings.HasPrefix(alias, "n") {
+				if i, err := strconv.Atoi(strings.TrimPrefix(alias, "n")); err == nil {
+					found = i
+					path = path[1:]
+				}
+			}
+		}
+
+		if found < 0 || found >= count {
+			unmatched = append(unmatched, err)
+			continue
+		}
+
+		errs[found] = append(errs[found], &graphql.Error{
+			Message:    gqlErr.Message,
+			Extensions: gqlErr.Extensions,
+			Path:       append([]interface{}{"node"}, path...),
+		})
+	}
+
+	// a request that failed without saying why could have failed for any of them
+	if len(list) == 0 {
+		unmatched = append(unmatched, errors.New("encountered error looking up objects"))
+	}
+
+	return errs, unmatched
+}
+
+// the codes that the executor puts in the extensions of errors it returns
+const (
+	// ErrorCodeDownstreamService marks errors that were returned by one of the services behind the gateway
+	ErrorCodeDownstreamService = "DOWNSTREAM_SERVICE_ERROR"
+	// ErrorCodeGateway marks errors that the gateway ran into while executing the plan
+	ErrorCodeGateway = "GATEWAY_ERROR"
+	// ErrorCodeCircuitOpen marks errors for services that weren't contacted because their circuit breaker is open
+	ErrorCodeCircuitOpen = "CIRCUIT_OPEN"
+	// ErrorCodeRequestBudget marks errors for parts of the query that were skipped because it needed too many requests
+	ErrorCodeRequestBudget = "REQUEST_BUDGET_EXCEEDED"
+)
+
+// executionStepError is the error produced by a step of the plan that failed. It keeps track of
+// where the result of the step was supposed to go so the executor can fill in the gap.
+type executionStepError struct {
+	Step           *QueryPlanStep
+	InsertionPoint []string
+	Err            error
+}
+
+func (e *executionStepError) Error() string {
+	return e.Err.Error()
+}
+
+// Errors returns the list of errors that caused the step to fail. Errors returned by the service have their
+// path rewritten to point into the client's operation and every error is tagged with the service that was
+// being queried as well as a code that distinguishes errors from the service from those raised by the gateway.
+func (e *executionStepError) Errors() graphql.ErrorList {
+	// the path in the response where the step was supposed to be inserted
+	insertionPath := executorResponsePath(e.InsertionPoint)
+
+	// errors without a path point to the first field that the step was responsible for
+	defaultPath := insertionPath
+	if fields := executorStepFields(e.Step); len(fields) > 0 {
+		defaultPath = append(append([]interface{}{}, insertionPath...), fields[0])
+	}
+
+	// the error could be a list of errors
+	errs := graphql.ErrorList{e.Err}
+	if list, ok := e.Err.(graphql.ErrorList); ok {
+		errs = list
+	}
+
+	result := graphql.ErrorList{}
+	for _, err := range errs {
+		var gqlErr *graphql.Error
+
+		if original, ok := err.(*graphql.Error); ok {
+			// copy the error so we don't modify something the queryer might hold onto
+			gqlErr = &graphql.Error{
+				Message:    original.Message,
+				Path:       defaultPath,
+				Extensions: map[string]interface{}{},
+			}
+			for key, value := range original.Extensions {
+				gqlErr.Extensions[key] = value
+			}
+
+			// the path of the error is relative to the query we sent the service
+			if len(original.Path) > 0 {
+				gqlErr.Path = executorRewriteErrorPath(e.Step, insertionPath, original.Path)
+			}
+
+			// services are free to send their own codes
+			if _, ok := gqlErr.Extensions["code"]; !ok {
+				gqlErr.Extensions["code"] = ErrorCodeDownstreamService
+			}
+		} else {
+			// if the error didn't come from the service then the gateway ran into it
+			code := ErrorCodeGateway
+			if _, ok := err.(*CircuitOpenError); ok {
+				code = ErrorCodeCircuitOpen
+			} else if err == ErrRequestBudgetExceeded {
+				code = ErrorCodeRequestBudget
+			}
+
+			gqlErr = &graphql.Error{
+				Message: err.Error(),
+				Path:    defaultPath,
+				Extensions: map[string]interface{}{
+					"code": code,
+				},
+			}
+		}
+
+		if e.Step.URL != "" {
+			gqlErr.Extensions["serviceURL"] = e.Step.URL
+		}
+
+		result = append(result, gqlErr)
+	}
+
+	return result
+}
+
+// executorRewriteErrorPath turns the path of an error returned by a service into the matching path in the
+// client's operation. Steps that were inserted into an object queried the service with node(id:) so the
+// error path has to be moved from underneath the node field to the insertion point.
+func executorRewriteErrorPath(step *QueryPlanStep, insertionPath []interface{}, path []interface{}) []interface{} {
+	if executorStripNode(step) && len(path) > 0 && path[0] == executorEntityField(step) {
+		path = path[1:]
+
+		// resolvers that take a list of keys put our object at the front of a list
+		if executorEntityList(step) && len(path) > 0 {
+			if _, ok := path[0].(string); !ok {
+				path = path[1:]
+			}
+		}
+	}
+
+	return append(append([]interface{}{}, insertionPath...), path...)
+}
+
+// executorStripNode returns true if the step queried for its object with a node(id:) field or an entity resolver
+func executorStripNode(step *QueryPlanStep) bool {
+	return step.ParentType != "Query" && step.ParentType != "Subscription" && step.ParentType != "Mutation"
+}
+
+// executorStepFields returns the keys in the response that the step is responsible for
+func executorStepFields(step *QueryPlanStep) []string {
+	selectionSet, err := graphql.ApplyFragments(step.SelectionSet, step.FragmentDefinitions)
+	if err != nil {
+		return nil
+	}
+
+	fields := []string{}
+	for _, field := range graphql.SelectedFields(selectionSet) {
+		key := field.Alias
+		if key == "" {
+			key = field.Name
+		}
+
+		fields = append(fields, key)
+	}
+
+	return fields
+}
+
+// executorResponsePath turns an insertion point like ["users:0#1", "friends:2#5"] into the
+// corresponding path in the response: ["users", 0, "friends", 2]
+func executorResponsePath(insertionPoint []string) []interface{} {
+	path := []interface{}{}
+
+	for _, point := range insertionPoint {
+		pointData, err := executorGetPointData(point)
+		if err != nil {
+			return path
+		}
+
+		path = append(path, pointData.Field)
+		if pointData.Index >= 0 {
+			path = append(path, pointData.Index)
+		}
+	}
+
+	return path
+}
+
+// executorNullFailedStep sets the fields that a failed step was responsible for to null. If one of those
+// fields can't be null, the null bubbles up to the nearest parent that can be. Returns false if the null
+// bubbled all the way up to the root of the response.
+func executorNullFailedStep(plan *QueryPlan, result map[string]interface{}, failure *executionStepError) bool {
+	// the path of the object that the step was going to fill in
+	objectPath := executorResponsePath(failure.InsertionPoint)
+
+	for _, field := range executorStepFields(failure.Step) {
+		// if another step already provided a value for this field, leave it alone
+		if object, ok := executorResponseValue(result, objectPath).(map[string]interface{}); ok && object[field] != nil {
+			continue
+		}
+
+		fieldPath := append(append([]interface{}{}, objectPath...), field)
+
+		// look for the nearest point along the path that can be null
+		types := executorPathTypes(plan, fieldPath)
+		target := len(fieldPath) - 1
+		if types != nil {
+			for target >= 0 && types[target].NonNull {
+				target--
+			}
+		}
+
+		// if nothing along the path can be null then the whole response is null
+		if target < 0 {
+			return false
+		}
+
+		// make sure the point is null
+		parent := executorResponseValue(result, fieldPath[:target])
+		switch parent := parent.(type) {
+		case map[string]interface{}:
+			if key, ok := fieldPath[target].(string); ok {
+				parent[key] = nil
+			}
+		case []interface{}:
+			if index, ok := fieldPath[target].(int); ok && index < len(parent) {
+				parent[index] = nil
+			}
+		}
+	}
+
+	return true
+}
+
+// executorResponseValue returns the value in the response at the given path. Returns nil if
+// the path goes through a null value.
+func executorResponseValue(result map[string]interface{}, path []interface{}) interface{} {
+	var value interface{} = result
+
+	for _, point := range path {
+		switch point := point.(type) {
+		case string:
+			obj, ok := value.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			value = obj[point]
+		case int:
+			list, ok := value.([]interface{})
+			if !ok || point >= len(list) {
+				return nil
+			}
+			value = list[point]
+		}
+	}
+
+	return value
+}
+
+// executorPathTypes returns the type of the value at every point along the path in the response.
+// Returns nil if the path could not be found in the operation.
+func executorPathTypes(plan *QueryPlan, path []interface{}) []*ast.Type {
+	if plan == nil || plan.Operation == nil {
+		return nil
+	}
+
+	types := []*ast.Type{}
+	selectionSet := plan.Operation.SelectionSet
+	var current *ast.Type
+
+	for _, point := range path {
+		switch point := point.(type) {
+		case string:
+			field, err := findSelection(point, selectionSet, plan.FragmentDefinitions)
+			if err != nil || field == nil || field.Definition == nil {
+				return nil
+			}
+
+			current = field.Definition.Type
+			selectionSet = field.SelectionSet
+		case int:
+			// an index points to an element of the list
+			if current == nil || current.Elem == nil {
+				return nil
+			}
+
+			current = current.Elem
+		}
+
+		types = append(types, current)
+	}
+
+	return types
 }
 
 func max(a, b int) int {
@@ -304,7 +1241,13 @@ func findSelection(matchString string, selectionSet ast.SelectionSet, fragmentDe
 
 // executorFindInsertionPoints returns the list of insertion points where this step should be executed.
 func executorFindInsertionPoints(resultLock *sync.Mutex, targetPoints []string, selectionSet ast.SelectionSet, result map[string]interface{}, startingPoints [][]string, fragmentDefs ast.FragmentDefinitionList) ([][]string, error) {
-	log.Debug("Looking for insertion points. target: ", targetPoints, " Starting from ", startingPoints)
+	return executorFindInsertionPointsByKey(nil, resultLock, targetPoints, selectionSet, result, startingPoints, fragmentDefs, "id")
+}
+
+// executorFindInsertionPointsByKey returns the list of insertion points where this step should be executed
+// using the given field of each object in place of its id.
+func executorFindInsertionPointsByKey(logger *Logger, resultLock *sync.Mutex, targetPoints []string, selectionSet ast.SelectionSet, result map[string]interface{}, startingPoints [][]string, fragmentDefs ast.FragmentDefinitionList, key string) ([][]string, error) {
+	logger.Debug("Looking for insertion points. target: ", targetPoints, " Starting from ", startingPoints)
 	oldBranch := startingPoints
 
 	// track the root of the selection set while  we walk
@@ -323,8 +1266,8 @@ func executorFindInsertionPoints(resultLock *sync.Mutex, targetPoints []string,
 		}
 	}
 
-	log.Debug("First meaningful path point: ", targetPoints[startingIndex])
-	log.Debug("result ", resultChunk)
+	logger.Debug("First meaningful path point: ", targetPoints[startingIndex])
+	logger.Debug("result ", resultChunk)
 
 	// if our starting point is []string{"users:0"} then we know everything so far
 	// is along the path of the steps insertion point
@@ -332,7 +1275,7 @@ func executorFindInsertionPoints(resultLock *sync.Mutex, targetPoints []string,
 		// the point in the steps insertion path that we want to add
 		point := targetPoints[pointI]
 
-		log.Debug("Looking for ", point)
+		logger.Debug("Looking for ", point)
 
 		// track wether we found a selection
 		var foundSelection *ast.Field
@@ -346,9 +1289,9 @@ func executorFindInsertionPoints(resultLock *sync.Mutex, targetPoints []string,
 			return [][]string{}, nil
 		}
 
-		log.Debug("")
-		log.Debug("Found Selection for: ", point)
-		log.Debug("Result Chunk: ", resultChunk)
+		logger.Debug("")
+		logger.Debug("Found Selection for: ", point)
+		logger.Debug("Result Chunk: ", resultChunk)
 		// make sure we are looking at the top of the selection set next time
 		selectionSetRoot = foundSelection.SelectionSet
 
@@ -356,7 +1299,7 @@ func executorFindInsertionPoints(resultLock *sync.Mutex, targetPoints []string,
 
 		// the bit of result chunk with the appropriate key should be a list
 		rootValue, ok := value[point]
-		if !ok {
+		if !ok || rootValue == nil {
 			return [][]string{}, nil
 		}
 
@@ -365,7 +1308,7 @@ func executorFindInsertionPoints(resultLock *sync.Mutex, targetPoints []string,
 
 		// if the type is a list
 		if selectionType.Elem != nil {
-			log.Debug("Selection should be a list")
+			logger.Debug("Selection should be a list")
 			// make sure the root value is a list
 			rootList, ok := rootValue.([]interface{})
 			if !ok {
@@ -377,6 +1320,11 @@ func executorFindInsertionPoints(resultLock *sync.Mutex, targetPoints []string,
 
 			// each value in the result contributes an insertion point
 			for entryI, iEntry := range rootList {
+				// null entries don't have anything to insert into
+				if iEntry == nil {
+					continue
+				}
+
 				resultEntry, ok := iEntry.(map[string]interface{})
 				if !ok {
 					return nil, errors.New("entry in result wasn't a map")
@@ -384,7 +1332,7 @@ func executorFindInsertionPoints(resultLock *sync.Mutex, targetPoints []string,
 
 				// the point we are going to add to the list
 				entryPoint := fmt.Sprintf("%s:%v", foundSelection.Name, entryI)
-				log.Warn("Adding ", entryPoint, " to list")
+				logger.Debug("Adding ", entryPoint, " to list")
 
 				newBranchSet := make([][]string, len(oldBranch))
 				copy(newBranchSet, oldBranch)
@@ -396,7 +1344,7 @@ func executorFindInsertionPoints(resultLock *sync.Mutex, targetPoints []string,
 						// if we are looking at the last thing in the insertion list
 						if pointI == len(targetPoints)-1 {
 							// look for an id
-							id, ok := resultEntry["id"]
+							id, ok := resultEntry[key]
 							if !ok {
 								return nil, errors.New("Could not find the id for elements in target list")
 							}
@@ -414,7 +1362,7 @@ func executorFindInsertionPoints(resultLock *sync.Mutex, targetPoints []string,
 				}
 
 				// compute the insertion points for that entry
-				entryInsertionPoints, err := executorFindInsertionPoints(resultLock, targetPoints, selectionSetRoot, resultEntry, newBranchSet, fragmentDefs)
+				entryInsertionPoints, err := executorFindInsertionPointsByKey(logger, resultLock, targetPoints, selectionSetRoot, resultEntry, newBranchSet, fragmentDefs, key)
 				if err != nil {
 					return nil, err
 				}
@@ -453,7 +1401,7 @@ func executorFindInsertionPoints(resultLock *sync.Mutex, targetPoints []string,
 
 					// look up the id of the object
 					resultLock.Lock()
-					id, ok := entry["id"]
+					id, ok := entry[key]
 					resultLock.Unlock()
 					if !ok {
 						return nil, errors.New("Could not find the id for the object")
@@ -472,7 +1420,7 @@ func executorFindInsertionPoints(resultLock *sync.Mutex, targetPoints []string,
 
 				for i := range oldBranch {
 					// look up the id of the object
-					id := rootObj["id"]
+					id := rootObj[key]
 					if !ok {
 						return nil, errors.New("Could not find the id for the object")
 					}
@@ -488,10 +1436,10 @@ func executorFindInsertionPoints(resultLock *sync.Mutex, targetPoints []string,
 	return oldBranch, nil
 }
 
-func executorExtractValue(source map[string]interface{}, resultLock *sync.Mutex, path []string) (interface{}, error) {
+func executorExtractValue(logger *Logger, source map[string]interface{}, resultLock *sync.Mutex, path []string) (interface{}, error) {
 	// a pointer to the objects we are modifying
 	var recent interface{} = source
-	log.Debug("Pulling ", path, " from ", source)
+	logger.Debug("Pulling ", path, " from ", source)
 
 	for i, point := range path[:] {
 		// if the point designates an element in the list
@@ -576,11 +1524,11 @@ func executorExtractValue(source map[string]interface{}, resultLock *sync.Mutex,
 	return recent, nil
 }
 
-func executorInsertObject(target map[string]interface{}, resultLock *sync.Mutex, path []string, value interface{}) error {
+func executorInsertObject(logger *Logger, target map[string]interface{}, resultLock *sync.Mutex, path []string, value interface{}) error {
 	// log.Debug("Inserting object\n    Target: ", target, "\n    Path: ", path, "\n    Value: ", value)
 	if len(path) > 0 {
 		// a pointer to the objects we are modifying
-		obj, err := executorExtractValue(target, resultLock, path)
+		obj, err := executorExtractValue(logger, target, resultLock, path)
 		if err != nil {
 			return err
 		}
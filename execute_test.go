@@ -8,8 +8,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/nautilus/graphql"
 	"github.com/stretchr/testify/assert"
@@ -1312,6 +1315,422 @@ func TestExecutor_multipleErrors(t *testing.T) {
 	}
 }
 
+func TestExecutor_errorPaths(t *testing.T) {
+	// the query we want to execute is
+	// {
+	// 		users {                  <- from serviceA
+	//      	firstName            <- from serviceA
+	// 			favoriteCatPhoto {   <- from serviceB, which fails
+	// 				url              <- from serviceB
+	// 			}
+	// 		}
+	//      status                   <- from serviceC, which can't be reached
+	// }
+
+	// build a query plan that the executor will follow
+	result, err := (&ParallelExecutor{}).Execute(&ExecutionContext{
+		RequestContext: context.Background(),
+		Plan: &QueryPlan{
+			RootStep: &QueryPlanStep{
+				Then: []*QueryPlanStep{
+					{
+						// this is equivalent to
+						// query { users }
+						ParentType:     "Query",
+						URL:            "serviceA",
+						InsertionPoint: []string{},
+						SelectionSet: ast.SelectionSet{
+							&ast.Field{
+								Name: "users",
+								Definition: &ast.FieldDefinition{
+									Type: ast.ListType(ast.NamedType("User", &ast.Position{}), &ast.Position{}),
+								},
+								SelectionSet: ast.SelectionSet{
+									&ast.Field{
+										Name: "firstName",
+										Definition: &ast.FieldDefinition{
+											Type: ast.NamedType("String", &ast.Position{}),
+										},
+									},
+								},
+							},
+						},
+						// return a known value we can test against
+						Queryer: &graphql.MockSuccessQueryer{map[string]interface{}{
+							"users": []interface{}{
+								map[string]interface{}{
+									"id":        "1",
+									"firstName": "hello",
+								},
+							},
+						}},
+						// then we have to ask for the users favorite cat photo and its url
+						Then: []*QueryPlanStep{
+							{
+								ParentType:     "User",
+								URL:            "serviceB",
+								InsertionPoint: []string{"users"},
+								SelectionSet: ast.SelectionSet{
+									&ast.Field{
+										Name: "favoriteCatPhoto",
+										Definition: &ast.FieldDefinition{
+											Type: ast.NamedType("CatPhoto", &ast.Position{}),
+										},
+										SelectionSet: ast.SelectionSet{
+											&ast.Field{
+												Name: "url",
+												Definition: &ast.FieldDefinition{
+													Type: ast.NamedType("String", &ast.Position{}),
+												},
+											},
+										},
+									},
+								},
+								// the service reports an error relative to the query it was sent
+								Queryer: graphql.QueryerFunc(func(input *graphql.QueryInput) (interface{}, error) {
+									return nil, graphql.ErrorList{
+										&graphql.Error{
+											Message: "no url",
+											Path:    []interface{}{"node", "favoriteCatPhoto", "url"},
+										},
+									}
+								}),
+							},
+						},
+					},
+					{
+						// this is equivalent to
+						// query { status }
+						ParentType:     "Query",
+						URL:            "serviceC",
+						InsertionPoint: []string{},
+						SelectionSet: ast.SelectionSet{
+							&ast.Field{
+								Name: "status",
+								Definition: &ast.FieldDefinition{
+									Type: ast.NamedType("String", &ast.Position{}),
+								},
+							},
+						},
+						Queryer: graphql.QueryerFunc(func(input *graphql.QueryInput) (interface{}, error) {
+							return nil, errors.New("connection refused")
+						}),
+					},
+				},
+			},
+		},
+	})
+	if !assert.NotNil(t, err) {
+		return
+	}
+
+	// the data that we could get should still be there
+	assert.Equal(t, map[string]interface{}{
+		"users": []interface{}{
+			map[string]interface{}{
+				"id":               "1",
+				"firstName":        "hello",
+				"favoriteCatPhoto": nil,
+			},
+		},
+		"status": nil,
+	}, result)
+
+	list, ok := err.(graphql.ErrorList)
+	if !assert.True(t, ok, "error was not an error list") || !assert.Len(t, list, 2) {
+		return
+	}
+
+	// index the errors by message so we don't depend on the order they came in
+	errs := map[string]*graphql.Error{}
+	for _, err := range list {
+		gqlErr, ok := err.(*graphql.Error)
+		if !assert.True(t, ok, "error was not a graphql error") {
+			return
+		}
+		errs[gqlErr.Message] = gqlErr
+	}
+
+	// the error from the service should point into the original query
+	assert.Equal(t, []interface{}{"users", 0, "favoriteCatPhoto", "url"}, errs["no url"].Path)
+	assert.Equal(t, map[string]interface{}{
+		"code":       ErrorCodeDownstreamService,
+		"serviceURL": "serviceB",
+	}, errs["no url"].Extensions)
+
+	// the error that the gateway ran into should point at the field it couldn't resolve
+	assert.Equal(t, []interface{}{"status"}, errs["connection refused"].Path)
+	assert.Equal(t, map[string]interface{}{
+		"code":       ErrorCodeGateway,
+		"serviceURL": "serviceC",
+	}, errs["connection refused"].Extensions)
+}
+
+func TestExecutor_batchNodeQueries(t *testing.T) {
+	// the query we want to execute is
+	// {
+	// 		users {                  <- from serviceA
+	//      	firstName            <- from serviceA
+	// 			favoriteColor        <- from serviceB
+	// 		}
+	// }
+
+	for _, nodesField := range []string{"", "nodes"} {
+		t.Run(fmt.Sprintf("nodes field %q", nodesField), func(t *testing.T) {
+			// keep track of the requests sent to serviceB
+			requests := []*graphql.QueryInput{}
+			requestsLock := &sync.Mutex{}
+
+			// serviceB looks up every user in a single request
+			serviceB := graphql.QueryerFunc(func(input *graphql.QueryInput) (interface{}, error) {
+				requestsLock.Lock()
+				requests = append(requests, input)
+				requestsLock.Unlock()
+
+				if nodesField != "" {
+					// the nodes don't have to come back in the order of the ids
+					nodes := []interface{}{}
+					for _, id := range input.Variables["ids"].([]interface{}) {
+						nodes = append([]interface{}{map[string]interface{}{
+							executorBatchIDAlias: id,
+							"favoriteColor":      fmt.Sprintf("color-%v", id),
+						}}, nodes...)
+					}
+
+					return map[string]interface{}{"nodes": nodes}, nil
+				}
+
+				result := map[string]interface{}{}
+				for i := range input.QueryDocument.Operations[0].SelectionSet {
+					id := input.Variables[fmt.Sprintf("id%d", i)]
+					result[fmt.Sprintf("n%d", i)] = map[string]interface{}{"favoriteColor": fmt.Sprintf("color-%v", id)}
+				}
+
+				return result, nil
+			})
+
+			result, err := (&ParallelExecutor{BatchNodeQueries: true, NodesField: nodesField}).Execute(&ExecutionContext{
+				RequestContext: context.Background(),
+				Plan: &QueryPlan{
+					RootStep: &QueryPlanStep{
+						Then: []*QueryPlanStep{
+							{
+								// this is equivalent to
+								// query { users }
+								ParentType:     "Query",
+								InsertionPoint: []string{},
+								SelectionSet: ast.SelectionSet{
+									&ast.Field{
+										Name: "users",
+										Definition: &ast.FieldDefinition{
+											Type: ast.ListType(ast.NamedType("User", &ast.Position{}), &ast.Position{}),
+										},
+										SelectionSet: ast.SelectionSet{
+											&ast.Field{
+												Name: "firstName",
+												Definition: &ast.FieldDefinition{
+													Type: ast.NamedType("String", &ast.Position{}),
+												},
+											},
+										},
+									},
+								},
+								// return a known value we can test against
+								Queryer: &graphql.MockSuccessQueryer{map[string]interface{}{
+									"users": []interface{}{
+										map[string]interface{}{"id": "1", "firstName": "hello"},
+										map[string]interface{}{"id": "2", "firstName": "goodbye"},
+										map[string]interface{}{"id": "3", "firstName": "moon"},
+									},
+								}},
+								// then we have to ask for every user's favorite color
+								Then: []*QueryPlanStep{
+									{
+										ParentType:     "User",
+										InsertionPoint: []string{"users"},
+										SelectionSet: ast.SelectionSet{
+											&ast.Field{
+												Name: "favoriteColor",
+												Definition: &ast.FieldDefinition{
+													Type: ast.NamedType("String", &ast.Position{}),
+												},
+											},
+										},
+										Queryer: serviceB,
+									},
+								},
+							},
+						},
+					},
+				},
+			})
+			if !assert.Nil(t, err) {
+				return
+			}
+
+			// every user should have their favorite color
+			assert.Equal(t, map[string]interface{}{
+				"users": []interface{}{
+					map[string]interface{}{"id": "1", "firstName": "hello", "favoriteColor": "color-1"},
+					map[string]interface{}{"id": "2", "firstName": "goodbye", "favoriteColor": "color-2"},
+					map[string]interface{}{"id": "3", "firstName": "moon", "favoriteColor": "color-3"},
+				},
+			}, result)
+
+			// and serviceB should have only been sent one request
+			if !assert.Len(t, requests, 1) {
+				return
+			}
+			if nodesField != "" {
+				assert.Equal(t, []interface{}{"1", "2", "3"}, requests[0].Variables["ids"])
+				assert.Contains(t, requests[0].Query, "nodes(ids: $ids)")
+			} else {
+				assert.Equal(t, map[string]interface{}{"id0": "1", "id1": "2", "id2": "3"}, requests[0].Variables)
+				assert.Contains(t, requests[0].Query, "n2: node(id: $id2)")
+			}
+		})
+	}
+}
+
+func TestExecutor_batchNodeQueriesPartialFailure(t *testing.T) {
+	// keep track of the requests sent to serviceB
+	requests := []*graphql.QueryInput{}
+	requestsLock := &sync.Mutex{}
+
+	// serviceB can't find the color of the second user. like most queryers, it throws away the data
+	// of the others when there are errors
+	serviceB := graphql.QueryerFunc(func(input *graphql.QueryInput) (interface{}, error) {
+		requestsLock.Lock()
+		requests = append(requests, input)
+		requestsLock.Unlock()
+
+		result := map[string]interface{}{}
+		errs := graphql.ErrorList{}
+		for i := range input.QueryDocument.Operations[0].SelectionSet {
+			id := input.Variables[fmt.Sprintf("id%d", i)]
+			if id == "2" {
+				errs = append(errs, &graphql.Error{Message: "no color", Path: []interface{}{fmt.Sprintf("n%d", i), "favoriteColor"}})
+				continue
+			}
+			result[fmt.Sprintf("n%d", i)] = map[string]interface{}{"favoriteColor": fmt.Sprintf("color-%v", id)}
+		}
+		if len(errs) > 0 {
+			return nil, errs
+		}
+
+		return result, nil
+	})
+
+	result, err := (&ParallelExecutor{BatchNodeQueries: true}).Execute(&ExecutionContext{
+		RequestContext: context.Background(),
+		Plan: &QueryPlan{
+			RootStep: &QueryPlanStep{
+				Then: []*QueryPlanStep{
+					{
+						// this is equivalent to
+						// query { users }
+						ParentType:     "Query",
+						InsertionPoint: []string{},
+						SelectionSet: ast.SelectionSet{
+							&ast.Field{
+								Name: "users",
+								Definition: &ast.FieldDefinition{
+									Type: ast.ListType(ast.NamedType("User", &ast.Position{}), &ast.Position{}),
+								},
+								SelectionSet: ast.SelectionSet{
+									&ast.Field{
+										Name: "firstName",
+										Definition: &ast.FieldDefinition{
+											Type: ast.NamedType("String", &ast.Position{}),
+										},
+									},
+								},
+							},
+						},
+						Queryer: &graphql.MockSuccessQueryer{map[string]interface{}{
+							"users": []interface{}{
+								map[string]interface{}{"id": "1", "firstName": "hello"},
+								map[string]interface{}{"id": "2", "firstName": "goodbye"},
+								map[string]interface{}{"id": "3", "firstName": "moon"},
+							},
+						}},
+						Then: []*QueryPlanStep{
+							{
+								ParentType:     "User",
+								InsertionPoint: []string{"users"},
+								SelectionSet: ast.SelectionSet{
+									&ast.Field{
+										Name: "favoriteColor",
+										Definition: &ast.FieldDefinition{
+											Type: ast.NamedType("String", &ast.Position{}),
+										},
+									},
+								},
+								Queryer: serviceB,
+							},
+						},
+					},
+				},
+			},
+		},
+	})
+
+	// only the user that failed should be missing
+	errs, ok := err.(graphql.ErrorList)
+	if !assert.True(t, ok) || !assert.Len(t, errs, 1) {
+		return
+	}
+	assert.Equal(t, "no color", errs[0].(*graphql.Error).Message)
+	assert.Equal(t, map[string]interface{}{
+		"users": []interface{}{
+			map[string]interface{}{"id": "1", "firstName": "hello", "favoriteColor": "color-1"},
+			map[string]interface{}{"id": "2", "firstName": "goodbye", "favoriteColor": nil},
+			map[string]interface{}{"id": "3", "firstName": "moon", "favoriteColor": "color-3"},
+		},
+	}, result)
+
+	// the users that didn't fail were looked up again without the one that did
+	if assert.Len(t, requests, 2) {
+		assert.Equal(t, map[string]interface{}{"id0": "1", "id1": "3"}, requests[1].Variables)
+	}
+}
+
+func TestExecutorSplitBatchErrors(t *testing.T) {
+	errs, unmatched := executorSplitBatchErrors(graphql.ErrorList{
+		&graphql.Error{Message: "first", Path: []interface{}{"n1", "favoriteColor"}},
+		&graphql.Error{Message: "second", Path: []interface{}{"n0"}},
+		errors.New("third"),
+	}, 3, "")
+
+	// the errors should be matched to their object and look like they came from a node query
+	assert.Equal(t, []graphql.ErrorList{
+		{
+			&graphql.Error{Message: "second", Path: []interface{}{"node"}},
+		},
+		{
+			&graphql.Error{Message: "first", Path: []interface{}{"node", "favoriteColor"}},
+		},
+		{},
+	}, errs)
+	// the ones without a path could belong to anything
+	assert.Equal(t, graphql.ErrorList{errors.New("third")}, unmatched)
+
+	// the same goes for lists of nodes
+	errs, unmatched = executorSplitBatchErrors(graphql.ErrorList{
+		&graphql.Error{Message: "first", Path: []interface{}{"nodes", float64(1), "favoriteColor"}},
+		&graphql.Error{Message: "second", Path: []interface{}{"nodes", "favoriteColor"}},
+	}, 2, "nodes")
+	assert.Equal(t, []graphql.ErrorList{
+		{},
+		{
+			&graphql.Error{Message: "first", Path: []interface{}{"node", "favoriteColor"}},
+		},
+	}, errs)
+	assert.Equal(t, graphql.ErrorList{
+		&graphql.Error{Message: "second", Path: []interface{}{"nodes", "favoriteColor"}},
+	}, unmatched)
+}
+
 func TestExecutor_includeIf(t *testing.T) {
 
 	// the query we want to execute is
@@ -1755,7 +2174,7 @@ func TestFindObject(t *testing.T) {
 		},
 	}
 
-	value, err := executorExtractValue(source, &sync.Mutex{}, []string{"hello:0", "friends:1", "friends:0"})
+	value, err := executorExtractValue(nil, source, &sync.Mutex{}, []string{"hello:0", "friends:1", "friends:0"})
 	if err != nil {
 		t.Error(err.Error())
 		return
@@ -1795,7 +2214,7 @@ func TestFindString(t *testing.T) {
 		},
 	}
 
-	value, err := executorExtractValue(source, &sync.Mutex{}, []string{"hello:0", "friends:1", "firstName"})
+	value, err := executorExtractValue(nil, source, &sync.Mutex{}, []string{"hello:0", "friends:1", "firstName"})
 	if err != nil {
 		t.Error(err.Error())
 		return
@@ -1812,7 +2231,7 @@ func TestExecutorInsertObject_insertObjectValues(t *testing.T) {
 	inserted := map[string]interface{}{"hello": "world"}
 
 	// insert the string deeeeep down
-	err := executorInsertObject(source, &sync.Mutex{}, []string{"hello:5#1", "message", "body:2"}, inserted)
+	err := executorInsertObject(nil, source, &sync.Mutex{}, []string{"hello:5#1", "message", "body:2"}, inserted)
 	if err != nil {
 		t.Error(err)
 		return
@@ -1891,7 +2310,7 @@ func TestExecutorInsertObject_insertListElements(t *testing.T) {
 	}
 
 	// insert the object deeeeep down
-	err := executorInsertObject(source, &sync.Mutex{}, []string{"hello", "objects:5"}, inserted)
+	err := executorInsertObject(nil, source, &sync.Mutex{}, []string{"hello", "objects:5"}, inserted)
 	if err != nil {
 		t.Error(err)
 		return
@@ -2072,3 +2491,213 @@ func TestFindInsertionPoint_stitchIntoObject(t *testing.T) {
 func TestFindInsertionPoint_handlesNullObjects(t *testing.T) {
 	t.Skip("Not yet implemented")
 }
+
+func TestExecutor_requestBudget(t *testing.T) {
+	postSchema, _ := graphql.LoadSchema(`
+		type Query {
+			posts: [Post]
+		}
+
+		type Post {
+			id: ID!
+			title: String!
+		}
+	`)
+	reviewSchema, _ := graphql.LoadSchema(`
+		type Post {
+			id: ID!
+			rating: Int
+		}
+	`)
+
+	// keep track of how many requests the review service is handling at once
+	inFlight := int32(0)
+	maxInFlight := int32(0)
+
+	factory := QueryerFactory(func(ctx *PlanningContext, url string) graphql.Queryer {
+		if url == "reviews" {
+			return graphql.QueryerFunc(func(input *graphql.QueryInput) (interface{}, error) {
+				current := atomic.AddInt32(&inFlight, 1)
+				defer atomic.AddInt32(&inFlight, -1)
+				for {
+					previous := atomic.LoadInt32(&maxInFlight)
+					if current <= previous || atomic.CompareAndSwapInt32(&maxInFlight, previous, current) {
+						break
+					}
+				}
+				time.Sleep(5 * time.Millisecond)
+
+				return map[string]interface{}{
+					"node": map[string]interface{}{"rating": 5},
+				}, nil
+			})
+		}
+
+		return &graphql.MockSuccessQueryer{map[string]interface{}{
+			"posts": []interface{}{
+				map[string]interface{}{"id": "1", "title": "hello"},
+				map[string]interface{}{"id": "2", "title": "world"},
+				map[string]interface{}{"id": "3", "title": "moon"},
+			},
+		}}
+	})
+
+	// the root step and two of the reviews fit in the budget
+	gateway, err := New([]*graphql.RemoteSchema{
+		{Schema: postSchema, URL: "posts"},
+		{Schema: reviewSchema, URL: "reviews"},
+	},
+		WithQueryerFactory(&factory),
+		WithExecutor(&ParallelExecutor{MaxRequests: 3, MaxConcurrency: 1}),
+	)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	reqCtx := &RequestContext{
+		Context: context.Background(),
+		Query:   "{ posts { title rating } }",
+	}
+
+	plans, err := gateway.GetPlan(reqCtx)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	result, err := gateway.Execute(reqCtx, plans)
+
+	// we never sent more than one request at a time
+	assert.Equal(t, int32(1), atomic.LoadInt32(&maxInFlight))
+
+	// one of the posts is missing its rating
+	posts, ok := result["posts"].([]interface{})
+	if !assert.True(t, ok) || !assert.Len(t, posts, 3) {
+		return
+	}
+	missing := 0
+	for _, post := range posts {
+		if post.(map[string]interface{})["rating"] == nil {
+			missing++
+		}
+	}
+	assert.Equal(t, 1, missing)
+
+	// and there's a single error saying why
+	errs, ok := err.(graphql.ErrorList)
+	if !assert.True(t, ok, "did not get an error list") || !assert.Len(t, errs, 1) {
+		return
+	}
+	gqlErr, ok := errs[0].(*graphql.Error)
+	if !assert.True(t, ok, "error was not a graphql error") {
+		return
+	}
+	assert.Equal(t, ErrRequestBudgetExceeded.Error(), gqlErr.Message)
+	assert.Equal(t, ErrorCodeRequestBudget, gqlErr.Extensions["code"])
+}
+
+func TestExecutor_mutationsInSeries(t *testing.T) {
+	postSchema, _ := graphql.LoadSchema(`
+		type Query {
+			posts: [Post]
+		}
+
+		type Mutation {
+			createPost: Post!
+			publishPost: Boolean!
+		}
+
+		type Post {
+			id: ID!
+			title: String!
+		}
+	`)
+	likeSchema, _ := graphql.LoadSchema(`
+		type Mutation {
+			likePost: Boolean!
+		}
+
+		type Post {
+			id: ID!
+			likes: Int!
+		}
+	`)
+
+	// keep track of when each mutation was sent and when it returned
+	eventsLock := &sync.Mutex{}
+	events := []string{}
+	record := func(event string) {
+		eventsLock.Lock()
+		defer eventsLock.Unlock()
+		events = append(events, event)
+	}
+
+	factory := QueryerFactory(func(ctx *PlanningContext, url string) graphql.Queryer {
+		return graphql.QueryerFunc(func(input *graphql.QueryInput) (interface{}, error) {
+			switch {
+			case strings.Contains(input.Query, "createPost"):
+				record("start createPost")
+				// the first mutation is slow so the others would finish first if they didn't wait
+				time.Sleep(20 * time.Millisecond)
+				record("end createPost")
+				return map[string]interface{}{
+					"createPost": map[string]interface{}{"id": "1", "title": "hello"},
+				}, nil
+
+			case strings.Contains(input.Query, "likePost"):
+				record("start likePost")
+				time.Sleep(5 * time.Millisecond)
+				record("end likePost")
+				return map[string]interface{}{"likePost": true}, nil
+
+			case strings.Contains(input.Query, "publishPost"):
+				record("start publishPost")
+				record("end publishPost")
+				return map[string]interface{}{"publishPost": true}, nil
+			}
+
+			// the likes of the post we just made
+			return map[string]interface{}{
+				"node": map[string]interface{}{"likes": 10},
+			}, nil
+		})
+	})
+
+	gateway, err := New([]*graphql.RemoteSchema{
+		{Schema: postSchema, URL: "posts"},
+		{Schema: likeSchema, URL: "likes"},
+	}, WithQueryerFactory(&factory))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	reqCtx := &RequestContext{
+		Context: context.Background(),
+		Query:   "mutation { createPost { title likes } likePost publishPost }",
+	}
+
+	plans, err := gateway.GetPlan(reqCtx)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	result, err := gateway.Execute(reqCtx, plans)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.Equal(t, map[string]interface{}{
+		"createPost":  map[string]interface{}{"title": "hello", "likes": 10},
+		"likePost":    true,
+		"publishPost": true,
+	}, result)
+
+	// each mutation waited for the one before it
+	assert.Equal(t, []string{
+		"start createPost",
+		"end createPost",
+		"start likePost",
+		"end likePost",
+		"start publishPost",
+		"end publishPost",
+	}, events)
+}
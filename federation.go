@@ -0,0 +1,225 @@
+package gateway
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/vektah/gqlparser/ast"
+
+	"github.com/nautilus/graphql"
+)
+
+// the directives services can use to say which of them owns a type and what the others need from it
+const (
+	federationKey      = "key"
+	federationExtends  = "extends"
+	federationExternal = "external"
+	federationRequires = "requires"
+
+	// the field that services which understand the directives look up objects with
+	federationEntitiesField = "_entities"
+)
+
+// Federation holds the directives in the schema of each service by its url. The directives are read
+// from the schemas the gateway is given. Introspection doesn't include the directives applied to a
+// schema so services have to be loaded from their SDL for the gateway to see them.
+type Federation map[string]*FederatedService
+
+// FederatedService holds the directives of a single service
+type FederatedService struct {
+	// Entities is true if the service can look up objects with _entities(representations:)
+	Entities bool
+	// Types holds the types with a @key or fields with @requires by name
+	Types map[string]*FederatedType
+}
+
+// FederatedType holds the directives of a type in a service
+type FederatedType struct {
+	// Key is the field named by @key(fields:) that the service looks up objects of the type with
+	Key string
+	// Requires holds the fields named by @requires(fields:) for each field that has one. The planner
+	// asks the service that owns the type for them and sends them along when it looks up the object.
+	Requires map[string][]string
+}
+
+// federationSchema reads the directives in the schemas of the sources. Keys the gateway can't use are
+// logged and left out instead of keeping the gateway from starting.
+func federationSchema(sources []*graphql.RemoteSchema, logger *Logger) (Federation, error) {
+	federation := Federation{}
+
+	for _, source := range sources {
+		service := &FederatedService{Types: map[string]*FederatedType{}}
+
+		if source.Schema.Query != nil && source.Schema.Query.Fields.ForName(federationEntitiesField) != nil {
+			service.Entities = true
+		}
+
+		for name, definition := range source.Schema.Types {
+			if definition.Kind != ast.Object {
+				continue
+			}
+
+			federated := &FederatedType{Requires: map[string][]string{}}
+
+			// @key can be repeated and the first one the gateway can use wins
+			for _, key := range definition.Directives.ForNames(federationKey) {
+				// the key ends up in the insertion points of the executor which can only hold one value
+				if federationCompoundKey(key) {
+					logger.Warn(fmt.Sprintf("Ignoring @key(fields: %q) of %s at %s since the gateway can only look objects up by a single field", key.Arguments.ForName("fields").Value.Raw, name, source.URL))
+					continue
+				}
+
+				fields, err := federationFieldSet(definition, key)
+				if err != nil {
+					return nil, fmt.Errorf("encountered error reading @key of %s at %s: %s", name, source.URL, err.Error())
+				}
+
+				if federated.Key == "" {
+					federated.Key = fields[0]
+				}
+			}
+
+			for _, field := range definition.Fields {
+				requires := field.Directives.ForName(federationRequires)
+				if requires == nil {
+					continue
+				}
+
+				fields, err := federationFieldSet(definition, requires)
+				if err != nil {
+					return nil, fmt.Errorf("encountered error reading @requires of %s.%s at %s: %s", name, field.Name, source.URL, err.Error())
+				}
+
+				// the values are copied out of the parent object so they can't have a selection of their own
+				for _, required := range fields {
+					fieldType := source.Schema.Types[definition.Fields.ForName(required).Type.Name()]
+					if fieldType == nil || (fieldType.Kind != ast.Scalar && fieldType.Kind != ast.Enum) {
+						return nil, fmt.Errorf("%s.%s at %s can only require scalar fields", name, field.Name, source.URL)
+					}
+				}
+
+				federated.Requires[field.Name] = fields
+			}
+
+			if federated.Key != "" || len(federated.Requires) > 0 {
+				service.Types[name] = federated
+			}
+		}
+
+		federation[source.URL] = service
+	}
+
+	return federation, nil
+}
+
+// federationCompoundKey returns true if the @key names more than one field or the fields of a nested object
+func federationCompoundKey(key *ast.Directive) bool {
+	argument := key.Arguments.ForName("fields")
+	if argument == nil || argument.Value == nil {
+		return false
+	}
+
+	return strings.ContainsAny(argument.Value.Raw, "{}") || len(strings.Fields(argument.Value.Raw)) > 1
+}
+
+// federationFieldSet returns the fields named by the fields argument of the directive
+func federationFieldSet(definition *ast.Definition, directive *ast.Directive) ([]string, error) {
+	argument := directive.Arguments.ForName("fields")
+	if argument == nil || argument.Value == nil {
+		return nil, fmt.Errorf("@%s is missing the fields argument", directive.Name)
+	}
+
+	if strings.ContainsAny(argument.Value.Raw, "{}") {
+		return nil, fmt.Errorf("@%s can't select the fields of nested objects", directive.Name)
+	}
+
+	fields := strings.Fields(argument.Value.Raw)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("@%s has to name at least one field", directive.Name)
+	}
+
+	for _, field := range fields {
+		if definition.Fields.ForName(field) == nil {
+			return nil, fmt.Errorf("%s has no field %s", definition.Name, field)
+		}
+	}
+
+	return fields, nil
+}
+
+// typeAt returns the directives of the type in the service at the location. nil means there aren't any.
+func (f Federation) typeAt(location string, typeName string) *FederatedType {
+	service, ok := f[location]
+	if !ok {
+		return nil
+	}
+
+	return service.Types[typeName]
+}
+
+// entities returns true if the service at the location can look up objects with _entities
+func (f Federation) entities(location string) bool {
+	service, ok := f[location]
+	return ok && service.Entities
+}
+
+// requires returns the fields of the parent that the service at the location needs to resolve the
+// fields in the selection, in the order they are first required
+func (f Federation) requires(location string, typeName string, selectionSet ast.SelectionSet, fragments ast.FragmentDefinitionList) ([]string, error) {
+	federated := f.typeAt(location, typeName)
+	if federated == nil || len(federated.Requires) == 0 {
+		return nil, nil
+	}
+
+	selection, err := graphql.ApplyFragments(selectionSet, fragments)
+	if err != nil {
+		return nil, err
+	}
+
+	requires := []string{}
+	seen := Set{}
+	for _, field := range graphql.SelectedFields(selection) {
+		for _, required := range federated.Requires[field.Name] {
+			if !seen.Has(required) {
+				seen.Add(required)
+				requires = append(requires, required)
+			}
+		}
+	}
+
+	return requires, nil
+}
+
+// federationDirective returns true if the directive is one that the gateway reads instead of a
+// part of the schema it serves
+func federationDirective(name string) bool {
+	switch name {
+	case federationKey, federationExtends, federationExternal, federationRequires:
+		return true
+	}
+
+	return false
+}
+
+// federationStripDirectives returns the directives in the list that are part of the schema the
+// gateway serves
+func federationStripDirectives(directives ast.DirectiveList) ast.DirectiveList {
+	stripped := ast.DirectiveList{}
+	for _, directive := range directives {
+		if !federationDirective(directive.Name) {
+			stripped = append(stripped, directive)
+		}
+	}
+
+	return stripped
+}
+
+// federationExternalField returns true if the field is defined by another service
+func federationExternalField(field *ast.FieldDefinition) bool {
+	return field.Directives.ForName(federationExternal) != nil
+}
+
+// federationExtendsType returns true if the type is owned by another service
+func federationExtendsType(definition *ast.Definition) bool {
+	return definition.Directives.ForName(federationExtends) != nil
+}
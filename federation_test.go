@@ -0,0 +1,277 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nautilus/graphql"
+	"github.com/stretchr/testify/assert"
+	"github.com/vektah/gqlparser/ast"
+)
+
+// the declarations that services following the federation spec add to their schema
+const federationTestDirectives = `
+	directive @key(fields: String!) on OBJECT
+	directive @extends on OBJECT
+	directive @external on FIELD_DEFINITION
+	directive @requires(fields: String!) on FIELD_DEFINITION
+
+	scalar _Any
+`
+
+// federationTestSources returns a posts service that owns the Post type and a reviews service
+// that extends it with a field that needs the title of the post
+func federationTestSources(t *testing.T) []*graphql.RemoteSchema {
+	postSchema, err := graphql.LoadSchema(federationTestDirectives + `
+		type Post @key(fields: "id") {
+			id: ID!
+			title: String!
+		}
+
+		type Query {
+			posts: [Post!]!
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reviewSchema, err := graphql.LoadSchema(federationTestDirectives + `
+		union _Entity = Post
+
+		type Post @key(fields: "id") @extends {
+			id: ID! @external
+			title: String! @external
+			rating: Int! @requires(fields: "title")
+		}
+
+		type Query {
+			_entities(representations: [_Any!]!): [_Entity]!
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return []*graphql.RemoteSchema{
+		{Schema: postSchema, URL: "posts"},
+		{Schema: reviewSchema, URL: "reviews"},
+	}
+}
+
+func TestMergeSchema_federation(t *testing.T) {
+	sources := federationTestSources(t)
+
+	schema, err := mergeSchemas([]*ast.Schema{sources[1].Schema, sources[0].Schema})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// the post has the fields of both services with the definitions of the owner
+	post := schema.Types["Post"]
+	if !assert.NotNil(t, post) {
+		return
+	}
+	assert.Len(t, post.Fields, 3)
+	assert.False(t, federationExternalField(post.Fields.ForName("title")))
+	assert.NotNil(t, post.Fields.ForName("rating"))
+
+	// the way the services talk to the gateway isn't part of the schema
+	assert.Nil(t, schema.Query.Fields.ForName("_entities"))
+	assert.Nil(t, schema.Types["_Any"])
+	assert.Nil(t, schema.Types["_Entity"])
+	assert.Nil(t, schema.Directives["requires"])
+
+	// only the owner is asked for the fields that the other service marks as external
+	locations := fieldURLs(sources, true)
+	titleLocations, _ := locations.URLFor("Post", "title")
+	assert.Equal(t, []string{"posts"}, titleLocations)
+}
+
+func TestFederationSchema_keys(t *testing.T) {
+	// @key can be repeated and the keys the gateway can't use are skipped with a warning
+	schema, err := graphql.LoadSchema(federationTestDirectives + `
+		type Post @key(fields: "id title") @key(fields: "slug") @key(fields: "id") {
+			id: ID!
+			slug: String!
+			title: String!
+		}
+
+		type Comment @key(fields: "post { id } index") {
+			index: Int!
+			post: Post!
+		}
+
+		type Query {
+			posts: [Post!]!
+			comments: [Comment!]!
+		}
+	`)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	output := &bytes.Buffer{}
+	federation, err := federationSchema([]*graphql.RemoteSchema{{Schema: schema, URL: "posts"}}, NewJSONLogger(output))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	if assert.NotNil(t, federation.typeAt("posts", "Post")) {
+		assert.Equal(t, "slug", federation.typeAt("posts", "Post").Key)
+	}
+	assert.Nil(t, federation.typeAt("posts", "Comment"))
+
+	messages := []string{}
+	for _, line := range logLines(t, output) {
+		assert.Equal(t, "warning", line["level"])
+		messages = append(messages, line["msg"].(string))
+	}
+	sort.Strings(messages)
+	assert.Equal(t, []string{
+		`Ignoring @key(fields: "id title") of Post at posts since the gateway can only look objects up by a single field`,
+		`Ignoring @key(fields: "post { id } index") of Comment at posts since the gateway can only look objects up by a single field`,
+	}, messages)
+}
+
+func TestFederationSchema_invalid(t *testing.T) {
+	// keys have to name fields of the type
+	schema, _ := graphql.LoadSchema(federationTestDirectives + `
+		type Post @key(fields: "slug") {
+			id: ID!
+			title: String!
+		}
+
+		type Query {
+			posts: [Post!]!
+		}
+	`)
+	_, err := federationSchema([]*graphql.RemoteSchema{{Schema: schema, URL: "posts"}}, nil)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "encountered error reading @key of Post at posts: Post has no field slug", err.Error())
+	}
+
+	// the required fields have to be on the type
+	schema, _ = graphql.LoadSchema(federationTestDirectives + `
+		type Post @extends {
+			id: ID! @external
+			rating: Int! @requires(fields: "body")
+		}
+
+		type Query {
+			posts: [Post!]!
+		}
+	`)
+	_, err = federationSchema([]*graphql.RemoteSchema{{Schema: schema, URL: "reviews"}}, nil)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "encountered error reading @requires of Post.rating at reviews: Post has no field body", err.Error())
+	}
+}
+
+func TestGateway_federation(t *testing.T) {
+	// the requests sent to the review service
+	lock := &sync.Mutex{}
+	requests := []*graphql.QueryInput{}
+
+	factory := QueryerFactory(func(ctx *PlanningContext, url string) graphql.Queryer {
+		if url == "reviews" {
+			return graphql.QueryerFunc(func(input *graphql.QueryInput) (interface{}, error) {
+				lock.Lock()
+				requests = append(requests, input)
+				lock.Unlock()
+
+				return map[string]interface{}{
+					"_entities": []interface{}{map[string]interface{}{"rating": 5}},
+				}, nil
+			})
+		}
+
+		return &graphql.MockSuccessQueryer{map[string]interface{}{
+			"posts": []interface{}{
+				map[string]interface{}{"id": "1", "title": "hello"},
+			},
+		}}
+	})
+
+	gateway, err := New(federationTestSources(t), WithQueryerFactory(&factory))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	reqCtx := &RequestContext{
+		Context: context.Background(),
+		Query:   "{ posts { rating } }",
+	}
+
+	plans, err := gateway.GetPlan(reqCtx)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// the posts service is asked for the title the reviews service needs
+	if !assert.Len(t, plans[0].RootStep.Then, 1) || !assert.Len(t, plans[0].RootStep.Then[0].Then, 1) {
+		return
+	}
+	assert.Contains(t,
+		strings.Join(strings.Fields(plans[0].RootStep.Then[0].QueryString), " "),
+		"{ posts { id title } }",
+	)
+
+	// which looks the post up with its representation
+	step := plans[0].RootStep.Then[0].Then[0]
+	assert.Equal(t,
+		"query ($id: [_Any!]!) { _entities(representations: $id) { ... on Post { rating } } }",
+		strings.Join(strings.Fields(step.QueryString), " "),
+	)
+	assert.Equal(t, []string{"title"}, step.Requires)
+
+	result, err := gateway.Execute(reqCtx, plans)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// the fields that were only there for the reviews service are gone
+	assert.Equal(t, map[string]interface{}{
+		"posts": []interface{}{map[string]interface{}{"rating": 5}},
+	}, result)
+	if assert.Len(t, requests, 1) {
+		assert.Equal(t, []interface{}{
+			map[string]interface{}{"__typename": "Post", "id": "1", "title": "hello"},
+		}, requests[0].Variables["id"])
+	}
+}
+
+func TestGateway_federationRequiresEntities(t *testing.T) {
+	sources := federationTestSources(t)
+
+	// without _entities the reviews service has nowhere to be sent the title
+	reviewSchema, _ := graphql.LoadSchema(federationTestDirectives + `
+		type Post @key(fields: "id") @extends {
+			id: ID! @external
+			title: String! @external
+			rating: Int! @requires(fields: "title")
+		}
+
+		type Query {
+			reviews: [Int!]!
+		}
+	`)
+	sources[1].Schema = reviewSchema
+
+	gateway, err := New(sources)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	_, err = gateway.GetPlan(&RequestContext{
+		Context: context.Background(),
+		Query:   "{ posts { rating } }",
+	})
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "reviews requires fields of Post but can't look them up with _entities", err.Error())
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/vektah/gqlparser/ast"
 
@@ -25,67 +27,200 @@ type Gateway struct {
 	queryerFactory *QueryerFactory
 	queryPlanCache QueryPlanCache
 
+	// picks between the services that can resolve the same field
+	locationSelector LocationSelector
+
+	// whether to add the timings of the request to the response and where else to send them
+	tracing    bool
+	traceHooks []TraceHook
+
+	// where the gateway sends its logs
+	logger *Logger
+	// whether to log every operation and how long an operation can take before its plan is logged
+	accessLog          bool
+	slowQueryThreshold time.Duration
+	slowQueryText      bool
+	// how long the successful responses to GET requests can be cached for
+	getMaxAge time.Duration
+
+	// the counters and histograms served by MetricsHandler
+	metrics *Metrics
+
+	// whether clients can ask for the plan of their query in the response extensions
+	queryPlanExtension bool
+
+	// the limits on the size of the queries we will plan
+	queryLimits *QueryLimits
+
+	// the timeouts, retries, and circuit breakers of the services
+	serviceConfigs       map[string]ServiceConfig
+	defaultServiceConfig *ServiceConfig
+
+	// the config of multipart requests. nil means they are turned away
+	uploads *UploadConfig
+
+	// translates the ids of nodes between the ones the clients see and the ones the services know
+	nodeIDCodec NodeIDCodec
+
+	// the fields that services look up objects with in place of node(id:)
+	entityResolvers EntityResolvers
+
+	// the factory used to open subscriptions against the remote services
+	subscriberFactory SubscriberFactory
+	// the origins of the pages that can open websocket connections with the gateway
+	subscriptionOrigins []string
+
 	// group up the list of middlewares at startup to avoid it during execution
 	requestMiddlewares  []graphql.NetworkMiddleware
 	responseMiddlewares []ResponseMiddleware
 
 	// the urls we have to visit to access certain fields
 	fieldURLs FieldURLMap
+
+	// the federation directives in the schemas of the sources
+	federation Federation
+
+	// the schema of the fields that the gateway resolves itself
+	internal *ast.Schema
+
+	// the sources can be reloaded while the gateway is running so access to
+	// sources, schema, fieldURLs, and federation has to go through this lock
+	schemaLock sync.RWMutex
+	// only one reload can happen at a time
+	reloadLock sync.Mutex
+
+	// the function used to introspect the sources when they are reloaded
+	introspectSources func(urls ...string) ([]*graphql.RemoteSchema, error)
+
+	// if set, the gateway reloads its sources on this interval
+	pollInterval    time.Duration
+	stopPolling     chan bool
+	stopPollingOnce sync.Once
 }
 
 // RequestContext holds all of the information required to satisfy the user's query
 type RequestContext struct {
-	Context   context.Context
-	Query     string
-	Variables map[string]interface{}
-	CacheKey  string
+	Context       context.Context
+	Query         string
+	OperationName string
+	Variables     map[string]interface{}
+	CacheKey      string
+	// Trace records the timings of the request if it is set
+	Trace *Trace
+	// Logger holds the fields that identify the request in the logs
+	Logger *Logger
 }
 
 func (g *Gateway) GetPlan(ctx *RequestContext) ([]*QueryPlan, error) {
+	// a hash that doesn't match the query would save the query under the wrong name
+	if ctx.CacheKey != "" && ctx.Query != "" && !strings.EqualFold(ctx.CacheKey, queryHash(ctx.Query)) {
+		return nil, errPersistedQueryHashMismatch
+	}
+
+	span := ctx.Trace.startSpan(TraceSpanPlanning)
+	start := time.Now()
+
+	// grab the schema, the locations, and the generation of the cache together so a reload can't
+	// happen in between. if one happens while we are planning, the cache won't save our plan
+	g.schemaLock.RLock()
+	planningCtx := &PlanningContext{
+		Query:         ctx.Query,
+		OperationName: ctx.OperationName,
+		Schema:        g.schema,
+		Gateway:       g,
+		Locations:     g.fieldURLs,
+		Federation:    g.federation,
+		Trace:         ctx.Trace,
+		Logger:        ctx.Logger,
+	}
+	if cache, ok := g.queryPlanCache.(queryPlanCacheWithGeneration); ok {
+		generation := cache.currentGeneration()
+		planningCtx.cacheGeneration = &generation
+	}
+	g.schemaLock.RUnlock()
+
 	// let the persister grab the plan for us
-	return g.queryPlanCache.Retrieve(&PlanningContext{
-		Query:     ctx.Query,
-		Schema:    g.schema,
-		Gateway:   g,
-		Locations: g.fieldURLs,
-	}, &ctx.CacheKey, g.planner)
+	plans, err := g.queryPlanCache.Retrieve(planningCtx, &ctx.CacheKey, g.planner)
+
+	g.metrics.observePlanning(time.Since(start))
+	ctx.Trace.finishSpan(span, err)
+	return plans, err
+}
+
+// Execute takes a query string, executes it, and returns the response. If some of the steps
+// in the plan fail, Execute returns the data that could be resolved along with the errors.
+func (g *Gateway) Execute(ctx *RequestContext, plans []*QueryPlan) (map[string]interface{}, error) {
+	// a document can hold more than one operation so we have to find the plan for the one the user asked for
+	plan, err := selectPlan(plans, ctx.OperationName)
+	if err != nil {
+		return nil, err
+	}
+
+	// execute the plan and return the results
+	return g.executePlan(ctx, plan)
 }
 
-// Execute takes a query string, executes it, and returns the response
-func (g *Gateway) Execute(ctx *RequestContext, plan []*QueryPlan) (map[string]interface{}, error) {
+// executePlan follows a single plan and passes the result through the response middlewares
+func (g *Gateway) executePlan(ctx *RequestContext, plan *QueryPlan) (map[string]interface{}, error) {
+	// requests that weren't given their own logger use the gateway's
+	logger := ctx.Logger
+	if logger == nil {
+		logger = g.logger
+	}
+
+	_, locations, _ := g.currentSchema()
+
 	// build up the execution context
 	executionContext := &ExecutionContext{
 		RequestContext:     ctx.Context,
 		RequestMiddlewares: g.requestMiddlewares,
-		Plan:               plan[0],
+		Plan:               plan,
 		Variables:          ctx.Variables,
+		Trace:              ctx.Trace,
+		Metrics:            g.metrics,
+		Logger:             logger,
+		NodeIDCodec:        g.nodeIDCodec,
+		Locations:          locations,
 	}
 
-	// TODO: handle plans of more than one query
-	// execute the plan and return the results
+	// execute the plan and return the results. the executor could return part of the
+	// response alongside an error so we only bail if there is nothing left to look at
 	result, err := g.executor.Execute(executionContext)
-	if err != nil {
+	if result == nil {
 		return nil, err
 	}
 
 	// now that we have our response, throw it through the list of middlewarse
+	span := ctx.Trace.startSpan(TraceSpanMiddlewares)
 	for _, ware := range g.responseMiddlewares {
 		if err := ware(executionContext, result); err != nil {
+			ctx.Trace.finishSpan(span, err)
 			return nil, err
 		}
 	}
+	ctx.Trace.finishSpan(span, nil)
 
 	// we're done here
-	return result, nil
+	return result, err
 }
 
 func (g *Gateway) internalSchema() *ast.Schema {
-	// we start off with the internal schema
-	schema := internalSchema
+	// we start off with a copy of the internal schema so that adding our query fields
+	// doesn't leak into other gateways
+	schema := *internalSchema
+	query := *internalSchema.Query
+	query.Fields = append(ast.FieldList{}, query.Fields...)
+	schema.Query = &query
+
+	schema.Types = map[string]*ast.Definition{}
+	for name, definition := range internalSchema.Types {
+		schema.Types[name] = definition
+	}
+	schema.Types[query.Name] = &query
 
 	// then we have to add any query fields we have
 	for _, field := range g.queryFields {
-		schema.Query.Fields = append(schema.Query.Fields, &ast.FieldDefinition{
+		query.Fields = append(query.Fields, &ast.FieldDefinition{
 			Name:      field.Name,
 			Type:      field.Type,
 			Arguments: field.Arguments,
@@ -93,7 +228,7 @@ func (g *Gateway) internalSchema() *ast.Schema {
 	}
 
 	// we're done
-	return schema
+	return &schema
 }
 
 // New instantiates a new schema with the required stuffs.
@@ -111,6 +246,11 @@ func New(sources []*graphql.RemoteSchema, configs ...Option) (*Gateway, error) {
 		merger:         MergerFunc(mergeSchemas),
 		queryFields:    []*QueryField{nodeField},
 		queryPlanCache: &NoQueryPlanCache{},
+
+		subscriberFactory: func(url string) Subscriber {
+			return NewWebSocketSubscriber(url)
+		},
+		introspectSources: graphql.IntrospectRemoteSchemas,
 	}
 
 	// pass the gateway through any Options
@@ -118,6 +258,21 @@ func New(sources []*graphql.RemoteSchema, configs ...Option) (*Gateway, error) {
 		config(gateway)
 	}
 
+	// the access log is logged at the info level which the default logger hides
+	if gateway.accessLog && !gateway.logger.infoEnabled() {
+		gateway.logger.Warn("The access log is enabled but the logger hides info logs. Call SetLevel(\"info\") on the logger to see it.")
+	}
+
+	// files sent to the gateway have to be forwarded to the services with multipart requests
+	if gateway.uploads != nil {
+		gateway.queryerFactory = uploadQueryerFactory(gateway.queryerFactory, *gateway.uploads)
+	}
+
+	// if the services have to be protected from each other, wrap the queryers they use
+	if len(gateway.serviceConfigs) > 0 || gateway.defaultServiceConfig != nil {
+		gateway.queryerFactory = serviceQueryerFactory(gateway.queryerFactory, gateway.defaultServiceConfig, gateway.serviceConfigs)
+	}
+
 	// if we have a queryer factory to assign
 	if gateway.queryerFactory != nil {
 		// if the planner can accept the factory
@@ -126,28 +281,55 @@ func New(sources []*graphql.RemoteSchema, configs ...Option) (*Gateway, error) {
 		}
 	}
 
-	internal := gateway.internalSchema()
-	// find the field URLs before we merge schemas. We need to make sure to include
-	// the fields defined by the gateway's internal schema
-	urls := fieldURLs(sources, true).Concat(
-		fieldURLs([]*graphql.RemoteSchema{
-			{
-				URL:    internalSchemaLocation,
-				Schema: internal,
-			}},
-			false,
-		),
-	)
+	// if we have a logger to assign
+	if gateway.logger != nil {
+		// if the planner can accept the logger
+		if planner, ok := gateway.planner.(PlannerWithLogger); ok {
+			gateway.planner = planner.WithLogger(gateway.logger)
+		}
+	}
 
-	// grab the schemas within each source
-	sourceSchemas := []*ast.Schema{}
-	for _, source := range sources {
-		sourceSchemas = append(sourceSchemas, source.Schema)
+	// if we have query limits to assign
+	if gateway.queryLimits != nil {
+		// if the planner can accept the limits
+		if planner, ok := gateway.planner.(PlannerWithQueryLimits); ok {
+			gateway.planner = planner.WithQueryLimits(gateway.queryLimits)
+		}
 	}
-	sourceSchemas = append(sourceSchemas, internal)
 
-	// merge them into one
-	schema, err := gateway.merger.Merge(sourceSchemas)
+	// if we have entity resolvers to assign
+	if len(gateway.entityResolvers) > 0 {
+		// if the planner can accept the resolvers
+		if planner, ok := gateway.planner.(PlannerWithEntityResolvers); ok {
+			gateway.planner = planner.WithEntityResolvers(gateway.entityResolvers)
+		}
+	}
+
+	// if we have a location selector to assign
+	if gateway.locationSelector != nil {
+		// if the planner can accept the selector
+		if planner, ok := gateway.planner.(PlannerWithLocationSelector); ok {
+			gateway.planner = planner.WithLocationSelector(gateway.locationSelector)
+		}
+
+		// plans computed with an old choice of location have to be thrown away
+		if selector, ok := gateway.locationSelector.(LocationSelectorWithListener); ok {
+			if cache, ok := gateway.queryPlanCache.(QueryPlanCacheWithInvalidation); ok {
+				selector.OnChange(cache.Invalidate)
+			}
+		}
+	}
+
+	// the metrics report the counters of the cache we ended up with
+	if gateway.metrics != nil {
+		gateway.metrics.cache = gateway.queryPlanCache
+	}
+
+	// the internal schema holds the fields that the gateway resolves itself
+	gateway.internal = gateway.internalSchema()
+
+	// merge the sources into the schema we will expose
+	schema, urls, federation, err := gateway.mergeSources(sources)
 	if err != nil {
 		// if something went wrong during the merge, return the result
 		return nil, err
@@ -170,22 +352,184 @@ func New(sources []*graphql.RemoteSchema, configs ...Option) (*Gateway, error) {
 		}
 	}
 
-	// we should be able to ask for the id under a gateway field without going to another service
-	// that requires that the gateway knows that it is a place it can get the `id`
-	for _, field := range gateway.queryFields {
-		urls.RegisterURL(field.Type.Name(), "id", internalSchemaLocation)
-	}
-
 	// assign the computed values
 	gateway.schema = schema
 	gateway.fieldURLs = urls
+	gateway.federation = federation
 	gateway.requestMiddlewares = requestMiddlewares
 	gateway.responseMiddlewares = responseMiddlewares
 
+	// some caches need to compute their plans before we start handling requests
+	if cache, ok := gateway.queryPlanCache.(QueryPlanCacheWithWarmUp); ok {
+		err := cache.WarmUp(&PlanningContext{
+			Schema:     gateway.schema,
+			Gateway:    gateway,
+			Locations:  gateway.fieldURLs,
+			Federation: gateway.federation,
+		}, gateway.planner)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// if we are supposed to watch the sources for changes
+	if gateway.pollInterval > 0 {
+		gateway.stopPolling = make(chan bool)
+		go gateway.pollSources(gateway.pollInterval, gateway.stopPolling)
+	}
+
 	// we're done here
 	return gateway, nil
 }
 
+// mergeSources merges the sources with the gateway's internal schema and computes the
+// locations of every field in the result along with the federation directives of the sources
+func (g *Gateway) mergeSources(sources []*graphql.RemoteSchema) (*ast.Schema, FieldURLMap, Federation, error) {
+	// find the field URLs before we merge schemas. We need to make sure to include
+	// the fields defined by the gateway's internal schema
+	urls := fieldURLs(sources, true).Concat(
+		fieldURLs([]*graphql.RemoteSchema{
+			{
+				URL:    internalSchemaLocation,
+				Schema: g.internal,
+			}},
+			false,
+		),
+	)
+
+	// grab the schemas within each source
+	sourceSchemas := []*ast.Schema{}
+	for _, source := range sources {
+		sourceSchemas = append(sourceSchemas, source.Schema)
+	}
+	sourceSchemas = append(sourceSchemas, g.internal)
+
+	// merge them into one
+	schema, err := g.merger.Merge(sourceSchemas)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// the planner needs to know which services own a type and what the others need from it
+	federation, err := federationSchema(sources, g.logger)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// we should be able to ask for the id under a gateway field without going to another service
+	// that requires that the gateway knows that it is a place it can get the `id`
+	for _, field := range g.queryFields {
+		urls.RegisterURL(field.Type.Name(), "id", internalSchemaLocation)
+	}
+
+	// if the ids say where the node came from, the gateway can send node(id:) to the right services
+	// itself instead of sending it to the first one that has the field
+	if g.nodeIDCodec != nil {
+		urls[urls.keyFor("Query", "node")] = []string{internalSchemaLocation}
+	}
+
+	return schema, urls, federation, nil
+}
+
+// currentSchema returns the schema, field locations, and federation directives the gateway is currently serving
+func (g *Gateway) currentSchema() (*ast.Schema, FieldURLMap, Federation) {
+	g.schemaLock.RLock()
+	defer g.schemaLock.RUnlock()
+
+	return g.schema, g.fieldURLs, g.federation
+}
+
+// UpdateSources merges the given sources and replaces the schema the gateway is serving.
+// If the new sources can't be merged, the gateway keeps serving the previous schema.
+func (g *Gateway) UpdateSources(sources []*graphql.RemoteSchema) error {
+	// the poller and manual reloads can't interleave or an older schema could replace a newer one
+	g.reloadLock.Lock()
+	defer g.reloadLock.Unlock()
+
+	schema, urls, federation, err := g.mergeSources(sources)
+	if err != nil {
+		return err
+	}
+
+	// caches that plan ahead of time have to be able to plan against the new schema
+	// before we can start using it
+	if cache, ok := g.queryPlanCache.(QueryPlanCacheWithWarmUp); ok {
+		err := cache.WarmUp(&PlanningContext{
+			Schema:     schema,
+			Gateway:    g,
+			Locations:  urls,
+			Federation: federation,
+		}, g.planner)
+		if err != nil {
+			return err
+		}
+	}
+
+	// swap the schema and the locations together
+	g.schemaLock.Lock()
+	defer g.schemaLock.Unlock()
+
+	g.sources = sources
+	g.schema = schema
+	g.fieldURLs = urls
+	g.federation = federation
+
+	// any plans computed against the old schema are no longer valid. the caches that warmed up
+	// already replaced theirs. this happens before anyone can read the new schema so that the
+	// requests planning against the old one can tell
+	if _, warmedUp := g.queryPlanCache.(QueryPlanCacheWithWarmUp); !warmedUp {
+		if cache, ok := g.queryPlanCache.(QueryPlanCacheWithInvalidation); ok {
+			cache.Invalidate()
+		}
+	}
+
+	return nil
+}
+
+// ReloadSources introspects the gateway's sources again and starts serving the merged result.
+// If the sources can't be introspected or merged, the gateway keeps serving the previous schema.
+func (g *Gateway) ReloadSources() error {
+	// the urls of the sources we are currently serving
+	g.schemaLock.RLock()
+	urls := []string{}
+	for _, source := range g.sources {
+		urls = append(urls, source.URL)
+	}
+	g.schemaLock.RUnlock()
+
+	sources, err := g.introspectSources(urls...)
+	if err != nil {
+		return err
+	}
+
+	return g.UpdateSources(sources)
+}
+
+// StopPolling stops the background reload of the gateway's sources. It is safe to call more than once.
+func (g *Gateway) StopPolling() {
+	g.stopPollingOnce.Do(func() {
+		if g.stopPolling != nil {
+			close(g.stopPolling)
+		}
+	})
+}
+
+func (g *Gateway) pollSources(interval time.Duration, stop chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := g.ReloadSources(); err != nil {
+				g.logger.Warn("Encountered error reloading sources: ", err.Error())
+			}
+		}
+	}
+}
+
 // Option is a function to be passed to New that configures the
 // resulting schema
 type Option func(*Gateway)
@@ -233,6 +577,22 @@ func WithQueryerFactory(factory *QueryerFactory) Option {
 	}
 }
 
+// WithSubscriberFactory returns an Option that changes the subscriber used to open subscriptions
+// against the remote services.
+func WithSubscriberFactory(factory SubscriberFactory) Option {
+	return func(g *Gateway) {
+		g.subscriberFactory = factory
+	}
+}
+
+// WithPollInterval returns an Option that reloads the gateway's sources on the given interval.
+// Call StopPolling to stop reloading.
+func WithPollInterval(interval time.Duration) Option {
+	return func(g *Gateway) {
+		g.pollInterval = interval
+	}
+}
+
 var nodeField = &QueryField{
 	Name: "node",
 	Type: ast.NamedType("Node", &ast.Position{}),
@@ -264,6 +624,10 @@ func fieldURLs(schemas []*graphql.RemoteSchema, stripInternal bool) FieldURLMap
 
 				// each field of each type can be found here
 				for _, fieldDef := range typeDef.Fields {
+					// unless another service resolves it
+					if federationExternalField(fieldDef) {
+						continue
+					}
 
 					// if the field is not an introspection field
 					if !(name == "Query" && strings.HasPrefix(fieldDef.Name, "__")) {
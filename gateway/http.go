@@ -19,8 +19,14 @@ func ListenAndServe(services []string) {
 		os.Exit(1)
 	}
 
+	// metrics are only collected if there is somewhere private to serve them
+	options := []gateway.Option{}
+	if MetricsPort != "" {
+		options = append(options, gateway.WithMetrics())
+	}
+
 	// create the gateway instance
-	gw, err := gateway.New(schemas)
+	gw, err := gateway.New(schemas, options...)
 	if err != nil {
 		fmt.Println("Encountered error starting gateway:", err.Error())
 		os.Exit(1)
@@ -29,6 +35,20 @@ func ListenAndServe(services []string) {
 	// add the graphql endpoints to the router
 	http.HandleFunc("/graphql", setCORSHeaders(gw.PlaygroundHandler))
 
+	// let prometheus scrape the metrics on their own port so they aren't public
+	if MetricsPort != "" {
+		metrics := http.NewServeMux()
+		metrics.HandleFunc("/metrics", gw.MetricsHandler)
+
+		go func() {
+			fmt.Printf("📈 Metrics are ready at http://localhost:%s/metrics\n", MetricsPort)
+			if err := http.ListenAndServe(fmt.Sprintf(":%s", MetricsPort), metrics); err != nil {
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
+		}()
+	}
+
 	// start the server
 	fmt.Printf("🚀 Gateway is ready at http://localhost:%s/graphql\n", Port)
 	err = http.ListenAndServe(fmt.Sprintf(":%s", Port), nil)
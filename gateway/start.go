@@ -11,11 +11,13 @@ var startCmd = &cobra.Command{
 }
 
 var Port string
+var MetricsPort string
 var Services []string
 
 func init() {
 	// add the configuration paramters for the start command
 	startCmd.Flags().StringVarP(&Port, "port", "p", "4000", "the port to listen on.")
+	startCmd.Flags().StringVar(&MetricsPort, "metrics-port", "", "the port to serve prometheus metrics on. metrics are disabled if it isn't set.")
 
 	startCmd.Flags().StringSliceVarP(&Services, "services", "s", []string{}, "Specify the services to wrap over")
 	startCmd.MarkFlagRequired("services")
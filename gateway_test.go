@@ -4,7 +4,9 @@ import (
 	"context"
 	"errors"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/nautilus/graphql"
 	"github.com/stretchr/testify/assert"
@@ -431,6 +433,451 @@ func TestGateway(t *testing.T) {
 	})
 }
 
+func TestGateway_executeOperationName(t *testing.T) {
+	schema, _ := graphql.LoadSchema(`
+		type Query {
+			foo: String
+			bar: String
+		}
+	`)
+
+	// a queryer that responds with the name of the field it was asked for
+	queryer := graphql.QueryerFunc(func(input *graphql.QueryInput) (interface{}, error) {
+		field := graphql.SelectedFields(input.QueryDocument.Operations[0].SelectionSet)[0]
+
+		return map[string]interface{}{field.Name: field.Name}, nil
+	})
+
+	factory := QueryerFactory(func(ctx *PlanningContext, url string) graphql.Queryer {
+		return queryer
+	})
+
+	gateway, err := New([]*graphql.RemoteSchema{{Schema: schema, URL: "url1"}}, WithQueryerFactory(&factory))
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	// a document with more than one operation
+	query := `
+		query Foo { foo }
+		query Bar { bar }
+	`
+
+	for _, name := range []string{"Foo", "Bar"} {
+		reqCtx := &RequestContext{
+			Context:       context.Background(),
+			Query:         query,
+			OperationName: name,
+		}
+
+		plans, err := gateway.GetPlan(reqCtx)
+		if !assert.Nil(t, err) {
+			return
+		}
+
+		// execute the plan and make sure we got the result of the named operation
+		result, err := gateway.Execute(reqCtx, plans)
+		if !assert.Nil(t, err) {
+			return
+		}
+
+		field := strings.ToLower(name)
+		assert.Equal(t, map[string]interface{}{field: field}, result)
+	}
+
+	// executing a multi-operation plan without a name is an error
+	reqCtx := &RequestContext{
+		Context:       context.Background(),
+		Query:         query,
+		OperationName: "Foo",
+	}
+	plans, err := gateway.GetPlan(reqCtx)
+	if !assert.Nil(t, err) {
+		return
+	}
+	reqCtx.OperationName = ""
+
+	_, err = gateway.Execute(reqCtx, plans)
+	assert.NotNil(t, err)
+}
+
+func TestGateway_partialResults(t *testing.T) {
+	postSchema, _ := graphql.LoadSchema(`
+		type Query {
+			posts: [Post]
+			strictPosts: [Post!]!
+		}
+
+		type Post {
+			id: ID!
+			title: String!
+		}
+	`)
+	reviewSchema, _ := graphql.LoadSchema(`
+		type Post {
+			id: ID!
+			rating: Int
+			author: String!
+		}
+	`)
+
+	// the service with the posts responds while the one with the reviews is down
+	factory := QueryerFactory(func(ctx *PlanningContext, url string) graphql.Queryer {
+		if url == "reviews" {
+			return graphql.QueryerFunc(func(input *graphql.QueryInput) (interface{}, error) {
+				return nil, errors.New("service unavailable")
+			})
+		}
+
+		return graphql.QueryerFunc(func(input *graphql.QueryInput) (interface{}, error) {
+			posts := []interface{}{
+				map[string]interface{}{"id": "1", "title": "hello"},
+				map[string]interface{}{"id": "2", "title": "world"},
+			}
+
+			// respond with the list that was asked for
+			field := graphql.SelectedFields(input.QueryDocument.Operations[0].SelectionSet)[0]
+
+			return map[string]interface{}{field.Name: posts}, nil
+		})
+	})
+
+	gateway, err := New([]*graphql.RemoteSchema{
+		{Schema: postSchema, URL: "posts"},
+		{Schema: reviewSchema, URL: "reviews"},
+	}, WithQueryerFactory(&factory))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	testCases := []struct {
+		Message string
+		Query   string
+		Data    map[string]interface{}
+	}{
+		{
+			"nullable fields are null",
+			"{ posts { title rating } }",
+			map[string]interface{}{
+				"posts": []interface{}{
+					map[string]interface{}{"title": "hello", "rating": nil},
+					map[string]interface{}{"title": "world", "rating": nil},
+				},
+			},
+		},
+		{
+			"non-null fields bubble up to the list entry",
+			"{ posts { title author } }",
+			map[string]interface{}{
+				"posts": []interface{}{nil, nil},
+			},
+		},
+		{
+			"non-null fields bubble up to the root",
+			"{ strictPosts { title author } }",
+			nil,
+		},
+	}
+
+	for _, row := range testCases {
+		t.Run(row.Message, func(t *testing.T) {
+			reqCtx := &RequestContext{
+				Context: context.Background(),
+				Query:   row.Query,
+			}
+
+			plans, err := gateway.GetPlan(reqCtx)
+			if !assert.Nil(t, err) {
+				return
+			}
+
+			result, err := gateway.Execute(reqCtx, plans)
+			assert.Equal(t, row.Data, result)
+
+			// there should be an error for every post that we couldn't look up
+			errs, ok := err.(graphql.ErrorList)
+			if !assert.True(t, ok, "did not get an error list") || !assert.Len(t, errs, 2) {
+				return
+			}
+
+			paths := []interface{}{}
+			for _, err := range errs {
+				gqlErr, ok := err.(*graphql.Error)
+				if !assert.True(t, ok, "error was not a graphql error") {
+					return
+				}
+				assert.Equal(t, "service unavailable", gqlErr.Message)
+
+				paths = append(paths, gqlErr.Path)
+			}
+
+			field := "rating"
+			if strings.Contains(row.Query, "author") {
+				field = "author"
+			}
+			list := "posts"
+			if strings.Contains(row.Query, "strictPosts") {
+				list = "strictPosts"
+			}
+			assert.ElementsMatch(t, []interface{}{
+				[]interface{}{list, 0, field},
+				[]interface{}{list, 1, field},
+			}, paths)
+		})
+	}
+}
+
+func TestGateway_reloadSources(t *testing.T) {
+	postSchema, _ := graphql.LoadSchema(`
+		type Query {
+			posts: [Post]
+		}
+
+		type Post {
+			id: ID!
+			title: String!
+		}
+	`)
+	reviewSchema, _ := graphql.LoadSchema(`
+		type Query {
+			posts: [Post]
+			reviews: [Review]
+		}
+
+		type Post {
+			id: ID!
+			title: String!
+		}
+
+		type Review {
+			id: ID!
+			body: String!
+		}
+	`)
+
+	// the sources that the next introspection will return
+	var introspected []*graphql.RemoteSchema
+	var introspectErr error
+	// the merger can be told to fail
+	var mergeErr error
+
+	cache := NewAutomaticQueryPlanCache()
+	gateway, err := New(
+		[]*graphql.RemoteSchema{{Schema: postSchema, URL: "posts"}},
+		WithQueryPlanCache(cache),
+		WithMerger(MergerFunc(func(sources []*ast.Schema) (*ast.Schema, error) {
+			if mergeErr != nil {
+				return nil, mergeErr
+			}
+			return mergeSchemas(sources)
+		})),
+	)
+	if !assert.Nil(t, err) {
+		return
+	}
+	gateway.introspectSources = func(urls ...string) ([]*graphql.RemoteSchema, error) {
+		// we should introspect the sources we are currently serving
+		assert.Equal(t, []string{"posts"}, urls)
+
+		return introspected, introspectErr
+	}
+
+	// plan a query so there is something in the cache
+	_, err = gateway.GetPlan(&RequestContext{
+		Context:  context.Background(),
+		Query:    "{ posts { title } }",
+		CacheKey: queryHash("{ posts { title } }"),
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, 1, cache.Stats().Entries)
+
+	t.Run("introspection fails", func(t *testing.T) {
+		introspectErr = errors.New("service unavailable")
+		defer func() { introspectErr = nil }()
+
+		assert.NotNil(t, gateway.ReloadSources())
+		assert.Nil(t, gateway.schema.Query.Fields.ForName("reviews"))
+		assert.Equal(t, 1, cache.Stats().Entries)
+	})
+
+	t.Run("merge fails", func(t *testing.T) {
+		introspected = []*graphql.RemoteSchema{{Schema: reviewSchema, URL: "posts"}}
+		mergeErr = errors.New("conflicting types")
+		defer func() { mergeErr = nil }()
+
+		assert.NotNil(t, gateway.ReloadSources())
+		assert.Nil(t, gateway.schema.Query.Fields.ForName("reviews"))
+		assert.Equal(t, 1, cache.Stats().Entries)
+	})
+
+	t.Run("swaps the schema", func(t *testing.T) {
+		introspected = []*graphql.RemoteSchema{{Schema: reviewSchema, URL: "posts"}}
+
+		if !assert.Nil(t, gateway.ReloadSources()) {
+			return
+		}
+
+		// the new field is part of the schema and can be found at the source
+		assert.NotNil(t, gateway.schema.Query.Fields.ForName("reviews"))
+		urls, err := gateway.fieldURLs.URLFor("Query", "reviews")
+		if !assert.Nil(t, err) {
+			return
+		}
+		assert.Equal(t, []string{"posts"}, urls)
+
+		// the plans computed against the old schema are gone
+		assert.Equal(t, 0, cache.Stats().Entries)
+
+		// and we can plan queries against the new schema
+		_, err = gateway.GetPlan(&RequestContext{
+			Context: context.Background(),
+			Query:   "{ reviews { body } }",
+		})
+		assert.Nil(t, err)
+	})
+}
+
+// testReloadingPlanner calls reload the first time it is asked for a plan, like a poller that
+// swaps the schema while the gateway is planning
+type testReloadingPlanner struct {
+	planner QueryPlanner
+	reload  func()
+}
+
+func (p *testReloadingPlanner) Plan(ctx *PlanningContext) ([]*QueryPlan, error) {
+	if reload := p.reload; reload != nil {
+		p.reload = nil
+		reload()
+	}
+
+	return p.planner.Plan(ctx)
+}
+
+func TestGateway_reloadSourcesWhilePlanning(t *testing.T) {
+	postSchema, _ := graphql.LoadSchema(`
+		type Query {
+			posts: [Post]
+		}
+
+		type Post {
+			id: ID!
+			title: String!
+		}
+	`)
+	reviewSchema, _ := graphql.LoadSchema(`
+		type Query {
+			posts: [Post]
+			reviews: [Review]
+		}
+
+		type Post {
+			id: ID!
+			title: String!
+		}
+
+		type Review {
+			id: ID!
+			body: String!
+		}
+	`)
+
+	cache := NewAutomaticQueryPlanCache()
+	gateway, err := New(
+		[]*graphql.RemoteSchema{{Schema: postSchema, URL: "posts"}},
+		WithQueryPlanCache(cache),
+	)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// the sources are reloaded while the first query is being planned and another request
+	// plans a query against the new schema before the first one is done
+	gateway.planner = &testReloadingPlanner{
+		planner: gateway.planner,
+		reload: func() {
+			if !assert.Nil(t, gateway.UpdateSources([]*graphql.RemoteSchema{{Schema: reviewSchema, URL: "posts"}})) {
+				return
+			}
+
+			_, err := gateway.GetPlan(&RequestContext{
+				Context:  context.Background(),
+				Query:    "{ reviews { body } }",
+				CacheKey: queryHash("{ reviews { body } }"),
+			})
+			assert.Nil(t, err)
+		},
+	}
+
+	_, err = gateway.GetPlan(&RequestContext{
+		Context:  context.Background(),
+		Query:    "{ posts { title } }",
+		CacheKey: queryHash("{ posts { title } }"),
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// the plan for the new schema is still around but the one for the old schema wasn't saved
+	assert.Equal(t, 1, cache.Stats().Entries)
+	cache.lock.Lock()
+	_, hasReviews := cache.entries[queryHash("{ reviews { body } }")]
+	_, hasPosts := cache.entries[queryHash("{ posts { title } }")]
+	cache.lock.Unlock()
+	assert.True(t, hasReviews)
+	assert.False(t, hasPosts)
+}
+
+func TestGateway_pollSources(t *testing.T) {
+	schema, _ := graphql.LoadSchema(`
+		type Query {
+			posts: [Post]
+		}
+
+		type Post {
+			id: ID!
+		}
+	`)
+
+	reloaded := make(chan bool, 1)
+
+	gateway, err := New([]*graphql.RemoteSchema{{Schema: schema, URL: "posts"}})
+	if !assert.Nil(t, err) {
+		return
+	}
+	gateway.introspectSources = func(urls ...string) ([]*graphql.RemoteSchema, error) {
+		select {
+		case reloaded <- true:
+		default:
+		}
+		return []*graphql.RemoteSchema{{Schema: schema, URL: "posts"}}, nil
+	}
+
+	// start polling the way WithPollInterval would
+	gateway.stopPolling = make(chan bool)
+	go gateway.pollSources(time.Millisecond, gateway.stopPolling)
+	defer gateway.StopPolling()
+
+	select {
+	case <-reloaded:
+	case <-time.After(time.Second):
+		t.Error("sources were not reloaded")
+	}
+
+	// stopping more than once from different goroutines is fine
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			gateway.StopPolling()
+		}()
+	}
+	wg.Wait()
+}
+
 func TestFieldURLs_concat(t *testing.T) {
 	// create a field url map
 	first := FieldURLMap{}
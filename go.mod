@@ -3,6 +3,7 @@ module github.com/nautilus/gateway
 require (
 	github.com/99designs/gqlgen v0.7.1
 	github.com/google/go-cmp v0.4.0 // indirect
+	github.com/gorilla/websocket v1.4.1
 	github.com/graph-gophers/graphql-go v0.0.0-20190108123631-d5b7dc6be53b
 	github.com/honeyscience/honey-utils-go v1.2.1
 	github.com/inconshreveable/mousetrap v1.0.0 // indirect
@@ -7,10 +7,15 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/nautilus/graphql"
+	"github.com/vektah/gqlparser/ast"
+	"github.com/vektah/gqlparser/parser"
 )
 
+// PersistedQuerySpecification is the persistedQuery extension of a request that points to a query by its hash
 type PersistedQuerySpecification struct {
 	Version int    `json:"version"`
 	Hash    string `json:"sha256Hash"`
@@ -23,9 +28,25 @@ type HTTPOperation struct {
 	OperationName string                 `json:"operationName"`
 	Extensions    struct {
 		QueryPlanCache *PersistedQuerySpecification `json:"persistedQuery"`
+		QueryPlan      bool                         `json:"queryPlan"`
 	} `json:"extensions"`
 }
 
+// errMissingQuery is returned for operations without a query or a persisted query hash
+var errMissingQuery = errors.New("could not find query body")
+
+// the only version of the persisted query protocol that we support
+const persistedQueryVersion = 1
+
+// the errors for persisted queries that don't follow the protocol
+var (
+	errPersistedQueryVersion      = errors.New("Unsupported persisted query version")
+	errPersistedQueryHashMismatch = errors.New("provided sha does not match query")
+)
+
+// errMutationOverGET is returned for mutations sent in GET requests which can be cached along the way
+var errMutationOverGET = errors.New("mutations cannot be sent with GET requests")
+
 func formatErrors(data map[string]interface{}, err error) map[string]interface{} {
 	// the final list of formatted errors
 	var errList graphql.ErrorList
@@ -33,6 +54,9 @@ func formatErrors(data map[string]interface{}, err error) map[string]interface{}
 	// if the err is itself an error list
 	if list, ok := err.(graphql.ErrorList); ok {
 		errList = list
+	} else if gqlErr, ok := err.(*graphql.Error); ok {
+		// keep the extensions of errors that are already formatted
+		errList = graphql.ErrorList{gqlErr}
 	} else {
 		errList = graphql.ErrorList{
 			&graphql.Error{
@@ -53,14 +77,258 @@ func formatErrors(data map[string]interface{}, err error) map[string]interface{}
 // a single object with { query, variables, operationName } or a list
 // of that object.
 func (g *Gateway) GraphQLHandler(w http.ResponseWriter, r *http.Request) {
+	// websocket connections are handled separately
+	if websocket.IsWebSocketUpgrade(r) {
+		g.SubscriptionHandler(w, r)
+		return
+	}
+
 	// this handler can handle multiple operations sent in the same query. Internally,
 	// it modules a single operation as a list of one.
-	operations := []*HTTPOperation{}
+	operations, batchMode, payloadErr := parseRequest(r, g.uploads)
+	// the files sent with the request are only around until we respond
+	defer closeUploads(operations)
+
+	// if there was an error retrieving the payload
+	if payloadErr != nil {
+		// stringify the response
+		response, _ := json.Marshal(formatErrors(nil, payloadErr))
+
+		// send the error to the user
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write(response)
+		return
+	}
+
+	/// Handle the operations regardless of the request method
+
+	// we have to respond to each operation in the right order
+	results := []map[string]interface{}{}
+
+	// the status code to report
+	statusCode := http.StatusOK
+
+	// every log for the request can be found with its id
+	requestID := httpRequestID(r)
+
+	for _, operation := range operations {
+		// the result of the operation
+		result := map[string]interface{}{}
+
+		// this might get mutated by the query plan cache so we have to pull it out
+		requestContext := operation.requestContext(r)
+		requestContext.Logger = g.logger.WithFields(LoggerFields{
+			"requestId":     requestID,
+			"operationName": operation.OperationName,
+		})
+		start := time.Now()
+		if g.tracing || len(g.traceHooks) > 0 {
+			requestContext.Trace = NewTrace(r.Context(), g.traceHooks...)
+			requestContext.Trace.continueFrom(r.Header.Get("traceparent"))
+		}
+
+		// if there is no query or cache key
+		if requestContext.Query == "" && requestContext.CacheKey == "" {
+			g.metrics.observeRequest(nil, errMissingQuery)
+			requestContext.Trace.finish()
+			g.logOperation(requestContext, nil, errMissingQuery, start)
+			statusCode = http.StatusUnprocessableEntity
+			results = append(results, formatErrors(nil, errMissingQuery))
+			continue
+		}
+
+		// a hash that doesn't match the query would save the query under the wrong name
+		if err := operation.validatePersistedQuery(); err != nil {
+			g.metrics.observeRequest(nil, err)
+			requestContext.Trace.finish()
+			g.logOperation(requestContext, nil, err, start)
+			statusCode = http.StatusBadRequest
+			results = append(results, formatErrors(nil, err))
+			continue
+		}
+
+		// mutations have side effects so they can't be sent in requests that could be cached or prefetched.
+		// if we can tell from the query, they are turned away before they reach the query plan cache
+		if r.Method == http.MethodGet && httpOperationType(requestContext.Query, operation.OperationName) == ast.Mutation {
+			g.metrics.observeRequest(nil, errMutationOverGET)
+			requestContext.Trace.finish()
+			g.logOperation(requestContext, nil, errMutationOverGET, start)
+			statusCode = http.StatusMethodNotAllowed
+			results = append(results, formatErrors(nil, errMutationOverGET))
+			continue
+		}
+
+		// Get the plan, and return a 400 if we can't get the plan
+		plan, err := g.GetPlan(requestContext)
+		if err != nil && isPersistedQueryMiss(err) {
+			// the client will send the query along with the hash once it sees this error. the
+			// response must not be cached or the client would keep seeing it
+			g.metrics.observeRequest(nil, err)
+			requestContext.Trace.finish()
+			g.logOperation(requestContext, nil, err, start)
+			w.Header().Set("Cache-Control", "private, no-cache, must-revalidate")
+			results = append(results, formatErrors(nil, err))
+			continue
+		}
+		if err != nil {
+			g.metrics.observeRequest(nil, err)
+			requestContext.Trace.finish()
+			g.logOperation(requestContext, nil, err, start)
+			response, err := json.Marshal(formatErrors(nil, err))
+			if err != nil {
+				// if we couldn't serialize the response then we're in internal error territory
+				response, err = json.Marshal(formatErrors(nil, err))
+				if err != nil {
+					response, _ = json.Marshal(formatErrors(nil, err))
+				}
+			}
+			if r.Method == http.MethodGet {
+				w.Header().Set("Cache-Control", g.getCacheControl(http.StatusBadRequest, nil))
+			}
+			emitResponse(w, http.StatusBadRequest, string(response))
+			return
+		}
+
+		// the plan that will be executed, if there is one for the operation
+		executed, _ := selectPlan(plan, operation.OperationName)
+
+		// persisted queries sent with just their hash can only be checked once we have their plan
+		if r.Method == http.MethodGet && executed != nil && executed.Operation != nil && executed.Operation.Operation == ast.Mutation {
+			g.metrics.observeRequest(executed, errMutationOverGET)
+			requestContext.Trace.finish()
+			g.logOperation(requestContext, executed, errMutationOverGET, start)
+			statusCode = http.StatusMethodNotAllowed
+			results = append(results, formatErrors(nil, errMutationOverGET))
+			continue
+		}
+
+		// fire the query with the request context passed through to execution
+		result, err = g.Execute(requestContext, plan)
+		requestContext.Trace.finish()
+		g.metrics.observeRequest(executed, err)
+		g.logOperation(requestContext, executed, err, start)
+
+		// the result for this operation. if some of the steps failed, we still
+		// have to send the data we could resolve alongside the errors
+		payload := map[string]interface{}{"data": result}
+		if err != nil {
+			payload = formatErrors(result, err)
+		}
+
+		extensions := map[string]interface{}{}
+
+		// if there was a cache key associated with this query
+		if requestContext.CacheKey != "" {
+			// embed the cache key in the response
+			extensions["persistedQuery"] = map[string]interface{}{
+				"sha256Hash": requestContext.CacheKey,
+				"version":    persistedQueryVersion,
+			}
+		}
+
+		// if the client wants to know how the query was resolved
+		if g.queryPlanExtension && operation.Extensions.QueryPlan && executed != nil {
+			extensions["queryPlan"] = DescribeQueryPlan(executed)
+		}
+
+		// if we are supposed to report how long the request took
+		if g.tracing {
+			extensions["tracing"] = requestContext.Trace.Extension()
+		}
+
+		if len(extensions) > 0 {
+			payload["extensions"] = extensions
+		}
+
+		// add this result to the list
+		results = append(results, payload)
+	}
+
+	// the final result depends on whether we are executing in batch mode or not
+	var finalResponse interface{}
+	if batchMode {
+		finalResponse = results
+	} else {
+		finalResponse = results[0]
+	}
+
+	// successful responses to GET requests can be cached if the gateway allows it
+	if r.Method == http.MethodGet && w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", g.getCacheControl(statusCode, results))
+	}
+
+	// serialized the response
+	response, err := json.Marshal(finalResponse)
+	if err != nil {
+		// if we couldn't serialize the response then we're in internal error territory
+		statusCode = http.StatusInternalServerError
+		response, err = json.Marshal(formatErrors(nil, err))
+		if err != nil {
+			response, _ = json.Marshal(formatErrors(nil, err))
+		}
+	}
+
+	// send the result to the user
+	emitResponse(w, statusCode, string(response))
+}
+
+// getCacheControl returns the Cache-Control header of the response to a GET request
+func (g *Gateway) getCacheControl(statusCode int, results []map[string]interface{}) string {
+	// errors are never cached
+	success := statusCode == http.StatusOK
+	for _, result := range results {
+		if _, hasErrors := result["errors"]; hasErrors {
+			success = false
+		}
+	}
+
+	if !success || g.getMaxAge <= 0 {
+		return "private, no-cache, must-revalidate"
+	}
 
-	// the error we have encountered when extracting query input
-	var payloadErr error
-	// make our lives easier. track if we're in batch mode
-	batchMode := false
+	return fmt.Sprintf("public, max-age=%d", int(g.getMaxAge.Seconds()))
+}
+
+// WithGetMaxAge returns an Option that lets browsers and CDNs cache the successful responses to GET
+// requests for the given amount of time. Only use it if the responses don't depend on who is asking.
+func WithGetMaxAge(maxAge time.Duration) Option {
+	return func(g *Gateway) {
+		g.getMaxAge = maxAge
+	}
+}
+
+// httpOperationType returns the type of the operation in the query. The type is empty if the query can't
+// be parsed or doesn't have the operation, which is left for the planner to report.
+func httpOperationType(query string, operationName string) ast.Operation {
+	if query == "" {
+		return ""
+	}
+
+	document, parseErr := parser.ParseQuery(&ast.Source{Input: query})
+	if parseErr != nil {
+		return ""
+	}
+
+	operation, err := selectOperation(document.Operations, operationName)
+	if err != nil {
+		return ""
+	}
+
+	return operation.Operation
+}
+
+// parseRequest pulls the operations out of a GET or POST request. POST requests can hold a list of
+// operations in which case batchMode is true. Files sent in multipart requests are saved until
+// closeUploads is called with the operations.
+func parseRequest(r *http.Request, uploads *UploadConfig) (operations []*HTTPOperation, batchMode bool, payloadErr error) {
+	// requests with files follow the multipart request spec
+	if isMultipartRequest(r) {
+		return parseMultipartRequest(r, uploads)
+	}
+
+	// the handlers can handle multiple operations sent in the same query. Internally,
+	// they model a single operation as a list of one.
+	operations = []*HTTPOperation{}
 
 	// if we got a GET request
 	if r.Method == http.MethodGet {
@@ -137,111 +405,55 @@ func (g *Gateway) GraphQLHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// if there was an error retrieving the payload
-	if payloadErr != nil {
-		// stringify the response
-		response, _ := json.Marshal(formatErrors(nil, payloadErr))
+	return operations, batchMode, payloadErr
+}
 
-		// send the error to the user
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		w.Write(response)
-		return
+// validatePersistedQuery returns an error if the persisted query extension of the operation doesn't
+// follow the protocol
+func (operation *HTTPOperation) validatePersistedQuery() error {
+	persisted := operation.Extensions.QueryPlanCache
+	if persisted == nil {
+		return nil
 	}
 
-	/// Handle the operations regardless of the request method
-
-	// we have to respond to each operation in the right order
-	results := []map[string]interface{}{}
-
-	// the status code to report
-	statusCode := http.StatusOK
-
-	for _, operation := range operations {
-		// the result of the operation
-		result := map[string]interface{}{}
-
-		// there might be a query plan cache key embedded in the operation
-		cacheKey := ""
-		if operation.Extensions.QueryPlanCache != nil {
-			cacheKey = operation.Extensions.QueryPlanCache.Hash
-		}
-
-		// if there is no query or cache key
-		if operation.Query == "" && cacheKey == "" {
-			statusCode = http.StatusUnprocessableEntity
-			results = append(results, formatErrors(nil, errors.New("could not find query body")))
-			continue
-		}
-
-		// this might get mutated by the query plan cache so we have to pull it out
-		requestContext := &RequestContext{
-			Context:   r.Context(),
-			Query:     operation.Query,
-			Variables: operation.Variables,
-			CacheKey:  cacheKey,
-		}
-
-		// Get the plan, and return a 400 if we can't get the plan
-		plan, err := g.GetPlan(requestContext)
-		if err != nil {
-			response, err := json.Marshal(formatErrors(nil, err))
-			if err != nil {
-				// if we couldn't serialize the response then we're in internal error territory
-				response, err = json.Marshal(formatErrors(nil, err))
-				if err != nil {
-					response, _ = json.Marshal(formatErrors(nil, err))
-				}
-			}
-			emitResponse(w, http.StatusBadRequest, string(response))
-			return
-		}
+	if persisted.Version != persistedQueryVersion {
+		return errPersistedQueryVersion
+	}
 
-		// fire the query with the request context passed through to execution
-		result, err = g.Execute(requestContext, plan)
-		if err != nil {
-			results = append(results, formatErrors(nil, err))
-			continue
+	// if the client sent the query along with the hash, they have to match
+	if operation.Query != "" && persisted.Hash != "" {
+		if !strings.EqualFold(persisted.Hash, queryHash(operation.Query)) {
+			return errPersistedQueryHashMismatch
 		}
+	}
 
-		// the result for this operation
-		payload := map[string]interface{}{"data": result}
-
-		// if there was a cache key associated with this query
-		if requestContext.CacheKey != "" {
-			// embed the cache key in the response
-			payload["extensions"] = map[string]interface{}{
-				"persistedQuery": map[string]interface{}{
-					"sha265Hash": requestContext.CacheKey,
-					"version":    "1",
-				},
-			}
-		}
+	return nil
+}
 
-		// add this result to the list
-		results = append(results, payload)
+// requestContext returns the context for executing the operation
+func (operation *HTTPOperation) requestContext(r *http.Request) *RequestContext {
+	// there might be a query plan cache key embedded in the operation
+	cacheKey := ""
+	if operation.Extensions.QueryPlanCache != nil {
+		cacheKey = operation.Extensions.QueryPlanCache.Hash
 	}
 
-	// the final result depends on whether we are executing in batch mode or not
-	var finalResponse interface{}
-	if batchMode {
-		finalResponse = results
-	} else {
-		finalResponse = results[0]
+	return &RequestContext{
+		Context:       r.Context(),
+		Query:         operation.Query,
+		OperationName: operation.OperationName,
+		Variables:     operation.Variables,
+		CacheKey:      cacheKey,
 	}
+}
 
-	// serialized the response
-	response, err := json.Marshal(finalResponse)
-	if err != nil {
-		// if we couldn't serialize the response then we're in internal error territory
-		statusCode = http.StatusInternalServerError
-		response, err = json.Marshal(formatErrors(nil, err))
-		if err != nil {
-			response, _ = json.Marshal(formatErrors(nil, err))
-		}
+// httpRequestID returns the id the client (or a proxy in front of us) gave the request or makes one up
+func httpRequestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); id != "" {
+		return id
 	}
 
-	// send the result to the user
-	emitResponse(w, statusCode, string(response))
+	return traceRandomID(8)
 }
 
 func emitResponse(w http.ResponseWriter, code int, response string) {
@@ -254,8 +466,8 @@ func emitResponse(w http.ResponseWriter, code int, response string) {
 // the user an interface that they can use to interact with the API. On
 // POSTs the endpoint executes the designated query
 func (g *Gateway) PlaygroundHandler(w http.ResponseWriter, r *http.Request) {
-	// on POSTs, we have to send the request to the graphqlHandler
-	if r.Method == http.MethodPost {
+	// on POSTs and websocket connections, we have to send the request to the graphqlHandler
+	if r.Method == http.MethodPost || websocket.IsWebSocketUpgrade(r) {
 		g.GraphQLHandler(w, r)
 		return
 	}
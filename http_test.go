@@ -4,12 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"golang.org/x/net/html"
 
@@ -154,6 +156,52 @@ func TestGraphQLHandler(t *testing.T) {
 	})
 }
 
+func TestGraphQLHandler_partialResults(t *testing.T) {
+	schema, _ := graphql.LoadSchema(`
+		type Query {
+			allUsers: [String]
+		}
+	`)
+
+	// an executor that could only resolve part of the response
+	gateway, err := New([]*graphql.RemoteSchema{
+		{Schema: schema, URL: "url1"},
+	}, WithExecutor(ExecutorFunc(
+		func(*ExecutionContext) (map[string]interface{}, error) {
+			return map[string]interface{}{
+				"allUsers": nil,
+			}, graphql.ErrorList{&graphql.Error{Message: "message", Path: []interface{}{"allUsers"}}}
+		},
+	)))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	request := httptest.NewRequest("POST", "/graphql", strings.NewReader(`{"query": "{ allUsers }"}`))
+	responseRecorder := httptest.NewRecorder()
+
+	gateway.GraphQLHandler(responseRecorder, request)
+
+	// the response should have the data alongside the errors
+	assert.Equal(t, http.StatusOK, responseRecorder.Result().StatusCode)
+
+	response := map[string]interface{}{}
+	if !assert.Nil(t, json.NewDecoder(responseRecorder.Body).Decode(&response)) {
+		return
+	}
+	assert.Equal(t, map[string]interface{}{"allUsers": nil}, response["data"])
+
+	errs, ok := response["errors"].([]interface{})
+	if !assert.True(t, ok) || !assert.Len(t, errs, 1) {
+		return
+	}
+	assert.Equal(t, "message", errs[0].(map[string]interface{})["message"])
+	assert.Equal(t, []interface{}{"allUsers"}, errs[0].(map[string]interface{})["path"])
+}
+
+// the sha256 hash of the query "{ allUsers }"
+const allUsersHash = "6c07498fc3f5d25b126807a308f533552d73251ea7fc7ccbb531ce723b6817a5"
+
 func TestQueryPlanCacheParameters_post(t *testing.T) {
 	// load the schema we'll test
 	schema, _ := graphql.LoadSchema(`
@@ -200,14 +248,20 @@ func TestQueryPlanCacheParameters_post(t *testing.T) {
 	// get the response from the handler
 	response := responseRecorder.Result()
 
-	// make sure we got a bad status
-	if !assert.Equal(t, http.StatusBadRequest, response.StatusCode) {
+	// the client has to be able to read the error so the status is OK
+	if !assert.Equal(t, http.StatusOK, response.StatusCode) {
 		return
 	}
+	// and the error can't be cached or the client will never get past it
+	assert.Equal(t, "private, no-cache, must-revalidate", response.Header.Get("Cache-Control"))
+
 	// the body of the response
 	body := struct {
 		Errors []struct {
-			Message string `json:"message"`
+			Message    string `json:"message"`
+			Extensions struct {
+				Code string `json:"code"`
+			} `json:"extensions"`
 		} `json:"errors"`
 	}{}
 	// parse the response
@@ -221,15 +275,16 @@ func TestQueryPlanCacheParameters_post(t *testing.T) {
 	if !assert.Equal(t, "PersistedQueryNotFound", body.Errors[0].Message) {
 		return
 	}
+	assert.Equal(t, ErrorCodePersistedQueryNotFound, body.Errors[0].Extensions.Code)
 
-	// passing in a valid query along with the hash
+	// passing in a valid query along with its hash
 	request = httptest.NewRequest("POST", "/graphql", strings.NewReader(`
 		{
 			"query": "{ allUsers }",
 			"extensions": {
 				"persistedQuery": {
 					"version": 1,
-					"sha256Hash": "1234"
+					"sha256Hash": "`+allUsersHash+`"
 				}
 			}
 		}
@@ -260,8 +315,8 @@ func TestQueryPlanCacheParameters_post(t *testing.T) {
 		"data": expectedResult,
 		"extensions": map[string]interface{}{
 			"persistedQuery": map[string]interface{}{
-				"sha265Hash": "1234",
-				"version":    "1",
+				"sha256Hash": allUsersHash,
+				"version":    float64(1),
 			},
 		},
 	}
@@ -313,14 +368,20 @@ func TestQueryPlanCacheParameters_get(t *testing.T) {
 	// get the response from the handler
 	response := responseRecorder.Result()
 
-	// make sure we got a bad status
-	if !assert.Equal(t, http.StatusBadRequest, response.StatusCode) {
+	// the client has to be able to read the error so the status is OK
+	if !assert.Equal(t, http.StatusOK, response.StatusCode) {
 		return
 	}
+	// and the error can't be cached or the client will never get past it
+	assert.Equal(t, "private, no-cache, must-revalidate", response.Header.Get("Cache-Control"))
+
 	// the body of the response
 	body := struct {
 		Errors []struct {
-			Message string `json:"message"`
+			Message    string `json:"message"`
+			Extensions struct {
+				Code string `json:"code"`
+			} `json:"extensions"`
 		} `json:"errors"`
 	}{}
 	// parse the response
@@ -334,6 +395,7 @@ func TestQueryPlanCacheParameters_get(t *testing.T) {
 	if !assert.Equal(t, "PersistedQueryNotFound", body.Errors[0].Message) {
 		return
 	}
+	assert.Equal(t, ErrorCodePersistedQueryNotFound, body.Errors[0].Extensions.Code)
 }
 
 func TestPlaygroundHandler_postRequest(t *testing.T) {
@@ -506,3 +568,173 @@ func TestPlaygroundHandler_getRequest(t *testing.T) {
 		return
 	}
 }
+
+func TestGraphQLHandler_persistedQueries(t *testing.T) {
+	schema, _ := graphql.LoadSchema(`
+		type Query {
+			allUsers: [String!]!
+		}
+
+		type Mutation {
+			addUser: String!
+		}
+	`)
+
+	newGateway := func(options ...Option) *Gateway {
+		gateway, err := New([]*graphql.RemoteSchema{
+			{Schema: schema, URL: "url1"},
+		}, append([]Option{WithExecutor(ExecutorFunc(
+			func(*ExecutionContext) (map[string]interface{}, error) {
+				return map[string]interface{}{"allUsers": []string{"John"}}, nil
+			},
+		))}, options...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return gateway
+	}
+
+	// the extensions of a request that points to the query by its hash
+	persisted := func(version int, hash string) string {
+		return fmt.Sprintf(`{"persistedQuery": {"version": %d, "sha256Hash": "%s"}}`, version, hash)
+	}
+
+	type response struct {
+		Data   map[string]interface{} `json:"data"`
+		Errors []struct {
+			Message    string `json:"message"`
+			Extensions struct {
+				Code string `json:"code"`
+			} `json:"extensions"`
+		} `json:"errors"`
+	}
+
+	send := func(gateway *Gateway, request *http.Request) (int, response) {
+		responseRecorder := httptest.NewRecorder()
+		gateway.GraphQLHandler(responseRecorder, request)
+
+		body := response{}
+		if err := json.NewDecoder(responseRecorder.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return responseRecorder.Result().StatusCode, body
+	}
+
+	t.Run("hash has to match the query", func(t *testing.T) {
+		status, body := send(newGateway(WithAutomaticQueryPlanCache()), httptest.NewRequest("POST", "/graphql", strings.NewReader(
+			`{"query": "{ allUsers }", "extensions": `+persisted(1, "1234")+`}`,
+		)))
+
+		assert.Equal(t, http.StatusBadRequest, status)
+		if assert.Len(t, body.Errors, 1) {
+			assert.Equal(t, "provided sha does not match query", body.Errors[0].Message)
+		}
+	})
+
+	t.Run("unsupported version", func(t *testing.T) {
+		status, body := send(newGateway(WithAutomaticQueryPlanCache()), httptest.NewRequest("POST", "/graphql", strings.NewReader(
+			`{"query": "{ allUsers }", "extensions": `+persisted(2, allUsersHash)+`}`,
+		)))
+
+		assert.Equal(t, http.StatusBadRequest, status)
+		if assert.Len(t, body.Errors, 1) {
+			assert.Equal(t, "Unsupported persisted query version", body.Errors[0].Message)
+		}
+	})
+
+	t.Run("gateway without a cache", func(t *testing.T) {
+		gateway := newGateway()
+
+		// a hash by itself can't be executed
+		status, body := send(gateway, httptest.NewRequest("POST", "/graphql", strings.NewReader(
+			`{"extensions": `+persisted(1, allUsersHash)+`}`,
+		)))
+		assert.Equal(t, http.StatusOK, status)
+		if assert.Len(t, body.Errors, 1) {
+			assert.Equal(t, MessagePersistedQueriesNotSupported, body.Errors[0].Message)
+			assert.Equal(t, ErrorCodePersistedQueryNotSupported, body.Errors[0].Extensions.Code)
+		}
+
+		// but the query is executed if it's sent along with the hash
+		status, body = send(gateway, httptest.NewRequest("POST", "/graphql", strings.NewReader(
+			`{"query": "{ allUsers }", "extensions": `+persisted(1, allUsersHash)+`}`,
+		)))
+		assert.Equal(t, http.StatusOK, status)
+		assert.Empty(t, body.Errors)
+		assert.NotNil(t, body.Data["allUsers"])
+	})
+
+	t.Run("GET requests with only the hash", func(t *testing.T) {
+		gateway := newGateway(WithAutomaticQueryPlanCache())
+		target := "/graphql?extensions=" + url.QueryEscape(persisted(1, allUsersHash))
+
+		// the gateway doesn't know the query yet
+		status, body := send(gateway, httptest.NewRequest("GET", target, nil))
+		assert.Equal(t, http.StatusOK, status)
+		if assert.Len(t, body.Errors, 1) {
+			assert.Equal(t, ErrorCodePersistedQueryNotFound, body.Errors[0].Extensions.Code)
+		}
+
+		// so the client sends it along with the hash
+		status, body = send(gateway, httptest.NewRequest("GET", target+"&query="+url.QueryEscape("{ allUsers }"), nil))
+		assert.Equal(t, http.StatusOK, status)
+		assert.Empty(t, body.Errors)
+
+		// from now on, the hash is enough
+		status, body = send(gateway, httptest.NewRequest("GET", target, nil))
+		assert.Equal(t, http.StatusOK, status)
+		assert.Empty(t, body.Errors)
+		assert.NotNil(t, body.Data["allUsers"])
+	})
+
+	t.Run("no mutations in GET requests", func(t *testing.T) {
+		cache := NewAutomaticQueryPlanCache()
+		gateway := newGateway(WithQueryPlanCache(cache))
+
+		mutation := "mutation { addUser }"
+		status, body := send(gateway, httptest.NewRequest("GET", "/graphql?query="+url.QueryEscape(mutation)+
+			"&extensions="+url.QueryEscape(persisted(1, queryHash(mutation))), nil))
+
+		assert.Equal(t, http.StatusMethodNotAllowed, status)
+		if assert.Len(t, body.Errors, 1) {
+			assert.Equal(t, "mutations cannot be sent with GET requests", body.Errors[0].Message)
+		}
+
+		// the mutation was turned away before it could be saved under its hash
+		assert.Equal(t, 0, cache.Stats().Entries)
+	})
+
+	t.Run("caching GET responses", func(t *testing.T) {
+		target := "/graphql?query=" + url.QueryEscape("{ allUsers }")
+
+		// responses can only be cached if the gateway says so
+		responseRecorder := httptest.NewRecorder()
+		newGateway().GraphQLHandler(responseRecorder, httptest.NewRequest("GET", target, nil))
+		assert.Equal(t, "private, no-cache, must-revalidate", responseRecorder.Result().Header.Get("Cache-Control"))
+
+		responseRecorder = httptest.NewRecorder()
+		newGateway(WithGetMaxAge(time.Minute)).GraphQLHandler(responseRecorder, httptest.NewRequest("GET", target, nil))
+		assert.Equal(t, "public, max-age=60", responseRecorder.Result().Header.Get("Cache-Control"))
+
+		// and errors are never cached
+		responseRecorder = httptest.NewRecorder()
+		newGateway(WithGetMaxAge(time.Minute)).GraphQLHandler(responseRecorder, httptest.NewRequest("GET", "/graphql?query="+url.QueryEscape("{ notAField }"), nil))
+		assert.Equal(t, "private, no-cache, must-revalidate", responseRecorder.Result().Header.Get("Cache-Control"))
+	})
+}
+
+func TestGateway_getPlanChecksHash(t *testing.T) {
+	schema, _ := graphql.LoadSchema(`
+		type Query {
+			value: String!
+		}
+	`)
+	gateway, err := New([]*graphql.RemoteSchema{{Schema: schema, URL: "url1"}}, WithAutomaticQueryPlanCache())
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// every way of planning a query has to check the hash before the query is saved under it
+	_, err = gateway.GetPlan(&RequestContext{Context: context.Background(), Query: "{ value }", CacheKey: "1234"})
+	assert.Equal(t, errPersistedQueryHashMismatch, err)
+}
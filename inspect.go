@@ -0,0 +1,180 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// QueryPlanDescription is a JSON-friendly summary of a QueryPlan. Steps, variables, and the fields to
+// scrub are sorted so that the same plan always produces the same output.
+type QueryPlanDescription struct {
+	OperationName string                      `json:"operationName"`
+	OperationType string                      `json:"operationType"`
+	Steps         []*QueryPlanStepDescription `json:"steps"`
+	FieldsToScrub map[string][][]string       `json:"fieldsToScrub"`
+}
+
+// QueryPlanStepDescription is a JSON-friendly summary of a QueryPlanStep. Variables lists the variables
+// of the request that the step sends along. The id of the object that a dependent step looks up is
+// added by the executor and isn't listed.
+type QueryPlanStepDescription struct {
+	URL            string                      `json:"url"`
+	ParentType     string                      `json:"parentType"`
+	InsertionPoint []string                    `json:"insertionPoint"`
+	Query          string                      `json:"query"`
+	Variables      []string                    `json:"variables"`
+	Then           []*QueryPlanStepDescription `json:"then"`
+	Ordered        bool                        `json:"ordered,omitempty"`
+}
+
+// WithQueryPlanExtension returns an Option that lets clients ask for the plan of their query by
+// sending "queryPlan": true in the extensions of the request. The plan is added to the
+// extensions of the response.
+func WithQueryPlanExtension() Option {
+	return func(g *Gateway) {
+		g.queryPlanExtension = true
+	}
+}
+
+// DescribeQueryPlan returns the description of the plan
+func DescribeQueryPlan(plan *QueryPlan) *QueryPlanDescription {
+	description := &QueryPlanDescription{
+		Steps:         []*QueryPlanStepDescription{},
+		FieldsToScrub: map[string][][]string{},
+	}
+
+	if plan.Operation != nil {
+		description.OperationName = plan.Operation.Name
+		description.OperationType = string(plan.Operation.Operation)
+	}
+
+	// the root step is a placeholder for the steps that can start right away
+	if plan.RootStep != nil {
+		description.Steps = describeQueryPlanSteps(plan.RootStep.Then)
+	}
+
+	for field, paths := range plan.FieldsToScrub {
+		sorted := append([][]string{}, paths...)
+		sort.Slice(sorted, func(i, j int) bool {
+			return strings.Join(sorted[i], ".") < strings.Join(sorted[j], ".")
+		})
+		description.FieldsToScrub[field] = sorted
+	}
+
+	return description
+}
+
+func describeQueryPlanSteps(steps []*QueryPlanStep) []*QueryPlanStepDescription {
+	descriptions := []*QueryPlanStepDescription{}
+
+	for _, step := range steps {
+		variables := []string{}
+		for variable := range step.Variables {
+			variables = append(variables, variable)
+		}
+		sort.Strings(variables)
+
+		descriptions = append(descriptions, &QueryPlanStepDescription{
+			URL:            step.URL,
+			ParentType:     step.ParentType,
+			InsertionPoint: append([]string{}, step.InsertionPoint...),
+			Query:          step.QueryString,
+			Variables:      variables,
+			Then:           describeQueryPlanSteps(step.Then),
+			Ordered:        step.Ordered,
+		})
+	}
+
+	// the top-level steps of a mutation are already in the order they run
+	if len(steps) > 0 && steps[0].Ordered {
+		return descriptions
+	}
+
+	// the planner builds steps concurrently so their order isn't stable
+	sort.Slice(descriptions, func(i, j int) bool {
+		return describeQueryPlanStepKey(descriptions[i]) < describeQueryPlanStepKey(descriptions[j])
+	})
+
+	return descriptions
+}
+
+func describeQueryPlanStepKey(step *QueryPlanStepDescription) string {
+	return strings.Join([]string{
+		strings.Join(step.InsertionPoint, "."),
+		step.ParentType,
+		step.URL,
+		step.Query,
+	}, "\n")
+}
+
+// QueryPlanHandler returns the plan of the query in the request without executing it. It accepts
+// the same requests as GraphQLHandler and responds with { "data": [plan descriptions] }.
+func (g *Gateway) QueryPlanHandler(w http.ResponseWriter, r *http.Request) {
+	operations, batchMode, err := parseRequest(r, g.uploads)
+	defer closeUploads(operations)
+	if err != nil {
+		response, _ := json.Marshal(formatErrors(nil, err))
+		emitResponse(w, http.StatusUnprocessableEntity, string(response))
+		return
+	}
+
+	results := []map[string]interface{}{}
+	statusCode := http.StatusOK
+
+	for _, operation := range operations {
+		requestContext := operation.requestContext(r)
+
+		// if there is no query or cache key
+		if requestContext.Query == "" && requestContext.CacheKey == "" {
+			statusCode = http.StatusUnprocessableEntity
+			results = append(results, formatErrors(nil, errMissingQuery))
+			continue
+		}
+
+		if err := operation.validatePersistedQuery(); err != nil {
+			statusCode = http.StatusBadRequest
+			results = append(results, formatErrors(nil, err))
+			continue
+		}
+
+		plans, err := g.GetPlan(requestContext)
+		if err != nil {
+			statusCode = http.StatusBadRequest
+			results = append(results, formatErrors(nil, err))
+			continue
+		}
+
+		// only describe the operation that would be executed
+		if operation.OperationName != "" {
+			plan, err := selectPlan(plans, operation.OperationName)
+			if err != nil {
+				statusCode = http.StatusBadRequest
+				results = append(results, formatErrors(nil, err))
+				continue
+			}
+			plans = []*QueryPlan{plan}
+		}
+
+		descriptions := []*QueryPlanDescription{}
+		for _, plan := range plans {
+			descriptions = append(descriptions, DescribeQueryPlan(plan))
+		}
+
+		results = append(results, map[string]interface{}{"data": descriptions})
+	}
+
+	var finalResponse interface{} = results
+	if !batchMode {
+		finalResponse = results[0]
+	}
+
+	response, err := json.Marshal(finalResponse)
+	if err != nil {
+		statusCode = http.StatusInternalServerError
+		response, _ = json.Marshal(formatErrors(nil, err))
+	}
+
+	emitResponse(w, statusCode, string(response))
+}
@@ -0,0 +1,233 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nautilus/graphql"
+	"github.com/stretchr/testify/assert"
+	"github.com/vektah/gqlparser/ast"
+)
+
+func TestDescribeQueryPlan(t *testing.T) {
+	plan := &QueryPlan{
+		Operation: &ast.OperationDefinition{
+			Name:      "MyQuery",
+			Operation: ast.Query,
+		},
+		RootStep: &QueryPlanStep{
+			Then: []*QueryPlanStep{
+				{
+					URL:            "posts",
+					ParentType:     "Query",
+					InsertionPoint: []string{},
+					QueryString:    "{ posts { id } }",
+					Variables:      Set{},
+					// the order of the dependents doesn't matter
+					Then: []*QueryPlanStep{
+						{
+							URL:            "reviews",
+							ParentType:     "Post",
+							InsertionPoint: []string{"posts"},
+							QueryString:    "query ($id: ID!) { node(id: $id) { ... on Post { rating } } }",
+							Variables:      Set{},
+						},
+						{
+							URL:            "authors",
+							ParentType:     "Post",
+							InsertionPoint: []string{"posts"},
+							QueryString:    "query ($id: ID!, $size: Int, $after: ID) { node(id: $id) { ... on Post { author(size: $size, after: $after) } } }",
+							Variables:      Set{"size": true, "after": true},
+						},
+					},
+				},
+			},
+		},
+		FieldsToScrub: map[string][][]string{
+			"id": {{"posts", "b"}, {"posts", "a"}},
+		},
+	}
+
+	description, err := json.Marshal(DescribeQueryPlan(plan))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.JSONEq(t, `{
+		"operationName": "MyQuery",
+		"operationType": "query",
+		"steps": [
+			{
+				"url": "posts",
+				"parentType": "Query",
+				"insertionPoint": [],
+				"query": "{ posts { id } }",
+				"variables": [],
+				"then": [
+					{
+						"url": "authors",
+						"parentType": "Post",
+						"insertionPoint": ["posts"],
+						"query": "query ($id: ID!, $size: Int, $after: ID) { node(id: $id) { ... on Post { author(size: $size, after: $after) } } }",
+						"variables": ["after", "size"],
+						"then": []
+					},
+					{
+						"url": "reviews",
+						"parentType": "Post",
+						"insertionPoint": ["posts"],
+						"query": "query ($id: ID!) { node(id: $id) { ... on Post { rating } } }",
+						"variables": [],
+						"then": []
+					}
+				]
+			}
+		],
+		"fieldsToScrub": {
+			"id": [["posts", "a"], ["posts", "b"]]
+		}
+	}`, string(description))
+}
+
+func inspectTestGateway(t *testing.T, options ...Option) *Gateway {
+	postSchema, _ := graphql.LoadSchema(`
+		type Query {
+			posts: [Post]
+		}
+
+		type Post {
+			id: ID!
+			title: String!
+		}
+	`)
+	reviewSchema, _ := graphql.LoadSchema(`
+		type Post {
+			id: ID!
+			rating: Int
+		}
+	`)
+
+	factory := QueryerFactory(func(ctx *PlanningContext, url string) graphql.Queryer {
+		if url == "reviews" {
+			return &graphql.MockSuccessQueryer{map[string]interface{}{
+				"node": map[string]interface{}{"rating": 5},
+			}}
+		}
+
+		return &graphql.MockSuccessQueryer{map[string]interface{}{
+			"posts": []interface{}{
+				map[string]interface{}{"id": "1", "title": "hello"},
+			},
+		}}
+	})
+
+	gateway, err := New([]*graphql.RemoteSchema{
+		{Schema: postSchema, URL: "posts"},
+		{Schema: reviewSchema, URL: "reviews"},
+	}, append([]Option{WithQueryerFactory(&factory)}, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return gateway
+}
+
+func TestQueryPlanHandler(t *testing.T) {
+	gateway := inspectTestGateway(t)
+
+	request := httptest.NewRequest("POST", "/graphql/plan", strings.NewReader(`{"query": "{ posts { title rating } }"}`))
+	responseRecorder := httptest.NewRecorder()
+
+	gateway.QueryPlanHandler(responseRecorder, request)
+	assert.Equal(t, http.StatusOK, responseRecorder.Result().StatusCode)
+
+	response := struct {
+		Data []*QueryPlanDescription `json:"data"`
+	}{}
+	if !assert.Nil(t, json.NewDecoder(responseRecorder.Body).Decode(&response)) {
+		return
+	}
+	if !assert.Len(t, response.Data, 1) || !assert.Len(t, response.Data[0].Steps, 1) {
+		return
+	}
+
+	// the posts come from the first service
+	root := response.Data[0].Steps[0]
+	assert.Equal(t, "posts", root.URL)
+	assert.Equal(t, "Query", root.ParentType)
+	if !assert.Len(t, root.Then, 1) {
+		return
+	}
+
+	// and the ratings are looked up from the other one
+	reviews := root.Then[0]
+	assert.Equal(t, "reviews", reviews.URL)
+	assert.Equal(t, "Post", reviews.ParentType)
+	assert.Equal(t, []string{"posts"}, reviews.InsertionPoint)
+	assert.Equal(t, []string{}, reviews.Variables)
+	assert.Contains(t, reviews.Query, "rating")
+}
+
+func TestGraphQLHandler_queryPlanExtension(t *testing.T) {
+	testCases := []struct {
+		Message  string
+		Options  []Option
+		Body     string
+		Included bool
+	}{
+		{
+			"included when asked for",
+			[]Option{WithQueryPlanExtension()},
+			`{"query": "{ posts { title rating } }", "extensions": {"queryPlan": true}}`,
+			true,
+		},
+		{
+			"left out by default",
+			[]Option{WithQueryPlanExtension()},
+			`{"query": "{ posts { title rating } }"}`,
+			false,
+		},
+		{
+			"left out if the gateway doesn't allow it",
+			[]Option{},
+			`{"query": "{ posts { title rating } }", "extensions": {"queryPlan": true}}`,
+			false,
+		},
+	}
+
+	for _, row := range testCases {
+		t.Run(row.Message, func(t *testing.T) {
+			gateway := inspectTestGateway(t, row.Options...)
+
+			request := httptest.NewRequest("POST", "/graphql", strings.NewReader(row.Body))
+			responseRecorder := httptest.NewRecorder()
+
+			gateway.GraphQLHandler(responseRecorder, request)
+			assert.Equal(t, http.StatusOK, responseRecorder.Result().StatusCode)
+
+			response := struct {
+				Data       map[string]interface{} `json:"data"`
+				Extensions struct {
+					QueryPlan *QueryPlanDescription `json:"queryPlan"`
+				} `json:"extensions"`
+			}{}
+			if !assert.Nil(t, json.NewDecoder(responseRecorder.Body).Decode(&response)) {
+				return
+			}
+
+			// the query is still executed
+			assert.NotNil(t, response.Data["posts"])
+
+			if !row.Included {
+				assert.Nil(t, response.Extensions.QueryPlan)
+				return
+			}
+			if assert.NotNil(t, response.Extensions.QueryPlan) && assert.Len(t, response.Extensions.QueryPlan.Steps, 1) {
+				assert.Equal(t, "posts", response.Extensions.QueryPlan.Steps[0].URL)
+			}
+		})
+	}
+}
@@ -37,7 +37,8 @@ func (g *Gateway) Query(ctx context.Context, input *graphql.QueryInput, receiver
 	result := map[string]interface{}{}
 
 	// wrap the schema in something capable of introspection
-	introspectionSchema := introspection.WrapSchema(g.schema)
+	schema, _, _ := g.currentSchema()
+	introspectionSchema := introspection.WrapSchema(schema)
 
 	// for local stuff we don't care about fragment directives
 	querySelection, err := graphql.ApplyFragments(input.QueryDocument.Operations[0].SelectionSet, input.QueryDocument.Fragments)
@@ -0,0 +1,172 @@
+package gateway
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/vektah/gqlparser/ast"
+)
+
+// QueryLimits bounds the size of the queries the gateway is willing to plan. A limit of zero is not enforced.
+type QueryLimits struct {
+	// MaxDepth is the deepest a field can be nested. Root fields have a depth of 1.
+	MaxDepth int
+	// MaxFields is the number of fields a query can select, counting fragments every time they are used
+	MaxFields int
+	// MaxCost is the estimated number of values a query can resolve. Every field costs 1 for each
+	// object it is resolved on so the fields under a list cost as much as the list is long.
+	MaxCost int
+
+	// ListFactor is the assumed length of a list field without a size argument. Defaults to 10.
+	ListFactor int
+	// ListSizeArguments are the arguments that set the length of a list field when they are
+	// passed as a literal. Defaults to first, last, and limit.
+	ListSizeArguments []string
+}
+
+// QueryStats holds the measurements of a query that are checked against QueryLimits
+type QueryStats struct {
+	Depth  int
+	Fields int
+	Cost   int
+}
+
+// PlannerWithQueryLimits is an interface for planners that can check queries against QueryLimits
+type PlannerWithQueryLimits interface {
+	WithQueryLimits(*QueryLimits) QueryPlanner
+}
+
+// WithQueryLimits returns an Option that rejects queries that are deeper, wider, or more expensive
+// than the given limits before they are planned
+func WithQueryLimits(limits QueryLimits) Option {
+	return func(g *Gateway) {
+		g.queryLimits = &limits
+	}
+}
+
+// Validate returns an error if any operation in the document exceeds the limits
+func (l *QueryLimits) Validate(document *ast.QueryDocument) error {
+	for _, operation := range document.Operations {
+		stats := l.Measure(document, operation)
+
+		if l.MaxDepth > 0 && stats.Depth > l.MaxDepth {
+			return fmt.Errorf("query has a depth of %d which exceeds the maximum of %d", stats.Depth, l.MaxDepth)
+		}
+		if l.MaxFields > 0 && stats.Fields > l.MaxFields {
+			return fmt.Errorf("query selects %d fields which exceeds the maximum of %d", stats.Fields, l.MaxFields)
+		}
+		if l.MaxCost > 0 && stats.Cost > l.MaxCost {
+			return fmt.Errorf("query has an estimated cost of %d which exceeds the maximum of %d", stats.Cost, l.MaxCost)
+		}
+	}
+
+	return nil
+}
+
+// Measure computes the depth, field count, and cost of an operation in the document
+func (l *QueryLimits) Measure(document *ast.QueryDocument, operation *ast.OperationDefinition) QueryStats {
+	stats := QueryStats{}
+	l.measureSelectionSet(document, operation.SelectionSet, 1, 1, &stats, map[string]*QueryStats{})
+
+	return stats
+}
+
+// measureSelectionSet adds the measurements of the selection set to the stats. Fragments are measured once
+// and saved in the given map since a query can spread the same fragment an exponential number of times.
+func (l *QueryLimits) measureSelectionSet(document *ast.QueryDocument, selectionSet ast.SelectionSet, depth int, multiplier int, stats *QueryStats, fragments map[string]*QueryStats) {
+	for _, selection := range selectionSet {
+		switch selection := selection.(type) {
+		case *ast.Field:
+			stats.Fields++
+			stats.Cost = limitsAdd(stats.Cost, multiplier)
+			if depth > stats.Depth {
+				stats.Depth = depth
+			}
+
+			// the fields under a list are resolved for every entry
+			childMultiplier := multiplier
+			if selection.Definition != nil && limitsIsList(selection.Definition.Type) {
+				childMultiplier = limitsMultiply(multiplier, l.listSize(selection))
+			}
+
+			l.measureSelectionSet(document, selection.SelectionSet, depth+1, childMultiplier, stats, fragments)
+
+		case *ast.InlineFragment:
+			l.measureSelectionSet(document, selection.SelectionSet, depth, multiplier, stats, fragments)
+
+		case *ast.FragmentSpread:
+			fragment := l.measureFragment(document, selection.Name, fragments)
+
+			// the fragment was measured as if it was spread at the root
+			stats.Fields = limitsAdd(stats.Fields, fragment.Fields)
+			stats.Cost = limitsAdd(stats.Cost, limitsMultiply(multiplier, fragment.Cost))
+			if fragment.Depth > 0 && depth-1+fragment.Depth > stats.Depth {
+				stats.Depth = depth - 1 + fragment.Depth
+			}
+		}
+	}
+}
+
+// measureFragment returns the measurements of the named fragment when it is spread at the root of an operation
+func (l *QueryLimits) measureFragment(document *ast.QueryDocument, name string, fragments map[string]*QueryStats) *QueryStats {
+	if stats, ok := fragments[name]; ok {
+		return stats
+	}
+
+	// fragments that spread themselves are rejected before we get here but they shouldn't hang us either
+	stats := &QueryStats{}
+	fragments[name] = stats
+
+	if definition := document.Fragments.ForName(name); definition != nil {
+		l.measureSelectionSet(document, definition.SelectionSet, 1, 1, stats, fragments)
+	}
+
+	return stats
+}
+
+// listSize returns the number of entries we expect a list field to have
+func (l *QueryLimits) listSize(field *ast.Field) int {
+	names := l.ListSizeArguments
+	if names == nil {
+		names = []string{"first", "last", "limit"}
+	}
+
+	// variables aren't known when the query is planned so only literals count
+	for _, name := range names {
+		argument := field.Arguments.ForName(name)
+		if argument == nil || argument.Value == nil || argument.Value.Kind != ast.IntValue {
+			continue
+		}
+
+		if size, err := strconv.Atoi(argument.Value.Raw); err == nil && size >= 0 {
+			return size
+		}
+	}
+
+	if l.ListFactor > 0 {
+		return l.ListFactor
+	}
+	return 10
+}
+
+// limitsIsList returns true if the type is a list, ignoring non-null wrappers
+func limitsIsList(fieldType *ast.Type) bool {
+	return fieldType.Elem != nil
+}
+
+// limitsAdd adds two counts without overflowing
+func limitsAdd(a int, b int) int {
+	if a > math.MaxInt32-b {
+		return math.MaxInt32
+	}
+	return a + b
+}
+
+// limitsMultiply multiplies two counts without overflowing
+func limitsMultiply(a int, b int) int {
+	if b != 0 && a > math.MaxInt32/b {
+		return math.MaxInt32
+	}
+	return a * b
+}
@@ -0,0 +1,158 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/nautilus/graphql"
+	"github.com/stretchr/testify/assert"
+	"github.com/vektah/gqlparser"
+)
+
+var limitsTestSchema = `
+	type Query {
+		post: Post
+		posts(first: Int): [Post!]!
+	}
+
+	type Post {
+		id: ID!
+		title: String!
+		comments(first: Int): [Comment]
+	}
+
+	type Comment {
+		body: String!
+		post: Post
+	}
+`
+
+func TestQueryLimits_measure(t *testing.T) {
+	schema, _ := graphql.LoadSchema(limitsTestSchema)
+
+	testCases := []struct {
+		Message string
+		Query   string
+		Stats   QueryStats
+	}{
+		{
+			"single field",
+			"{ post { title } }",
+			QueryStats{Depth: 2, Fields: 2, Cost: 2},
+		},
+		{
+			"lists use the list factor",
+			"{ posts { title } }",
+			QueryStats{Depth: 2, Fields: 2, Cost: 1 + 10},
+		},
+		{
+			"lists use their size argument",
+			"{ posts(first: 2) { title comments(first: 3) { body } } }",
+			QueryStats{Depth: 3, Fields: 4, Cost: 1 + 2 + 2 + 2*3},
+		},
+		{
+			"fragments count every time they are used",
+			`
+				{ post { ...PostInfo comments(first: 1) { post { ...PostInfo } } } }
+				fragment PostInfo on Post { id title }
+			`,
+			QueryStats{Depth: 4, Fields: 7, Cost: 7},
+		},
+		{
+			"inline fragments don't add depth",
+			"{ post { ... on Post { title } } }",
+			QueryStats{Depth: 2, Fields: 2, Cost: 2},
+		},
+	}
+
+	for _, row := range testCases {
+		t.Run(row.Message, func(t *testing.T) {
+			document, err := gqlparser.LoadQuery(schema, row.Query)
+			if !assert.Nil(t, err) {
+				return
+			}
+
+			limits := &QueryLimits{}
+			assert.Equal(t, row.Stats, limits.Measure(document, document.Operations[0]))
+		})
+	}
+}
+
+func TestQueryLimits_measureFragmentsOnce(t *testing.T) {
+	schema, _ := graphql.LoadSchema(limitsTestSchema)
+
+	// every fragment spreads the next one twice so measuring each spread would take forever
+	query := "{ post { ...F0 } }\n"
+	for i := 0; i < 60; i++ {
+		query += fmt.Sprintf("fragment F%d on Post { id comments(first: 1) { post { ...F%d } } ...F%d }\n", i, i+1, i+1)
+	}
+	query += "fragment F60 on Post { title }"
+
+	document, err := gqlparser.LoadQuery(schema, query)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	stats := (&QueryLimits{}).Measure(document, document.Operations[0])
+	assert.Equal(t, 2+2*60, stats.Depth)
+	assert.Equal(t, math.MaxInt32, stats.Fields)
+	assert.Equal(t, math.MaxInt32, stats.Cost)
+}
+
+func TestQueryLimits_validate(t *testing.T) {
+	schema, _ := graphql.LoadSchema(limitsTestSchema)
+
+	document, err := gqlparser.LoadQuery(schema, "{ posts(first: 5) { comments { post { title } } } }")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	testCases := []struct {
+		Message string
+		Limits  QueryLimits
+		Valid   bool
+	}{
+		{"no limits", QueryLimits{}, true},
+		{"within limits", QueryLimits{MaxDepth: 4, MaxFields: 4, MaxCost: 1 + 5 + 50 + 50}, true},
+		{"too deep", QueryLimits{MaxDepth: 3}, false},
+		{"too many fields", QueryLimits{MaxFields: 3}, false},
+		{"too expensive", QueryLimits{MaxCost: 100}, false},
+		{"smaller list factor", QueryLimits{MaxCost: 100, ListFactor: 2}, true},
+	}
+
+	for _, row := range testCases {
+		t.Run(row.Message, func(t *testing.T) {
+			err := row.Limits.Validate(document)
+			assert.Equal(t, row.Valid, err == nil)
+		})
+	}
+}
+
+func TestGateway_queryLimits(t *testing.T) {
+	schema, _ := graphql.LoadSchema(limitsTestSchema)
+
+	gateway, err := New([]*graphql.RemoteSchema{{Schema: schema, URL: "posts"}},
+		WithQueryLimits(QueryLimits{MaxDepth: 2}),
+	)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// shallow queries are planned like normal
+	_, err = gateway.GetPlan(&RequestContext{
+		Context: context.Background(),
+		Query:   "{ posts { title } }",
+	})
+	assert.Nil(t, err)
+
+	// deep queries are rejected
+	_, err = gateway.GetPlan(&RequestContext{
+		Context: context.Background(),
+		Query:   "{ posts { comments { body } } }",
+	})
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "query has a depth of 3 which exceeds the maximum of 2", err.Error())
+	}
+}
@@ -0,0 +1,315 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/nautilus/graphql"
+)
+
+// LocationSelector picks the service that resolves a field when more than one service can
+// provide it and none of them is the service that resolves the field's parent. The choice is
+// fixed in the plan so it only applies to plans computed after it changes.
+type LocationSelector interface {
+	SelectLocation(parentType string, field string, locations []string) string
+}
+
+// LocationSelectorFunc wraps a function to be used as a LocationSelector
+type LocationSelectorFunc func(parentType string, field string, locations []string) string
+
+// SelectLocation calls the underlying function
+func (s LocationSelectorFunc) SelectLocation(parentType string, field string, locations []string) string {
+	return s(parentType, field, locations)
+}
+
+// LocationSelectorWithObserver is a LocationSelector that is told about every query the
+// gateway sends to a service so it can base its choice on how the services behave.
+type LocationSelectorWithObserver interface {
+	ObserveQuery(url string, duration time.Duration, err error)
+}
+
+// LocationSelectorWithListener is a LocationSelector whose choices can change over time. The
+// gateway registers a listener so that it can drop any plans computed with the old choice.
+type LocationSelectorWithListener interface {
+	OnChange(listener func())
+}
+
+// PlannerWithLocationSelector is an interface for planners with configurable location selectors
+type PlannerWithLocationSelector interface {
+	WithLocationSelector(LocationSelector) QueryPlanner
+}
+
+// WithLocationSelector returns an Option that sets the strategy used to pick between the
+// services that can resolve the same field
+func WithLocationSelector(selector LocationSelector) Option {
+	return func(g *Gateway) {
+		g.locationSelector = selector
+	}
+}
+
+// RoundRobinLocationSelector cycles through the possible locations of each field every time
+// it is planned
+type RoundRobinLocationSelector struct {
+	counters map[string]int
+	lock     sync.Mutex
+}
+
+// NewRoundRobinLocationSelector returns a RoundRobinLocationSelector
+func NewRoundRobinLocationSelector() *RoundRobinLocationSelector {
+	return &RoundRobinLocationSelector{
+		counters: map[string]int{},
+	}
+}
+
+// SelectLocation returns the next location for the field
+func (s *RoundRobinLocationSelector) SelectLocation(parentType string, field string, locations []string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := parentType + "." + field
+	location := locations[s.counters[key]%len(locations)]
+	s.counters[key]++
+
+	return location
+}
+
+// HealthCheckLocationSelector avoids services that have recently failed to respond. A
+// service is considered unhealthy when a query to it fails with anything other than a
+// graphql error and stays that way until the cooldown has passed or a query succeeds.
+// Queries that were canceled or ran out of time on the client's side don't say anything
+// about the service so they are ignored.
+type HealthCheckLocationSelector struct {
+	// Cooldown is how long a failed service is avoided for. Zero means until it is marked healthy.
+	Cooldown time.Duration
+
+	unhealthy map[string]time.Time
+	listeners []func()
+	lock      sync.Mutex
+}
+
+// NewHealthCheckLocationSelector returns a HealthCheckLocationSelector that avoids failed
+// services for the given cooldown
+func NewHealthCheckLocationSelector(cooldown time.Duration) *HealthCheckLocationSelector {
+	return &HealthCheckLocationSelector{
+		Cooldown:  cooldown,
+		unhealthy: map[string]time.Time{},
+	}
+}
+
+// SelectLocation returns the first healthy location. If none of them are healthy, the
+// first location is used.
+func (s *HealthCheckLocationSelector) SelectLocation(parentType string, field string, locations []string) string {
+	for _, location := range locations {
+		if s.Healthy(location) {
+			return location
+		}
+	}
+
+	return locations[0]
+}
+
+// Healthy returns whether the service at the url can be used
+func (s *HealthCheckLocationSelector) Healthy(url string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.healthy(url)
+}
+
+// healthy returns whether the service at the url can be used. The caller must hold the lock.
+func (s *HealthCheckLocationSelector) healthy(url string) bool {
+	failedAt, ok := s.unhealthy[url]
+	if !ok {
+		return true
+	}
+
+	return s.Cooldown > 0 && time.Since(failedAt) > s.Cooldown
+}
+
+// MarkHealthy marks the service at the url as healthy. Use this to report the result of
+// your own health checks.
+func (s *HealthCheckLocationSelector) MarkHealthy(url string) {
+	s.lock.Lock()
+	_, changed := s.unhealthy[url]
+	delete(s.unhealthy, url)
+	s.lock.Unlock()
+
+	if changed {
+		s.notify()
+	}
+}
+
+// MarkUnhealthy marks the service at the url as unhealthy. Use this to report the result of
+// your own health checks.
+func (s *HealthCheckLocationSelector) MarkUnhealthy(url string) {
+	s.lock.Lock()
+	wasHealthy := s.healthy(url)
+	s.unhealthy[url] = time.Now()
+	cooldown := s.Cooldown
+	s.lock.Unlock()
+
+	if !wasHealthy {
+		return
+	}
+
+	// the plans that avoid the service have to be thrown away once it can be used again
+	if cooldown > 0 {
+		time.AfterFunc(cooldown, func() { s.expire(url) })
+	}
+	s.notify()
+}
+
+// expire forgets the failure of the service at the url once the cooldown has passed
+func (s *HealthCheckLocationSelector) expire(url string) {
+	s.lock.Lock()
+	failedAt, ok := s.unhealthy[url]
+	if !ok {
+		// the service was marked healthy in the meantime
+		s.lock.Unlock()
+		return
+	}
+
+	// the service could have failed again since
+	if remaining := s.Cooldown - time.Since(failedAt); remaining > 0 {
+		s.lock.Unlock()
+		time.AfterFunc(remaining, func() { s.expire(url) })
+		return
+	}
+
+	delete(s.unhealthy, url)
+	s.lock.Unlock()
+
+	s.notify()
+}
+
+// ObserveQuery updates the health of the service with the result of a query
+func (s *HealthCheckLocationSelector) ObserveQuery(url string, duration time.Duration, err error) {
+	// a graphql error means the service is up and said no
+	if _, ok := err.(graphql.ErrorList); err == nil || ok {
+		s.MarkHealthy(url)
+		return
+	}
+
+	s.MarkUnhealthy(url)
+}
+
+// OnChange registers a function to call when the health of a service changes
+func (s *HealthCheckLocationSelector) OnChange(listener func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.listeners = append(s.listeners, listener)
+}
+
+func (s *HealthCheckLocationSelector) notify() {
+	s.lock.Lock()
+	listeners := s.listeners
+	s.lock.Unlock()
+
+	for _, listener := range listeners {
+		listener()
+	}
+}
+
+// LatencyLocationSelector picks the location with the lowest observed latency. Locations
+// that haven't been queried yet are picked first so that every location gets measured.
+type LatencyLocationSelector struct {
+	latencies map[string]time.Duration
+	listeners []func()
+	lock      sync.Mutex
+}
+
+// NewLatencyLocationSelector returns a LatencyLocationSelector
+func NewLatencyLocationSelector() *LatencyLocationSelector {
+	return &LatencyLocationSelector{
+		latencies: map[string]time.Duration{},
+	}
+}
+
+// SelectLocation returns the location with the lowest latency
+func (s *LatencyLocationSelector) SelectLocation(parentType string, field string, locations []string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	selected := locations[0]
+	for _, location := range locations {
+		if s.latencies[location] < s.latencies[selected] {
+			selected = location
+		}
+	}
+
+	return selected
+}
+
+// ObserveQuery records the latency of a successful query. Queries that timed out took at least
+// as long as the timeout so they count too.
+func (s *LatencyLocationSelector) ObserveQuery(url string, duration time.Duration, err error) {
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		return
+	}
+
+	s.lock.Lock()
+	// keep a moving average so a single slow query doesn't move traffic away
+	previous, measured := s.latencies[url]
+	if measured {
+		duration = (previous*4 + duration) / 5
+	}
+	s.latencies[url] = duration
+
+	// the choice only changes if the service passed another one or was measured for the first time
+	changed := !measured
+	for other, latency := range s.latencies {
+		if other != url && (latency < previous) != (latency < duration) {
+			changed = true
+		}
+	}
+	listeners := s.listeners
+	s.lock.Unlock()
+
+	if changed {
+		for _, listener := range listeners {
+			listener()
+		}
+	}
+}
+
+// OnChange registers a function to call when the fastest location could have changed
+func (s *LatencyLocationSelector) OnChange(listener func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.listeners = append(s.listeners, listener)
+}
+
+// observedQueryer reports every query it sends to the location selector
+type observedQueryer struct {
+	url      string
+	queryer  graphql.Queryer
+	observer LocationSelectorWithObserver
+}
+
+func (q *observedQueryer) Query(ctx context.Context, input *graphql.QueryInput, receiver interface{}) error {
+	start := time.Now()
+	err := q.queryer.Query(ctx, input, receiver)
+
+	// if the client gave up on the query, we didn't learn anything about the service. running out
+	// of the service's own timeout still counts against it
+	if err != nil && ctx.Err() != nil {
+		return err
+	}
+
+	q.observer.ObserveQuery(q.url, time.Since(start), err)
+	return err
+}
+
+// WithMiddlewares passes the middlewares on to the wrapped queryer
+func (q *observedQueryer) WithMiddlewares(wares []graphql.NetworkMiddleware) graphql.Queryer {
+	inner, ok := q.queryer.(graphql.QueryerWithMiddlewares)
+	if !ok {
+		return q
+	}
+
+	return &observedQueryer{url: q.url, queryer: inner.WithMiddlewares(wares), observer: q.observer}
+}
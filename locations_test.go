@@ -0,0 +1,272 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nautilus/graphql"
+	"github.com/stretchr/testify/assert"
+	"github.com/vektah/gqlparser/ast"
+)
+
+func TestPlanQuery_locationSelector(t *testing.T) {
+	schema, _ := graphql.LoadSchema(`
+		type Post {
+			id: ID!
+		}
+
+		type Query {
+			posts: [Post!]!
+		}
+	`)
+
+	// the field can be found in both services
+	locations := FieldURLMap{}
+	locations.RegisterURL("Query", "posts", "url1", "url2")
+	locations.RegisterURL("Post", "id", "url1", "url2")
+
+	planLocation := func(planner *MinQueriesPlanner) string {
+		plans, err := planner.Plan(&PlanningContext{
+			Query:     "{ posts { id } }",
+			Schema:    schema,
+			Locations: locations,
+		})
+		if !assert.Nil(t, err) {
+			return ""
+		}
+
+		return plans[0].RootStep.Then[0].URL
+	}
+
+	// without a selector we use the first location
+	assert.Equal(t, "url1", planLocation(&MinQueriesPlanner{}))
+
+	// a round robin selector cycles between the two
+	planner := &MinQueriesPlanner{}
+	planner.WithLocationSelector(NewRoundRobinLocationSelector())
+	assert.Equal(t, "url1", planLocation(planner))
+	assert.Equal(t, "url2", planLocation(planner))
+	assert.Equal(t, "url1", planLocation(planner))
+}
+
+func TestHealthCheckLocationSelector(t *testing.T) {
+	selector := NewHealthCheckLocationSelector(0)
+
+	// count the number of times the selector tells us about a change
+	changes := 0
+	selector.OnChange(func() { changes++ })
+
+	locations := []string{"url1", "url2"}
+	assert.Equal(t, "url1", selector.SelectLocation("Query", "posts", locations))
+
+	// a graphql error means the service is still up
+	selector.ObserveQuery("url1", time.Millisecond, graphql.ErrorList{errors.New("not allowed")})
+	assert.Equal(t, "url1", selector.SelectLocation("Query", "posts", locations))
+	assert.Equal(t, 0, changes)
+
+	// any other error means it's down
+	selector.ObserveQuery("url1", time.Millisecond, errors.New("connection refused"))
+	selector.ObserveQuery("url1", time.Millisecond, errors.New("connection refused"))
+	assert.Equal(t, "url2", selector.SelectLocation("Query", "posts", locations))
+	assert.Equal(t, 1, changes)
+
+	// if everything is down, fall back to the first location
+	selector.MarkUnhealthy("url2")
+	assert.Equal(t, "url1", selector.SelectLocation("Query", "posts", locations))
+	assert.Equal(t, 2, changes)
+
+	// once a service recovers we can use it again
+	selector.MarkHealthy("url1")
+	assert.Equal(t, "url1", selector.SelectLocation("Query", "posts", locations))
+	assert.Equal(t, 3, changes)
+
+	// failures are forgotten after the cooldown
+	selector.Cooldown = time.Millisecond
+	time.Sleep(2 * time.Millisecond)
+	assert.True(t, selector.Healthy("url2"))
+
+	// queries that the client gave up on don't say anything about the service
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	queryer := &observedQueryer{url: "url1", queryer: &contextQueryer{}, observer: selector}
+	err := queryer.Query(ctx, testServiceInput(ast.Query), &map[string]interface{}{})
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, selector.Healthy("url1"))
+	assert.Equal(t, 3, changes)
+}
+
+func TestGateway_locationSelectorServiceTimeout(t *testing.T) {
+	schema, _ := graphql.LoadSchema(`
+		type Query {
+			posts: [String!]!
+		}
+	`)
+
+	// the first service never responds
+	factory := QueryerFactory(func(ctx *PlanningContext, url string) graphql.Queryer {
+		if url == "url1" {
+			return &contextQueryer{}
+		}
+
+		return &graphql.MockSuccessQueryer{map[string]interface{}{"posts": []interface{}{"hello"}}}
+	})
+
+	selector := NewHealthCheckLocationSelector(time.Minute)
+	gateway, err := New([]*graphql.RemoteSchema{
+		{Schema: schema, URL: "url1"},
+		{Schema: schema, URL: "url2"},
+	},
+		WithQueryerFactory(&factory),
+		WithLocationSelector(selector),
+		WithServiceConfig("url1", ServiceConfig{Timeout: 10 * time.Millisecond}),
+	)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	ctx := &RequestContext{Context: context.Background(), Query: "{ posts }"}
+	plans, err := gateway.GetPlan(ctx)
+	if !assert.Nil(t, err) {
+		return
+	}
+	_, err = gateway.Execute(ctx, plans)
+	assert.NotNil(t, err)
+
+	// running out of the service's own timeout means the service is in trouble
+	assert.False(t, selector.Healthy("url1"))
+	assert.True(t, selector.Healthy("url2"))
+}
+
+func TestHealthCheckLocationSelector_cooldownNotifies(t *testing.T) {
+	selector := NewHealthCheckLocationSelector(10 * time.Millisecond)
+
+	changes := make(chan bool, 2)
+	selector.OnChange(func() { changes <- true })
+
+	// the service going down is a change
+	selector.MarkUnhealthy("url1")
+	<-changes
+
+	// and so is the cooldown running out
+	select {
+	case <-changes:
+		assert.True(t, selector.Healthy("url1"))
+	case <-time.After(time.Second):
+		t.Error("the selector did not say the service could be used again")
+	}
+}
+
+func TestLatencyLocationSelector(t *testing.T) {
+	selector := NewLatencyLocationSelector()
+	locations := []string{"url1", "url2"}
+
+	// locations that haven't been measured are tried first
+	selector.ObserveQuery("url1", 10*time.Millisecond, nil)
+	assert.Equal(t, "url2", selector.SelectLocation("Query", "posts", locations))
+
+	// after that, the fastest location wins
+	selector.ObserveQuery("url2", 20*time.Millisecond, nil)
+	assert.Equal(t, "url1", selector.SelectLocation("Query", "posts", locations))
+
+	// failed queries don't count
+	selector.ObserveQuery("url2", time.Millisecond, errors.New("connection refused"))
+	assert.Equal(t, "url1", selector.SelectLocation("Query", "posts", locations))
+
+	// but the ones that ran out of time do
+	selector.ObserveQuery("url1", time.Second, fmt.Errorf("sending request: %w", context.DeadlineExceeded))
+	assert.Equal(t, "url2", selector.SelectLocation("Query", "posts", locations))
+}
+
+func TestLatencyLocationSelector_onChange(t *testing.T) {
+	selector := NewLatencyLocationSelector()
+
+	changes := 0
+	selector.OnChange(func() { changes++ })
+
+	// measuring a location for the first time can change the choice
+	selector.ObserveQuery("url1", 10*time.Millisecond, nil)
+	selector.ObserveQuery("url2", 20*time.Millisecond, nil)
+	assert.Equal(t, 2, changes)
+
+	// getting slower without passing the other location doesn't
+	selector.ObserveQuery("url2", 30*time.Millisecond, nil)
+	assert.Equal(t, 2, changes)
+
+	// but passing it does
+	selector.ObserveQuery("url1", 100*time.Millisecond, nil)
+	assert.Equal(t, 3, changes)
+	assert.Equal(t, "url2", selector.SelectLocation("Query", "posts", []string{"url1", "url2"}))
+}
+
+func TestGateway_locationSelector(t *testing.T) {
+	schema, _ := graphql.LoadSchema(`
+		type Query {
+			posts: [Post]
+		}
+
+		type Post {
+			id: ID!
+			title: String!
+		}
+	`)
+
+	// the first service is down
+	factory := QueryerFactory(func(ctx *PlanningContext, url string) graphql.Queryer {
+		if url == "url1" {
+			return graphql.QueryerFunc(func(input *graphql.QueryInput) (interface{}, error) {
+				return nil, errors.New("connection refused")
+			})
+		}
+
+		return &graphql.MockSuccessQueryer{map[string]interface{}{
+			"posts": []interface{}{
+				map[string]interface{}{"title": "hello"},
+			},
+		}}
+	})
+
+	gateway, err := New([]*graphql.RemoteSchema{
+		{Schema: schema, URL: "url1"},
+		{Schema: schema, URL: "url2"},
+	},
+		WithQueryerFactory(&factory),
+		WithAutomaticQueryPlanCache(),
+		WithLocationSelector(NewHealthCheckLocationSelector(time.Minute)),
+	)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	execute := func() (map[string]interface{}, error) {
+		ctx := &RequestContext{
+			Context:  context.Background(),
+			Query:    "{ posts { title } }",
+			CacheKey: queryHash("{ posts { title } }"),
+		}
+
+		plans, err := gateway.GetPlan(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		return gateway.Execute(ctx, plans)
+	}
+
+	// the first request goes to the service that is down
+	_, err = execute()
+	assert.NotNil(t, err)
+
+	// the cached plan is thrown away and the next request goes to the other service
+	result, err := execute()
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, map[string]interface{}{
+		"posts": []interface{}{
+			map[string]interface{}{"title": "hello"},
+		},
+	}, result)
+}
@@ -2,74 +2,105 @@ package gateway
 
 import (
 	"fmt"
+	"io"
 	"strings"
 
 	"github.com/sirupsen/logrus"
 	"github.com/vektah/gqlparser/ast"
 )
 
-// Logger handles the logging in the gateway library
+// Logger handles the logging in the gateway library. A nil Logger logs to the default
+// logger which writes warnings and above to stderr.
 type Logger struct {
-	fields logrus.Fields
+	entry *logrus.Entry
 }
 
 // LoggerFields is a wrapper over a map of key,value pairs to associate with the log
 type LoggerFields map[string]interface{}
 
-// Debug should be used for any logging that would be useful for debugging
-func (l *Logger) Debug(args ...interface{}) {
-	entry := newLogEntry()
-	// if there are fields
-	if l.fields != nil {
-		entry = entry.WithFields(l.fields)
+// NewLogger returns a Logger that writes to the given logrus logger. Use this to send the
+// logs of the gateway wherever the rest of your logs go.
+func NewLogger(logger *logrus.Logger) *Logger {
+	return &Logger{entry: logrus.NewEntry(logger)}
+}
+
+// NewJSONLogger returns a Logger that writes warnings and above to out as JSON, one object per line
+func NewJSONLogger(out io.Writer) *Logger {
+	logger := logrus.New()
+	logger.SetOutput(out)
+	logger.SetLevel(logrus.WarnLevel)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+
+	return NewLogger(logger)
+}
+
+// WithLogger returns an Option that sends the logs of the gateway to the given logger
+func WithLogger(logger *Logger) Option {
+	return func(g *Gateway) {
+		g.logger = logger
+	}
+}
+
+// SetLevel changes the level of the logger while the gateway is running. The level is one of
+// debug, info, warn, or error and applies to every Logger that writes to the same place.
+func (l *Logger) SetLevel(level string) error {
+	parsed, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
 	}
 
-	// finally log
-	entry.Debug(args...)
+	l.logEntry().Logger.SetLevel(parsed)
+	return nil
 }
 
-// Info should be used for any logging that doesn't necessarily need attention but is nice to see by default
-func (l *Logger) Info(args ...interface{}) {
-	entry := newLogEntry()
-	// if there are fields
-	if l.fields != nil {
-		entry = entry.WithFields(l.fields)
+// logEntry returns the entry to log to
+func (l *Logger) logEntry() *logrus.Entry {
+	if l == nil || l.entry == nil {
+		return log.entry
 	}
 
-	// finally log
-	entry.Info(args...)
+	return l.entry
+}
+
+// Debug should be used for any logging that would be useful for debugging
+func (l *Logger) Debug(args ...interface{}) {
+	l.logEntry().Debug(args...)
+}
+
+// Info should be used for any logging that doesn't necessarily need attention but is nice to see by default
+func (l *Logger) Info(args ...interface{}) {
+	l.logEntry().Info(args...)
 }
 
 // Warn should be used for logging that needs attention
 func (l *Logger) Warn(args ...interface{}) {
-	entry := newLogEntry()
-	// if there are fields
-	if l.fields != nil {
-		entry = entry.WithFields(l.fields)
-	}
-
-	// finally log
-	entry.Warn(args...)
+	l.logEntry().Warn(args...)
 }
 
-// WithFields adds the provided fields to the Log
+// WithFields returns a Logger that adds the provided fields to every log, along with the fields
+// that were already there
 func (l *Logger) WithFields(fields LoggerFields) *Logger {
-	// build up the logrus fields
-	logrusFields := logrus.Fields{}
-	for key, value := range fields {
-		logrusFields[key] = value
-	}
-	return &Logger{fields: logrusFields}
+	return &Logger{entry: l.logEntry().WithFields(logrus.Fields(fields))}
+}
+
+// infoEnabled returns true if info logs are written
+func (l *Logger) infoEnabled() bool {
+	return l.logEntry().Logger.IsLevelEnabled(logrus.InfoLevel)
 }
 
 // QueryPlanStep formats and logs a query plan step for human consumption
 func (l *Logger) QueryPlanStep(step *QueryPlanStep) {
-	log.WithFields(LoggerFields{
+	// formatting the selection set is expensive so skip it if it won't be logged
+	if !l.infoEnabled() {
+		return
+	}
+
+	l.WithFields(LoggerFields{
 		"id":              step.ParentID,
 		"insertion point": step.InsertionPoint,
 	}).Info(step.ParentType)
 
-	log.Info(l.FormatSelectionSet(step.SelectionSet))
+	l.Info(l.FormatSelectionSet(step.SelectionSet))
 }
 
 func (l *Logger) indentPrefix(level int) string {
@@ -132,22 +163,18 @@ func (l *Logger) FormatSelectionSet(selection ast.SelectionSet) string {
 
 var log *Logger
 
-func newLogEntry() *logrus.Entry {
-	entry := logrus.New()
+func init() {
+	logger := logrus.New()
 
 	// only log the warning severity or above.
-	entry.SetLevel(logrus.WarnLevel)
+	logger.SetLevel(logrus.WarnLevel)
 
 	// configure the formatter
-	entry.SetFormatter(&logrus.TextFormatter{
+	logger.SetFormatter(&logrus.TextFormatter{
 		DisableTimestamp:       true,
 		ForceColors:            true,
 		DisableLevelTruncation: true,
 	})
 
-	return logrus.NewEntry(entry)
-}
-
-func init() {
-	log = &Logger{}
+	log = NewLogger(logger)
 }
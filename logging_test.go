@@ -0,0 +1,154 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// logLines parses the lines written by a JSON logger
+func logLines(t *testing.T, output *bytes.Buffer) []map[string]interface{} {
+	lines := []map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+		if line == "" {
+			continue
+		}
+
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line was not json: %s", line)
+		}
+		lines = append(lines, entry)
+	}
+
+	return lines
+}
+
+func TestGraphQLHandler_logger(t *testing.T) {
+	output := &bytes.Buffer{}
+	logger := NewJSONLogger(output)
+	if !assert.Nil(t, logger.SetLevel("debug")) {
+		return
+	}
+
+	gateway := inspectTestGateway(t, WithLogger(logger))
+
+	request := httptest.NewRequest("POST", "/graphql", strings.NewReader(`{"query": "query Ratings { posts { title rating } }", "operationName": "Ratings"}`))
+	request.Header.Set("X-Request-ID", "my-request")
+	responseRecorder := httptest.NewRecorder()
+
+	gateway.GraphQLHandler(responseRecorder, request)
+	assert.Equal(t, http.StatusOK, responseRecorder.Result().StatusCode)
+
+	lines := logLines(t, output)
+	if !assert.NotEmpty(t, lines) {
+		return
+	}
+
+	// every step logs with the fields of the request and an id of its own
+	stepIDs := map[string]interface{}{}
+	for _, line := range lines {
+		if line["stepId"] == nil {
+			continue
+		}
+
+		assert.Equal(t, "my-request", line["requestId"])
+		assert.Equal(t, "Ratings", line["operationName"])
+		stepIDs[line["service"].(string)] = line["stepId"]
+	}
+	if assert.Len(t, stepIDs, 2) {
+		assert.NotEqual(t, stepIDs["posts"], stepIDs["reviews"])
+	}
+
+	// looking for insertion points is part of the request too
+	found := false
+	for _, line := range lines {
+		if strings.HasPrefix(line["msg"].(string), "Looking for insertion points.") {
+			found = true
+			assert.Equal(t, "my-request", line["requestId"])
+		}
+	}
+	assert.True(t, found)
+}
+
+func TestPlanningContext_logger(t *testing.T) {
+	gateway := &Gateway{logger: NewJSONLogger(&bytes.Buffer{})}
+	requestLogger := gateway.logger.WithFields(LoggerFields{"requestId": "my-request"})
+
+	// planning logs with the fields of the request
+	assert.Equal(t, requestLogger, (&PlanningContext{Gateway: gateway, Logger: requestLogger}).logger())
+
+	// unless it doesn't have any
+	assert.Equal(t, gateway.logger, (&PlanningContext{Gateway: gateway}).logger())
+}
+
+func TestGateway_planningLogsWithRequestFields(t *testing.T) {
+	output := &bytes.Buffer{}
+	gateway := inspectTestGateway(t, WithLogger(NewJSONLogger(output)))
+	if !assert.Nil(t, gateway.logger.SetLevel("debug")) {
+		return
+	}
+	output.Reset()
+
+	_, err := gateway.GetPlan(&RequestContext{
+		Context: context.Background(),
+		Query:   "{ posts { title rating } }",
+		Logger:  gateway.logger.WithFields(LoggerFields{"requestId": "my-request"}),
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// the planner logs with the fields of the request
+	found := false
+	for _, line := range logLines(t, output) {
+		if line["msg"] == "--- Extracting Selection ---" {
+			found = true
+			assert.Equal(t, "my-request", line["requestId"])
+		}
+	}
+	assert.True(t, found)
+}
+
+func TestLogger_setLevel(t *testing.T) {
+	output := &bytes.Buffer{}
+	logger := NewJSONLogger(output)
+
+	// warnings are logged by default
+	logger.Info("hidden")
+	logger.WithFields(LoggerFields{"hello": "world"}).Warn("shown")
+
+	lines := logLines(t, output)
+	if assert.Len(t, lines, 1) {
+		assert.Equal(t, "shown", lines[0]["msg"])
+		assert.Equal(t, "world", lines[0]["hello"])
+	}
+
+	// changing the level applies to the loggers that were already made
+	child := logger.WithFields(LoggerFields{"hello": "world"})
+	if !assert.Nil(t, logger.SetLevel("error")) {
+		return
+	}
+	output.Reset()
+	child.Warn("hidden")
+	assert.Equal(t, "", output.String())
+
+	// unknown levels are rejected
+	assert.NotNil(t, logger.SetLevel("loud"))
+}
+
+func TestLogger_nil(t *testing.T) {
+	// loggers that weren't configured fall back to the default
+	var logger *Logger
+
+	assert.NotPanics(t, func() {
+		logger.Debug("hello")
+		logger.WithFields(LoggerFields{"hello": "world"}).Debug("hello")
+	})
+}
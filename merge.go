@@ -3,6 +3,7 @@ package gateway
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/vektah/gqlparser/ast"
@@ -58,6 +59,14 @@ func mergeSchemas(sources []*ast.Schema) (*ast.Schema, error) {
 		}
 	}
 
+	// the service that owns a type has to be merged first so that the types extending it
+	// can't decide what its fields and interfaces are
+	for _, definitions := range types {
+		sort.SliceStable(definitions, func(i, j int) bool {
+			return !federationExtendsType(definitions[i]) && federationExtendsType(definitions[j])
+		})
+	}
+
 	// merge each interface into one
 	for name, definitions := range interfaces {
 		for _, definition := range definitions {
@@ -183,10 +192,52 @@ func mergeSchemas(sources []*ast.Schema) (*ast.Schema, error) {
 	result.Mutation = mutationType
 	result.Subscription = subscriptionType
 
+	// the types and fields services use to talk to the gateway aren't part of the schema we serve
+	mergeStripFederation(result)
+
 	// we're done here
 	return result, nil
 }
 
+// mergeStripFederation removes the types, fields, and directives of the federation spec from the schema
+func mergeStripFederation(schema *ast.Schema) {
+	for _, name := range []string{"_Any", "_Entity", "_Service", "_FieldSet"} {
+		delete(schema.Types, name)
+		delete(schema.PossibleTypes, name)
+	}
+
+	for name := range schema.Directives {
+		if federationDirective(name) {
+			delete(schema.Directives, name)
+		}
+	}
+
+	if schema.Query == nil {
+		return
+	}
+
+	fields := ast.FieldList{}
+	for _, field := range schema.Query.Fields {
+		if field.Name != federationEntitiesField && field.Name != "_service" {
+			fields = append(fields, field)
+		}
+	}
+	if len(fields) == len(schema.Query.Fields) {
+		return
+	}
+
+	// the definition belongs to one of the sources so we have to change a copy
+	query := *schema.Query
+	query.Fields = fields
+	for i, possibleType := range schema.PossibleTypes[query.Name] {
+		if possibleType == schema.Query {
+			schema.PossibleTypes[query.Name][i] = &query
+		}
+	}
+	schema.Types[query.Name] = &query
+	schema.Query = &query
+}
+
 func mergeInterfaces(schema *ast.Schema, previousDefinition *ast.Definition, newDefinition *ast.Definition) error {
 	// fields
 	if len(previousDefinition.Fields) != len(newDefinition.Fields) {
@@ -210,9 +261,24 @@ func mergeObjectTypes(schema *ast.Schema, previousDefinition *ast.Definition, ne
 
 	// we have to add the fields in the source definition with the one in the aggregate
 	for _, newField := range newDefinition.Fields {
+		// fields marked @external are resolved by another service
+		if federationExternalField(newField) {
+			continue
+		}
+
 		// look up if we already know about this field
 		field := previousFields.ForName(newField.Name)
 
+		// if we only know about the field from a service that doesn't resolve it, use the real one
+		if field != nil && federationExternalField(field) {
+			for i, previousField := range previousFields {
+				if previousField == field {
+					previousFields[i] = newField
+				}
+			}
+			continue
+		}
+
 		// if we already know about the field
 		if field != nil {
 			// and they aren't equal
@@ -227,9 +293,12 @@ func mergeObjectTypes(schema *ast.Schema, previousDefinition *ast.Definition, ne
 
 	}
 
-	// make sure the 2 implement the same number of interfaces
-	if err := mergeStringSliceEquivalent(previousDefinition.Interfaces, newDefinition.Interfaces); err != nil {
-		return fmt.Errorf("object type does not implement a consistent set of interfaces. %s", err.Error())
+	// make sure the 2 implement the same number of interfaces. types that extend another service's
+	// type only have to mention the fields they add
+	if !federationExtendsType(previousDefinition) && !federationExtendsType(newDefinition) {
+		if err := mergeStringSliceEquivalent(previousDefinition.Interfaces, newDefinition.Interfaces); err != nil {
+			return fmt.Errorf("object type does not implement a consistent set of interfaces. %s", err.Error())
+		}
 	}
 
 	// make sure that the 2 directive lists are the same
@@ -408,6 +477,10 @@ func mergeFieldsEqual(field1, field2 *ast.FieldDefinition) error {
 }
 
 func mergeDirectiveListsEqual(list1, list2 ast.DirectiveList) error {
+	// the federation directives are allowed to differ between services
+	list1 = federationStripDirectives(list1)
+	list2 = federationStripDirectives(list2)
+
 	// if the 2 lists are not the same length
 	if len(list1) != len(list2) {
 		// they will never be the same
@@ -0,0 +1,362 @@
+package gateway
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the buckets (in seconds) of the latency histograms
+var metricsLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// the buckets of the histograms that count the parts of a plan
+var metricsCountBuckets = []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000}
+
+// clients pick the names of their operations so only this many of them get their own series
+const metricsMaxOperationNames = 100
+
+// the operation name reported for operations that weren't planned or don't get their own series
+const metricsOtherOperations = "other"
+
+// Metrics collects counters and histograms about the requests a gateway handles and
+// renders them in the Prometheus text format. All of the methods are safe to call on
+// a nil Metrics so gateways without metrics don't have to check.
+type Metrics struct {
+	requests         *metricsCounter
+	planningDuration *metricsHistogram
+	serviceDuration  *metricsHistogram
+	serviceErrors    *metricsCounter
+	planSteps        *metricsHistogram
+	planInsertions   *metricsHistogram
+
+	// the operation names that have their own series
+	operationNames     map[string]bool
+	operationNamesLock sync.Mutex
+
+	// the cache is asked for its counters when the metrics are collected
+	cache QueryPlanCache
+}
+
+// QueryPlanCacheWithStats is a QueryPlanCache that keeps track of how often it is used. The
+// counters are reported by the metrics endpoint.
+type QueryPlanCacheWithStats interface {
+	Stats() QueryPlanCacheStats
+}
+
+// NewMetrics returns an empty set of metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests: newMetricsCounter(
+			"nautilus_gateway_requests_total",
+			"The number of operations handled by the gateway.",
+			"operation_name", "status",
+		),
+		planningDuration: newMetricsHistogram(
+			"nautilus_gateway_planning_duration_seconds",
+			"How long it took to retrieve the plan for an operation.",
+			metricsLatencyBuckets,
+		),
+		serviceDuration: newMetricsHistogram(
+			"nautilus_gateway_service_request_duration_seconds",
+			"How long the requests sent to the services took.",
+			metricsLatencyBuckets,
+			"service",
+		),
+		serviceErrors: newMetricsCounter(
+			"nautilus_gateway_service_errors_total",
+			"The number of requests sent to the services that failed.",
+			"service",
+		),
+		planSteps: newMetricsHistogram(
+			"nautilus_gateway_plan_steps",
+			"The number of steps in each executed plan.",
+			metricsCountBuckets,
+		),
+		planInsertions: newMetricsHistogram(
+			"nautilus_gateway_plan_insertion_points",
+			"The number of insertion points each executed plan resolved.",
+			metricsCountBuckets,
+		),
+		operationNames: map[string]bool{},
+	}
+}
+
+// WithMetrics returns an Option that collects metrics about the requests the gateway handles.
+// They are served by Gateway.MetricsHandler.
+func WithMetrics() Option {
+	return func(g *Gateway) {
+		g.metrics = NewMetrics()
+	}
+}
+
+// MetricsHandler serves the metrics of the gateway in the Prometheus text format. Mount it
+// at /metrics to have Prometheus scrape the gateway.
+func (g *Gateway) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	g.metrics.WritePrometheus(w)
+}
+
+// WritePrometheus writes the metrics in the Prometheus text format
+func (m *Metrics) WritePrometheus(w io.Writer) {
+	if m == nil {
+		return
+	}
+
+	b := &strings.Builder{}
+
+	m.requests.write(b)
+	m.planningDuration.write(b)
+
+	// the cache counters are owned by the cache
+	if cache, ok := m.cache.(QueryPlanCacheWithStats); ok {
+		stats := cache.Stats()
+
+		cacheRequests := newMetricsCounter(
+			"nautilus_gateway_query_plan_cache_requests_total",
+			"The number of plans looked up in the query plan cache.",
+			"result",
+		)
+		cacheRequests.add(float64(stats.Hits), "hit")
+		cacheRequests.add(float64(stats.Misses), "miss")
+		cacheRequests.write(b)
+	}
+
+	m.serviceDuration.write(b)
+	m.serviceErrors.write(b)
+	m.planSteps.write(b)
+	m.planInsertions.write(b)
+
+	io.WriteString(w, b.String())
+}
+
+// observeRequest counts an operation handled by the gateway. The plan is nil if the operation wasn't planned.
+func (m *Metrics) observeRequest(plan *QueryPlan, err error) {
+	if m == nil {
+		return
+	}
+
+	status := "success"
+	if err != nil {
+		status = "error"
+	}
+	m.requests.add(1, m.operationName(plan), status)
+}
+
+// operationName returns the name to report for the operation of the plan. Only the name of an operation
+// that was planned is trusted and once there are enough names, the rest are grouped together.
+func (m *Metrics) operationName(plan *QueryPlan) string {
+	if plan == nil || plan.Operation == nil {
+		return metricsOtherOperations
+	}
+	name := plan.Operation.Name
+
+	m.operationNamesLock.Lock()
+	defer m.operationNamesLock.Unlock()
+
+	if !m.operationNames[name] {
+		if len(m.operationNames) >= metricsMaxOperationNames {
+			return metricsOtherOperations
+		}
+		m.operationNames[name] = true
+	}
+
+	return name
+}
+
+// observePlanning records how long it took to retrieve a plan
+func (m *Metrics) observePlanning(duration time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.planningDuration.observe(duration.Seconds())
+}
+
+// observeServiceRequest records a request sent to a service
+func (m *Metrics) observeServiceRequest(url string, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+
+	m.serviceDuration.observe(duration.Seconds(), url)
+	if err != nil {
+		m.serviceErrors.add(1, url)
+	}
+}
+
+// observePlan records the size of an executed plan
+func (m *Metrics) observePlan(plan *QueryPlan, insertionPoints int) {
+	if m == nil {
+		return
+	}
+
+	m.planSteps.observe(float64(queryPlanStepCount(plan.RootStep.Then)))
+	m.planInsertions.observe(float64(insertionPoints))
+}
+
+// queryPlanStepCount returns the number of steps in the list and the steps that depend on them
+func queryPlanStepCount(steps []*QueryPlanStep) int {
+	count := len(steps)
+	for _, step := range steps {
+		count += queryPlanStepCount(step.Then)
+	}
+	return count
+}
+
+// metricsCounter is a counter with a value for every combination of its labels
+type metricsCounter struct {
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+	lock   sync.Mutex
+}
+
+func newMetricsCounter(name string, help string, labels ...string) *metricsCounter {
+	return &metricsCounter{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (c *metricsCounter) add(value float64, labelValues ...string) {
+	key := metricsLabels(c.labels, labelValues)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.values[key] += value
+}
+
+func (c *metricsCounter) write(b *strings.Builder) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range metricsSortedKeys(c.values) {
+		fmt.Fprintf(b, "%s%s %s\n", c.name, key, metricsFormatValue(c.values[key]))
+	}
+}
+
+// metricsHistogram is a histogram with a set of buckets for every combination of its labels
+type metricsHistogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	series  map[string]*metricsHistogramSeries
+	lock    sync.Mutex
+}
+
+type metricsHistogramSeries struct {
+	labelValues []string
+	// counts[i] is the number of observations that fell in bucket i (not cumulative)
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newMetricsHistogram(name string, help string, buckets []float64, labels ...string) *metricsHistogram {
+	return &metricsHistogram{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  map[string]*metricsHistogramSeries{},
+	}
+}
+
+func (h *metricsHistogram) observe(value float64, labelValues ...string) {
+	key := metricsLabels(h.labels, labelValues)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	series, ok := h.series[key]
+	if !ok {
+		series = &metricsHistogramSeries{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+	}
+
+	// the observation goes in the first bucket it fits under
+	for i, bound := range h.buckets {
+		if value <= bound {
+			series.counts[i]++
+			break
+		}
+	}
+	series.count++
+	series.sum += value
+}
+
+func (h *metricsHistogram) write(b *strings.Builder) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	keys := []string{}
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		series := h.series[key]
+
+		// the buckets are cumulative and have an extra label for their upper bound
+		bucketLabels := append(append([]string{}, h.labels...), "le")
+		cumulative := uint64(0)
+		for i, bound := range h.buckets {
+			cumulative += series.counts[i]
+			labels := metricsLabels(bucketLabels, append(append([]string{}, series.labelValues...), metricsFormatValue(bound)))
+			fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, labels, cumulative)
+		}
+		labels := metricsLabels(bucketLabels, append(append([]string{}, series.labelValues...), "+Inf"))
+		fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, labels, series.count)
+
+		fmt.Fprintf(b, "%s_sum%s %s\n", h.name, key, metricsFormatValue(series.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", h.name, key, series.count)
+	}
+}
+
+// metricsLabels renders the labels of a series, for example {service="http://localhost:3000"}
+func metricsLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := []string{}
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, metricsLabelEscaper.Replace(value)))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// metricsLabelEscaper escapes the characters that the Prometheus text format doesn't allow in a label value
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func metricsFormatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func metricsSortedKeys(values map[string]float64) []string {
+	keys := []string{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,176 @@
+package gateway
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nautilus/graphql"
+	"github.com/stretchr/testify/assert"
+	"github.com/vektah/gqlparser/ast"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	// the reviews service is down
+	factory := QueryerFactory(func(ctx *PlanningContext, url string) graphql.Queryer {
+		if url == "reviews" {
+			return graphql.QueryerFunc(func(input *graphql.QueryInput) (interface{}, error) {
+				return nil, errors.New("connection refused")
+			})
+		}
+
+		return &graphql.MockSuccessQueryer{map[string]interface{}{
+			"posts": []interface{}{
+				map[string]interface{}{"id": "1", "title": "hello"},
+				map[string]interface{}{"id": "2", "title": "world"},
+			},
+		}}
+	})
+
+	gateway := inspectTestGateway(t, WithQueryerFactory(&factory), WithAutomaticQueryPlanCache(), WithMetrics())
+
+	// the second request only sends the hash of the first so its plan comes from the cache
+	hash := sha256.Sum256([]byte("query Posts { posts { title } }"))
+	for _, body := range []string{
+		`{"query": "query Posts { posts { title } }", "operationName": "Posts"}`,
+		`{"operationName": "Posts", "extensions": {"persistedQuery": {"version": 1, "sha256Hash": "` + hex.EncodeToString(hash[:]) + `"}}}`,
+		`{"query": "query Ratings { posts { title rating } }", "operationName": "Ratings"}`,
+	} {
+		request := httptest.NewRequest("POST", "/graphql", strings.NewReader(body))
+		gateway.GraphQLHandler(httptest.NewRecorder(), request)
+	}
+
+	request := httptest.NewRequest("GET", "/metrics", nil)
+	responseRecorder := httptest.NewRecorder()
+	gateway.MetricsHandler(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Result().StatusCode)
+	assert.Contains(t, responseRecorder.Result().Header.Get("Content-Type"), "text/plain")
+
+	lines := strings.Split(responseRecorder.Body.String(), "\n")
+	for _, expected := range []string{
+		`# TYPE nautilus_gateway_requests_total counter`,
+		`nautilus_gateway_requests_total{operation_name="Posts",status="success"} 2`,
+		`nautilus_gateway_requests_total{operation_name="Ratings",status="error"} 1`,
+		`# TYPE nautilus_gateway_planning_duration_seconds histogram`,
+		`nautilus_gateway_planning_duration_seconds_count 3`,
+		`nautilus_gateway_query_plan_cache_requests_total{result="hit"} 1`,
+		`nautilus_gateway_query_plan_cache_requests_total{result="miss"} 2`,
+		`nautilus_gateway_service_request_duration_seconds_count{service="posts"} 3`,
+		`nautilus_gateway_service_request_duration_seconds_count{service="reviews"} 2`,
+		`nautilus_gateway_service_errors_total{service="reviews"} 2`,
+		`nautilus_gateway_plan_steps_bucket{le="1"} 2`,
+		`nautilus_gateway_plan_steps_bucket{le="2"} 3`,
+		`nautilus_gateway_plan_steps_sum 4`,
+		`nautilus_gateway_plan_insertion_points_sum 5`,
+	} {
+		assert.Contains(t, lines, expected)
+	}
+}
+
+func TestMetricsHandler_queryPlanCaches(t *testing.T) {
+	query := "query Posts { posts { title } }"
+
+	testCases := []struct {
+		Message string
+		Option  Option
+		Hits    int
+		Misses  int
+	}{
+		{"no cache", WithNoQueryPlanCache(), 0, 2},
+		{"static cache", WithStaticQueryPlanCache(map[string]string{queryHash(query): query}), 1, 1},
+	}
+
+	for _, row := range testCases {
+		t.Run(row.Message, func(t *testing.T) {
+			gateway := inspectTestGateway(t, row.Option, WithMetrics())
+
+			// one request sends the hash of the query and the other sends the query itself
+			for _, body := range []string{
+				`{"operationName": "Posts", "extensions": {"persistedQuery": {"version": 1, "sha256Hash": "` + queryHash(query) + `"}}}`,
+				`{"query": "` + query + `", "operationName": "Posts"}`,
+			} {
+				request := httptest.NewRequest("POST", "/graphql", strings.NewReader(body))
+				gateway.GraphQLHandler(httptest.NewRecorder(), request)
+			}
+
+			responseRecorder := httptest.NewRecorder()
+			gateway.MetricsHandler(responseRecorder, httptest.NewRequest("GET", "/metrics", nil))
+
+			lines := strings.Split(responseRecorder.Body.String(), "\n")
+			assert.Contains(t, lines, fmt.Sprintf(`nautilus_gateway_query_plan_cache_requests_total{result="hit"} %d`, row.Hits))
+			assert.Contains(t, lines, fmt.Sprintf(`nautilus_gateway_query_plan_cache_requests_total{result="miss"} %d`, row.Misses))
+		})
+	}
+}
+
+func TestMetrics_histogram(t *testing.T) {
+	histogram := newMetricsHistogram("test_seconds", "A test.", []float64{0.1, 1}, "service")
+	histogram.observe(0.05, "a")
+	histogram.observe(0.5, "a")
+	histogram.observe(5, "a")
+	histogram.observe(0.5, "b\"c")
+
+	b := &strings.Builder{}
+	histogram.write(b)
+
+	assert.Equal(t, strings.Join([]string{
+		`# HELP test_seconds A test.`,
+		`# TYPE test_seconds histogram`,
+		`test_seconds_bucket{service="a",le="0.1"} 1`,
+		`test_seconds_bucket{service="a",le="1"} 2`,
+		`test_seconds_bucket{service="a",le="+Inf"} 3`,
+		`test_seconds_sum{service="a"} 5.55`,
+		`test_seconds_count{service="a"} 3`,
+		`test_seconds_bucket{service="b\"c",le="0.1"} 0`,
+		`test_seconds_bucket{service="b\"c",le="1"} 1`,
+		`test_seconds_bucket{service="b\"c",le="+Inf"} 1`,
+		`test_seconds_sum{service="b\"c"} 0.5`,
+		`test_seconds_count{service="b\"c"} 1`,
+		``,
+	}, "\n"), b.String())
+}
+
+func TestMetrics_operationNames(t *testing.T) {
+	metrics := NewMetrics()
+
+	// operations that weren't planned don't get to pick their name
+	metrics.observeRequest(nil, errors.New("no query"))
+
+	// and once there are enough names, the rest are grouped together
+	for i := 0; i < metricsMaxOperationNames+5; i++ {
+		metrics.observeRequest(&QueryPlan{Operation: &ast.OperationDefinition{Name: fmt.Sprintf("Operation%d", i)}}, nil)
+	}
+
+	b := &strings.Builder{}
+	metrics.requests.write(b)
+	lines := strings.Split(b.String(), "\n")
+
+	assert.Contains(t, lines, `nautilus_gateway_requests_total{operation_name="other",status="error"} 1`)
+	assert.Contains(t, lines, `nautilus_gateway_requests_total{operation_name="other",status="success"} 5`)
+	assert.Contains(t, lines, `nautilus_gateway_requests_total{operation_name="Operation0",status="success"} 1`)
+	assert.NotContains(t, lines, fmt.Sprintf(`nautilus_gateway_requests_total{operation_name="Operation%d",status="success"} 1`, metricsMaxOperationNames))
+}
+
+func TestMetricsLabels_escaping(t *testing.T) {
+	// prometheus only escapes backslashes, quotes, and new lines. everything else is left as is
+	assert.Equal(t, `{service="a\\b\"c\nd`+"\t"+`é"}`, metricsLabels([]string{"service"}, []string{"a\\b\"c\nd\té"}))
+}
+
+func TestMetrics_disabled(t *testing.T) {
+	gateway := inspectTestGateway(t)
+
+	request := httptest.NewRequest("POST", "/graphql", strings.NewReader(`{"query": "{ posts { title } }"}`))
+	gateway.GraphQLHandler(httptest.NewRecorder(), request)
+
+	responseRecorder := httptest.NewRecorder()
+	gateway.MetricsHandler(responseRecorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Result().StatusCode)
+	assert.Equal(t, "", responseRecorder.Body.String())
+}
@@ -44,8 +44,9 @@ func scrubInsertionIDs(ctx *ExecutionContext, response map[string]interface{}) e
 	// there are many fields to scrub
 	for field, locations := range ctx.Plan.FieldsToScrub {
 		for _, location := range locations {
-			// look for the insertion points in the response for the field
-			insertionPoints, err := executorFindInsertionPoints(&lock, location, ctx.Plan.Operation.SelectionSet, response, [][]string{[]string{}}, ctx.Plan.FragmentDefinitions)
+			// look for the insertion points in the response for the field. the field is the key of the
+			// objects it was added to so it's there to find them with
+			insertionPoints, err := executorFindInsertionPointsByKey(ctx.Logger, &lock, location, ctx.Plan.Operation.SelectionSet, response, [][]string{[]string{}}, ctx.Plan.FragmentDefinitions, field)
 			if err != nil {
 				return err
 			}
@@ -53,7 +54,7 @@ func scrubInsertionIDs(ctx *ExecutionContext, response map[string]interface{}) e
 			// each insertion point needs to be cleaned up
 			for _, point := range insertionPoints {
 				// extract the obj at that point
-				value, err := executorExtractValue(response, &lock, point)
+				value, err := executorExtractValue(ctx.Logger, response, &lock, point)
 				if err != nil {
 					return err
 				}
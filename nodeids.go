@@ -0,0 +1,320 @@
+package gateway
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/vektah/gqlparser/ast"
+
+	"github.com/nautilus/graphql"
+)
+
+// NodeIDCodec turns the ids that services give their nodes into ids that are unique across every
+// service behind the gateway, and back again.
+type NodeIDCodec interface {
+	// Encode returns the id that the gateway hands out for the node the service knows by id
+	Encode(service string, id string) string
+	// Decode returns the service that gave out the id and the id that the service knows the node by
+	Decode(id string) (service string, serviceID string, err error)
+}
+
+// ErrInvalidNodeID is returned for ids that were not made by the gateway's NodeIDCodec
+var ErrInvalidNodeID = errors.New("invalid node id")
+
+// Base64NodeIDCodec encodes the url of the service and its id for the node in base64. Anyone holding
+// one of these ids can read the url of the service so use a codec of your own if that's a problem.
+type Base64NodeIDCodec struct{}
+
+// Encode returns the base64 encoding of the service and id
+func (c Base64NodeIDCodec) Encode(service string, id string) string {
+	return base64.StdEncoding.EncodeToString([]byte(service + "\n" + id))
+}
+
+// Decode returns the service and id held in an id made by Encode
+func (c Base64NodeIDCodec) Decode(id string) (string, string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(id)
+	if err != nil {
+		return "", "", ErrInvalidNodeID
+	}
+
+	// urls can't hold a new line so the first one splits the two halves
+	parts := strings.SplitN(string(decoded), "\n", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", ErrInvalidNodeID
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// WithNodeIDCodec returns an Option that namespaces the ids of nodes with the service that resolved
+// them. The ids of types that implement Node are encoded before they are sent to the client and
+// variables of type ID are decoded before they are sent to a service, which lets node(id:) go to
+// the services that know about the node instead of all of them. ids written in the query are turned
+// into variables when the query is planned so they are decoded the same way. Values that the codec
+// can't decode are sent as they are.
+func WithNodeIDCodec(codec NodeIDCodec) Option {
+	return func(g *Gateway) {
+		g.nodeIDCodec = codec
+	}
+}
+
+// nodeIDsEncode replaces the ids of the nodes in the value with ones that carry the service
+func nodeIDsEncode(codec NodeIDCodec, service string, selectionSet ast.SelectionSet, fragments ast.FragmentDefinitionList, value interface{}) {
+	switch value := value.(type) {
+	case []interface{}:
+		for _, entry := range value {
+			nodeIDsEncode(codec, service, selectionSet, fragments, entry)
+		}
+
+	case map[string]interface{}:
+		selection, err := graphql.ApplyFragments(selectionSet, fragments)
+		if err != nil {
+			return
+		}
+
+		// the id can be selected more than once but it can only be encoded once
+		encoded := map[string]bool{}
+
+		for _, field := range graphql.SelectedFields(selection) {
+			key := field.Alias
+			if key == "" {
+				key = field.Name
+			}
+
+			if field.Name == "id" && nodeIDsField(field) {
+				if id, ok := value[key].(string); ok && !encoded[key] {
+					value[key] = codec.Encode(service, id)
+					encoded[key] = true
+				}
+				continue
+			}
+
+			if len(field.SelectionSet) > 0 {
+				nodeIDsEncode(codec, service, field.SelectionSet, fragments, value[key])
+			}
+		}
+	}
+}
+
+// nodeIDsField returns true if the field holds the id of a node
+func nodeIDsField(field *ast.Field) bool {
+	// the planner adds ids without a definition to the objects that other steps look up with node(id:)
+	if field.ObjectDefinition == nil {
+		return true
+	}
+
+	if field.Definition != nil && field.Definition.Type.Name() != "ID" {
+		return false
+	}
+
+	if field.ObjectDefinition.Name == "Node" {
+		return true
+	}
+	for _, iface := range field.ObjectDefinition.Interfaces {
+		if iface == "Node" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nodeIDsDecodeVariables replaces the ids in the variables of type ID with the ones the services know.
+// Variables that the step uses but weren't sent get their default value, which is where the ids
+// written in the query end up. Not every ID is the id of a node so the values the codec can't decode
+// are left alone.
+func nodeIDsDecodeVariables(codec NodeIDCodec, definitions ast.VariableDefinitionList, used Set, variables map[string]interface{}, decode bool) {
+	for name := range used {
+		definition := definitions.ForName(name)
+		if definition == nil || definition.Type.Name() != "ID" {
+			continue
+		}
+
+		value, ok := variables[name]
+		if !ok {
+			if definition.DefaultValue == nil {
+				continue
+			}
+
+			defaultValue, err := definition.DefaultValue.Value(nil)
+			if err != nil {
+				continue
+			}
+			value = defaultValue
+		}
+
+		if decode {
+			value = nodeIDsDecodeValue(codec, value)
+		}
+		variables[name] = value
+	}
+}
+
+// nodeIDsDecodeValue decodes the id or list of ids in the value
+func nodeIDsDecodeValue(codec NodeIDCodec, value interface{}) interface{} {
+	switch value := value.(type) {
+	case string:
+		if _, id, err := codec.Decode(value); err == nil {
+			return id
+		}
+		return value
+
+	case []interface{}:
+		// the list is shared with the variables of the request so we need a copy
+		decoded := make([]interface{}, len(value))
+		for i, entry := range value {
+			decoded[i] = nodeIDsDecodeValue(codec, entry)
+		}
+		return decoded
+	}
+
+	return value
+}
+
+// nodeIDsLiftLiterals turns the ids written in the query into variables that have the id as their
+// default value. The plan is shared between requests so this lets the ids be decoded for each
+// request along with the ones that were sent as variables.
+func nodeIDsLiftLiterals(document *ast.QueryDocument) {
+	// the names of the variables we add can't clash with the ones in the document
+	lifter := &nodeIDsLifter{taken: Set{}, fragments: map[string]ast.VariableDefinitionList{}}
+	for _, operation := range document.Operations {
+		for _, definition := range operation.VariableDefinitions {
+			lifter.taken.Add(definition.Variable)
+		}
+	}
+
+	// a fragment can be spread into more than one operation so each of them has to define its variables
+	for _, fragment := range document.Fragments {
+		lifter.fragments[fragment.Name] = lifter.liftSelection(fragment.SelectionSet)
+	}
+
+	for _, operation := range document.Operations {
+		operation.VariableDefinitions = append(operation.VariableDefinitions, lifter.liftSelection(operation.SelectionSet)...)
+		operation.VariableDefinitions = append(operation.VariableDefinitions, lifter.spreadVariables(operation.SelectionSet, document.Fragments, Set{})...)
+	}
+}
+
+// nodeIDsLifter keeps track of the variables that were added to a document
+type nodeIDsLifter struct {
+	taken     Set
+	count     int
+	fragments map[string]ast.VariableDefinitionList
+}
+
+// liftSelection replaces the ids in the arguments of the fields in the selection set and returns
+// the definitions of the variables that took their place
+func (l *nodeIDsLifter) liftSelection(selectionSet ast.SelectionSet) ast.VariableDefinitionList {
+	definitions := ast.VariableDefinitionList{}
+
+	for _, selection := range selectionSet {
+		switch selection := selection.(type) {
+		case *ast.Field:
+			for _, argument := range selection.Arguments {
+				var lifted ast.VariableDefinitionList
+				argument.Value, lifted = l.liftValue(argument.Value)
+				definitions = append(definitions, lifted...)
+			}
+			definitions = append(definitions, l.liftSelection(selection.SelectionSet)...)
+
+		case *ast.InlineFragment:
+			definitions = append(definitions, l.liftSelection(selection.SelectionSet)...)
+		}
+	}
+
+	return definitions
+}
+
+// liftValue returns the value with every id in it replaced by a variable
+func (l *nodeIDsLifter) liftValue(value *ast.Value) (*ast.Value, ast.VariableDefinitionList) {
+	if value == nil || value.Kind == ast.Variable {
+		return value, nil
+	}
+
+	if (value.Kind == ast.StringValue || value.Kind == ast.IntValue) && value.ExpectedType != nil && value.ExpectedType.Name() == "ID" {
+		definition := &ast.VariableDefinition{
+			Variable:     l.name(),
+			Type:         value.ExpectedType,
+			DefaultValue: value,
+			Position:     value.Position,
+		}
+
+		return &ast.Value{
+			Kind:               ast.Variable,
+			Raw:                definition.Variable,
+			Position:           value.Position,
+			Definition:         value.Definition,
+			ExpectedType:       value.ExpectedType,
+			VariableDefinition: definition,
+		}, ast.VariableDefinitionList{definition}
+	}
+
+	definitions := ast.VariableDefinitionList{}
+	for _, child := range value.Children {
+		var lifted ast.VariableDefinitionList
+		child.Value, lifted = l.liftValue(child.Value)
+		definitions = append(definitions, lifted...)
+	}
+
+	return value, definitions
+}
+
+// spreadVariables returns the variables that were added to the fragments spread in the selection set
+func (l *nodeIDsLifter) spreadVariables(selectionSet ast.SelectionSet, fragments ast.FragmentDefinitionList, visited Set) ast.VariableDefinitionList {
+	definitions := ast.VariableDefinitionList{}
+
+	for _, selection := range selectionSet {
+		switch selection := selection.(type) {
+		case *ast.Field:
+			definitions = append(definitions, l.spreadVariables(selection.SelectionSet, fragments, visited)...)
+
+		case *ast.InlineFragment:
+			definitions = append(definitions, l.spreadVariables(selection.SelectionSet, fragments, visited)...)
+
+		case *ast.FragmentSpread:
+			if visited.Has(selection.Name) {
+				continue
+			}
+			visited.Add(selection.Name)
+
+			definitions = append(definitions, l.fragments[selection.Name]...)
+			if fragment := fragments.ForName(selection.Name); fragment != nil {
+				definitions = append(definitions, l.spreadVariables(fragment.SelectionSet, fragments, visited)...)
+			}
+		}
+	}
+
+	return definitions
+}
+
+// name returns the name of a variable that isn't used by the document
+func (l *nodeIDsLifter) name() string {
+	for {
+		name := fmt.Sprintf("_literalID%d", l.count)
+		l.count++
+
+		if !l.taken.Has(name) {
+			l.taken.Add(name)
+			return name
+		}
+	}
+}
+
+// nodeIDsStepTypes returns the types that a step looking up a node can add fields to
+func nodeIDsStepTypes(step *QueryPlanStep) []string {
+	types := []string{}
+	for _, selection := range step.SelectionSet {
+		fragment, ok := selection.(*ast.InlineFragment)
+		if !ok || fragment.TypeCondition == "" {
+			return []string{step.ParentType}
+		}
+		types = append(types, fragment.TypeCondition)
+	}
+
+	if len(types) == 0 {
+		return []string{step.ParentType}
+	}
+
+	return types
+}
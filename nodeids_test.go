@@ -0,0 +1,202 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nautilus/graphql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBase64NodeIDCodec(t *testing.T) {
+	codec := Base64NodeIDCodec{}
+
+	// ids come back out the way they went in
+	service, id, err := codec.Decode(codec.Encode("http://posts:8080/graphql", "1\n2"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, "http://posts:8080/graphql", service)
+	assert.Equal(t, "1\n2", id)
+
+	// ids that we didn't make are rejected
+	for _, invalid := range []string{"1", "bm90IGFuIGlk", ""} {
+		_, _, err := codec.Decode(invalid)
+		assert.Equal(t, ErrInvalidNodeID, err, invalid)
+	}
+}
+
+// nodeIDsTestGateway builds a gateway in front of a posts and a comments service that keeps track of
+// the ids each service was asked to look up
+func nodeIDsTestGateway(t *testing.T) (*Gateway, map[string][]interface{}) {
+	postSchema, _ := graphql.LoadSchema(`
+		interface Node {
+			id: ID!
+		}
+
+		type Post implements Node {
+			id: ID!
+			title: String!
+		}
+
+		type Query {
+			posts: [Post!]!
+			node(id: ID!): Node
+		}
+	`)
+	commentSchema, _ := graphql.LoadSchema(`
+		interface Node {
+			id: ID!
+		}
+
+		type Comment implements Node {
+			id: ID!
+			body: String!
+		}
+
+		type Query {
+			comments(post: ID): [Comment!]!
+			node(id: ID!): Node
+		}
+	`)
+
+	lock := &sync.Mutex{}
+	lookups := map[string][]interface{}{}
+
+	factory := QueryerFactory(func(ctx *PlanningContext, url string) graphql.Queryer {
+		return graphql.QueryerFunc(func(input *graphql.QueryInput) (interface{}, error) {
+			lock.Lock()
+			defer lock.Unlock()
+
+			if url == "comments" {
+				// the post can be sent as a variable or written in the query
+				post := input.Variables["post"]
+				for name, value := range input.Variables {
+					if strings.HasPrefix(name, "_literalID") {
+						post = value
+					}
+				}
+
+				lookups[url] = append(lookups[url], post, input.Variables["id"])
+				if strings.Contains(input.Query, "node") {
+					return map[string]interface{}{"node": map[string]interface{}{"body": "hello"}}, nil
+				}
+				return map[string]interface{}{
+					"comments": []interface{}{map[string]interface{}{"id": "1", "body": "hello"}},
+				}, nil
+			}
+
+			lookups[url] = append(lookups[url], input.Variables["id"])
+			if strings.Contains(input.Query, "node") {
+				return map[string]interface{}{"node": map[string]interface{}{"title": "world"}}, nil
+			}
+			return map[string]interface{}{
+				"posts": []interface{}{map[string]interface{}{"id": "1", "title": "world"}},
+			}, nil
+		})
+	})
+
+	gateway, err := New([]*graphql.RemoteSchema{
+		{Schema: postSchema, URL: "posts"},
+		{Schema: commentSchema, URL: "comments"},
+	}, WithQueryerFactory(&factory), WithNodeIDCodec(Base64NodeIDCodec{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return gateway, lookups
+}
+
+func TestGateway_nodeIDs(t *testing.T) {
+	gateway, lookups := nodeIDsTestGateway(t)
+	codec := Base64NodeIDCodec{}
+
+	execute := func(query string, variables map[string]interface{}) (map[string]interface{}, error) {
+		reqCtx := &RequestContext{
+			Context:   context.Background(),
+			Query:     query,
+			Variables: variables,
+		}
+
+		plans, err := gateway.GetPlan(reqCtx)
+		if err != nil {
+			return nil, err
+		}
+
+		return gateway.Execute(reqCtx, plans)
+	}
+
+	// the ids of the posts say that they came from the posts service
+	result, err := execute("{ posts { id title } comments { id body } }", nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, map[string]interface{}{
+		"posts":    []interface{}{map[string]interface{}{"id": codec.Encode("posts", "1"), "title": "world"}},
+		"comments": []interface{}{map[string]interface{}{"id": codec.Encode("comments", "1"), "body": "hello"}},
+	}, result)
+
+	// looking up the post only asks the service that knows about it
+	result, err = execute(`
+		query ($id: ID!) {
+			node(id: $id) {
+				id
+				... on Post { title }
+				... on Comment { body }
+			}
+		}
+	`, map[string]interface{}{"id": codec.Encode("posts", "1")})
+	if !assert.Nil(t, err, fmt.Sprint(err)) {
+		return
+	}
+	assert.Equal(t, map[string]interface{}{
+		"node": map[string]interface{}{"id": codec.Encode("posts", "1"), "title": "world"},
+	}, result)
+	assert.Equal(t, []interface{}{nil, "1"}, lookups["posts"])
+	assert.Equal(t, []interface{}{nil, nil}, lookups["comments"])
+
+	// ids sent to a service are the ones it knows
+	_, err = execute(`query ($post: ID) { comments(post: $post) { body } }`, map[string]interface{}{"post": codec.Encode("posts", "1")})
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, []interface{}{nil, nil, "1", nil}, lookups["comments"])
+
+	// ids that the gateway didn't make are sent as they are
+	_, err = execute(`query ($post: ID) { comments(post: $post) { body } }`, map[string]interface{}{"post": "abc"})
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, []interface{}{nil, nil, "1", nil, "abc", nil}, lookups["comments"])
+
+	// ids written in the query are decoded too
+	_, err = execute(fmt.Sprintf(`{ comments(post: %q) { body } }`, codec.Encode("posts", "2")), nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, []interface{}{nil, nil, "1", nil, "abc", nil, "2", nil}, lookups["comments"])
+
+	// including the ones in fragments and the ones looked up with node(id:)
+	result, err = execute(fmt.Sprintf(`
+		{
+			node(id: %q) { ... on Post { title } }
+			...Comments
+		}
+
+		fragment Comments on Query {
+			comments(post: "abc") { id body }
+		}
+	`, codec.Encode("posts", "3")), nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, map[string]interface{}{
+		"node":     map[string]interface{}{"title": "world"},
+		"comments": []interface{}{map[string]interface{}{"id": codec.Encode("comments", "1"), "body": "hello"}},
+	}, result)
+	assert.Equal(t, []interface{}{nil, "1", "3"}, lookups["posts"])
+	assert.Equal(t, []interface{}{nil, nil, "1", nil, "abc", nil, "2", nil, "abc", nil}, lookups["comments"])
+}
@@ -3,6 +3,7 @@ package gateway
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
 
 	"github.com/vektah/gqlparser"
@@ -19,6 +20,7 @@ type QueryPlanStep struct {
 
 	// required info to generate the query
 	Queryer      graphql.Queryer
+	URL          string
 	ParentType   string
 	ParentID     string
 	SelectionSet ast.SelectionSet
@@ -28,6 +30,18 @@ type QueryPlanStep struct {
 	QueryString         string
 	FragmentDefinitions ast.FragmentDefinitionList
 	Variables           Set
+
+	// Entity is the field the step looks up the object it's inserted into with. If it's nil the
+	// step uses node(id:)
+	Entity *EntityResolver
+
+	// Requires holds the fields of the object the step is inserted into that its service needs to
+	// resolve the fields of the step. They are sent along when the object is looked up with _entities.
+	Requires []string
+
+	// Ordered is set on the top-level steps of a mutation. They have to finish one at a time in
+	// the order they appear in the plan.
+	Ordered bool
 }
 
 // QueryPlan is the full plan to resolve a particular query
@@ -47,6 +61,8 @@ type newQueryPlanStepPayload struct {
 	InsertionPoint []string
 	Fragments      ast.FragmentDefinitionList
 	Wrapper        ast.SelectionSet
+	Ordered        bool
+	Requires       []string
 }
 
 // QueryPlanner is responsible for taking a string with a graphql query and returns
@@ -60,13 +76,22 @@ type PlannerWithQueryerFactory interface {
 	WithQueryerFactory(*QueryerFactory) QueryPlanner
 }
 
+// PlannerWithLogger is an interface for planners that can log to the gateway's logger
+type PlannerWithLogger interface {
+	WithLogger(*Logger) QueryPlanner
+}
+
 // QueryerFactory is a function that returns the queryer to use depending on the context
 type QueryerFactory func(ctx *PlanningContext, url string) graphql.Queryer
 
 // Planner is meant to be embedded in other QueryPlanners to share configuration
 type Planner struct {
-	QueryerFactory *QueryerFactory
-	queryerCache   map[string]graphql.Queryer
+	QueryerFactory   *QueryerFactory
+	LocationSelector LocationSelector
+	QueryLimits      *QueryLimits
+	Logger           *Logger
+	EntityResolvers  EntityResolvers
+	queryerCache     map[string]graphql.Queryer
 }
 
 // MinQueriesPlanner does the most basic level of query planning
@@ -80,35 +105,91 @@ func (p *MinQueriesPlanner) WithQueryerFactory(factory *QueryerFactory) QueryPla
 	return p
 }
 
+// WithQueryLimits returns a version of the planner that rejects queries over the limits
+func (p *MinQueriesPlanner) WithQueryLimits(limits *QueryLimits) QueryPlanner {
+	p.Planner.QueryLimits = limits
+	return p
+}
+
+// WithLocationSelector returns a version of the planner with the location selector set
+func (p *MinQueriesPlanner) WithLocationSelector(selector LocationSelector) QueryPlanner {
+	p.Planner.LocationSelector = selector
+	return p
+}
+
+// WithLogger returns a version of the planner that logs to the given logger
+func (p *MinQueriesPlanner) WithLogger(logger *Logger) QueryPlanner {
+	p.Planner.Logger = logger
+	return p
+}
+
 // PlanningContext is the input struct to the Plan method
 type PlanningContext struct {
-	Query     string
-	Schema    *ast.Schema
-	Locations FieldURLMap
-	Gateway   *Gateway
+	Query         string
+	OperationName string
+	Schema        *ast.Schema
+	Locations     FieldURLMap
+	Federation    Federation
+	Gateway       *Gateway
+	Trace         *Trace
+	// Logger holds the fields that identify the request in the logs
+	Logger *Logger
+
+	// the generation of the query plan cache when the schema was read. plans computed for a schema
+	// that was replaced in the meantime aren't saved.
+	cacheGeneration *uint64
+}
+
+// logger returns the logger of the request we are planning for. Requests that weren't given their
+// own logger use the gateway's.
+func (ctx *PlanningContext) logger() *Logger {
+	if ctx.Logger != nil {
+		return ctx.Logger
+	}
+	if ctx.Gateway == nil {
+		return nil
+	}
+
+	return ctx.Gateway.logger
 }
 
 // Plan computes the nested selections that will need to be performed
 func (p *MinQueriesPlanner) Plan(ctx *PlanningContext) ([]*QueryPlan, error) {
 	// the first thing to do is to parse the query
+	span := ctx.Trace.startSpan(TraceSpanParsing)
 	parsedQuery, e := gqlparser.LoadQuery(ctx.Schema, ctx.Query)
 	if e != nil {
+		ctx.Trace.finishSpan(span, e)
 		return nil, e
 	}
+	ctx.Trace.finishSpan(span, nil)
 
-	// generate the plan
-	plans, err := p.generatePlans(ctx, parsedQuery)
-	if err != nil {
+	// make sure that the document has an operation that matches the requested name. We still plan every
+	// operation in the document so that the result can be cached and reused regardless of the name
+	if _, err := selectOperation(parsedQuery.Operations, ctx.OperationName); err != nil {
 		return nil, err
 	}
 
-	flatSelection, err := graphql.ApplyFragments(parsedQuery.Operations[0].SelectionSet, parsedQuery.Fragments)
+	// make sure the query isn't too big before we spend any time planning it
+	if p.QueryLimits != nil {
+		if err := p.QueryLimits.Validate(parsedQuery); err != nil {
+			return nil, err
+		}
+	}
+
+	// ids written in the query have to be decoded for each request so they are moved into variables
+	if ctx.Gateway != nil && ctx.Gateway.nodeIDCodec != nil {
+		nodeIDsLiftLiterals(parsedQuery)
+	}
+
+	// generate the plan
+	plans, err := p.generatePlans(ctx, parsedQuery)
 	if err != nil {
 		return nil, err
 	}
 
 	// add the scrub fields
-	err = p.generateScrubFields(plans, flatSelection)
+	err = p.generateScrubFields(plans)
 	if err != nil {
 		return nil, err
 	}
@@ -121,6 +202,9 @@ func (p *MinQueriesPlanner) generatePlans(ctx *PlanningContext, query *ast.Query
 	// an accumulator
 	plans := []*QueryPlan{}
 
+	// the logs of the planner carry the fields of the request it's planning for
+	logger := p.logger(ctx)
+
 	for _, operation := range query.Operations {
 		// each operation results in a new query
 		plan := &QueryPlan{
@@ -177,16 +261,19 @@ func (p *MinQueriesPlanner) generatePlans(ctx *PlanningContext, query *ast.Query
 					}
 					step := &QueryPlanStep{
 						Queryer:             p.GetQueryer(ctx, payload.Location),
+						URL:                 payload.Location,
 						ParentType:          payload.ParentType,
 						SelectionSet:        ast.SelectionSet{},
 						InsertionPoint:      payload.InsertionPoint,
 						Variables:           Set{},
 						FragmentDefinitions: payload.Fragments,
+						Ordered:             payload.Ordered,
+						Requires:            payload.Requires,
 					}
 
 					// if there is a parent to this query
 					if payload.Parent != nil {
-						log.Debug(fmt.Sprintf("Adding step as dependency"))
+						logger.Debug(fmt.Sprintf("Adding step as dependency"))
 						// add the new step to the Then of the parent
 						payload.Parent.Then = append(payload.Parent.Then, step)
 					}
@@ -196,22 +283,24 @@ func (p *MinQueriesPlanner) generatePlans(ctx *PlanningContext, query *ast.Query
 						plan.RootStep = step
 					}
 
-					log.Debug(fmt.Sprintf(
+					logger.Debug(fmt.Sprintf(
 						"Encountered new step: \n"+
 							"\tParentType: %v \n"+
 							"\tInsertion Point: %v \n"+
 							"\tSelectionSet: \n%s",
 						step.ParentType,
 						payload.InsertionPoint,
-						log.FormatSelectionSet(payload.SelectionSet),
+						logger.FormatSelectionSet(payload.SelectionSet),
 					))
 
 					// we are going to start walking down the operations selection set and let
 					// the steps of the walk add any necessary selectedFields
 					newSelection, err := p.extractSelection(&extractSelectionConfig{
+						logger:         logger,
 						stepCh:         stepCh,
 						stepWg:         stepWg,
 						locations:      ctx.Locations,
+						federation:     ctx.Federation,
 						parentLocation: payload.Location,
 						parentType:     step.ParentType,
 						selection:      payload.SelectionSet,
@@ -243,8 +332,28 @@ func (p *MinQueriesPlanner) generatePlans(ctx *PlanningContext, query *ast.Query
 						variableDefs = append(variableDefs, plan.Operation.VariableDefinitions.ForName(variable))
 					}
 
+					// steps that are inserted into an object might look it up with something other than node(id:)
+					var keyType *ast.Type
+					if executorStripNode(step) {
+						step.Entity = p.entityResolver(ctx.Federation, step.URL, step.ParentType)
+					}
+					if step.Entity != nil {
+						keyType, err = entityKeyType(ctx.Schema, step.Entity)
+						if err != nil {
+							errCh <- err
+							continue SelectLoop
+						}
+					}
+
+					// only _entities can be sent the fields that the service needs from the parent
+					if len(step.Requires) > 0 && (step.Entity == nil || step.Entity.Field != federationEntitiesField) {
+						errCh <- fmt.Errorf("%s requires fields of %s but can't look them up with %s", step.URL, step.ParentType, federationEntitiesField)
+						continue SelectLoop
+					}
+
 					// build up the query document
-					step.QueryDocument = plannerBuildQuery(step.ParentType, variableDefs, step.SelectionSet, step.FragmentDefinitions)
+					logger.Debug("Building Query: \n"+"\tParentType: ", step.ParentType, " ")
+					step.QueryDocument = plannerBuildEntityQuery(step.ParentType, step.Entity, keyType, variableDefs, step.SelectionSet, step.FragmentDefinitions)
 
 					// we also need to turn the query into a string
 					queryString, err := graphql.PrintQuery(step.QueryDocument)
@@ -254,11 +363,10 @@ func (p *MinQueriesPlanner) generatePlans(ctx *PlanningContext, query *ast.Query
 					}
 
 					step.QueryString = queryString
+					logger.Debug("")
 
 					// we're done processing this step
 					stepWg.Done()
-
-					log.Debug("")
 				}
 			}
 		}(stepCh)
@@ -302,6 +410,7 @@ type extractSelectionConfig struct {
 	stepWg *sync.WaitGroup
 
 	locations      FieldURLMap
+	federation     Federation
 	parentLocation string
 	parentType     string
 	step           *QueryPlanStep
@@ -309,12 +418,18 @@ type extractSelectionConfig struct {
 	selection      ast.SelectionSet
 	insertionPoint []string
 	wrapper        ast.SelectionSet
+	logger         *Logger
 }
 
 func (p *MinQueriesPlanner) extractSelection(config *extractSelectionConfig) (ast.SelectionSet, error) {
-	log.Debug("")
-	log.Debug("--- Extracting Selection ---")
-	log.Debug("Parent location: ", config.parentLocation)
+	config.logger.Debug("")
+	config.logger.Debug("--- Extracting Selection ---")
+	config.logger.Debug("Parent location: ", config.parentLocation)
+
+	// the top-level fields of a mutation have to be resolved in the order they were asked for
+	if config.plan.Operation.Operation == ast.Mutation && config.step == config.plan.RootStep {
+		return p.extractMutationSelection(config)
+	}
 
 	// in order to group together fields in as few queries as possible, we need to group
 	// the selection set by the location.
@@ -323,10 +438,11 @@ func (p *MinQueriesPlanner) extractSelection(config *extractSelectionConfig) (as
 		return nil, err
 	}
 
-	log.Debug("Fields By Location: ", locationFields)
+	config.logger.Debug("Fields By Location: ", locationFields)
 
-	// we only need to add an ID field if there are steps coming off of this insertion point
-	checkForID := false
+	// we only need to add the keys of the objects (and the fields other services require from them)
+	// if there are steps coming off of this insertion point
+	keys := Set{}
 
 	// we have to make sure we spawn any more goroutines before this one terminates. This means that
 	// we first have to look at any locations that are not the current one
@@ -336,7 +452,7 @@ func (p *MinQueriesPlanner) extractSelection(config *extractSelectionConfig) (as
 		}
 
 		// we are dealing with a selection to another location that isn't the current one
-		log.Debug(fmt.Sprintf(
+		config.logger.Debug(fmt.Sprintf(
 			"Adding the new step"+
 				"\n\tParent Type: %s"+
 				"\n\tLocation: %v"+
@@ -344,12 +460,32 @@ func (p *MinQueriesPlanner) extractSelection(config *extractSelectionConfig) (as
 			config.parentType, location, config.insertionPoint))
 
 		// if there are selections in this bundle that are not from the parent location we need to add
-		// id to the selection set
-		checkForID = true
+		// the field the other location looks up the object with to the selection set
+		keys.Add(p.entityKey(config.federation, location, config.parentType))
+
+		// along with any fields the other location needs to resolve the ones we are asking it for
+		requires, err := config.federation.requires(location, config.parentType, selectionSet, locationFragments[location])
+		if err != nil {
+			return nil, err
+		}
+		for _, field := range requires {
+			parentLocations, _ := config.locations.URLFor(config.parentType, field)
+			resolvable := false
+			for _, parentLocation := range parentLocations {
+				if parentLocation == config.parentLocation {
+					resolvable = true
+				}
+			}
+			if !resolvable {
+				return nil, fmt.Errorf("%s.%s is required by %s but can't be resolved by %s", config.parentType, field, location, config.parentLocation)
+			}
+
+			keys.Add(field)
+		}
 
 		// if we have a wrapper to add
 		if config.wrapper != nil && len(config.wrapper) > 0 {
-			log.Debug("wrapping selection", config.wrapper)
+			config.logger.Debug("wrapping selection", config.wrapper)
 
 			// use the wrapped version
 			selectionSet, err = p.wrapSelectionSet(config, locationFragments, location, selectionSet)
@@ -371,13 +507,19 @@ func (p *MinQueriesPlanner) extractSelection(config *extractSelectionConfig) (as
 			Location:     location,
 			SelectionSet: selectionSet,
 			Fragments:    locationFragments[location],
+			Requires:     requires,
 		}
 	}
 
-	// if we have to have an id field on this selection set
-	if checkForID {
-		// add the id field since duplicates are ignored
-		locationFields[config.parentLocation] = append(locationFields[config.parentLocation], &ast.Field{Name: "id"})
+	// if we have to have key fields on this selection set, add them in a stable order
+	sortedKeys := []string{}
+	for key := range keys {
+		sortedKeys = append(sortedKeys, key)
+	}
+	sort.Strings(sortedKeys)
+	for _, key := range sortedKeys {
+		// add the key field since duplicates are ignored
+		locationFields[config.parentLocation] = append(locationFields[config.parentLocation], &ast.Field{Name: key})
 	}
 
 	// now we have to generate a selection set for fields that are coming from the same location as the parent
@@ -414,13 +556,15 @@ func (p *MinQueriesPlanner) extractSelection(config *extractSelectionConfig) (as
 					}
 				}
 
-				log.Debug("found a thing with a selection. extracting to ", insertionPoint, ". Parent insertion", config.insertionPoint)
+				config.logger.Debug("found a thing with a selection. extracting to ", insertionPoint, ". Parent insertion", config.insertionPoint)
 				// add any possible selections provided by this fields selections
 				subSelection, err := p.extractSelection(&extractSelectionConfig{
+					logger:         config.logger,
 					stepCh:         config.stepCh,
 					stepWg:         config.stepWg,
 					step:           config.step,
 					locations:      config.locations,
+					federation:     config.federation,
 					parentLocation: config.parentLocation,
 					plan:           config.plan,
 
@@ -433,12 +577,12 @@ func (p *MinQueriesPlanner) extractSelection(config *extractSelectionConfig) (as
 					return nil, err
 				}
 
-				log.Debug(fmt.Sprintf("final selection for %s.%s: %v\n", config.parentType, selection.Name, subSelection))
+				config.logger.Debug(fmt.Sprintf("final selection for %s.%s: %v\n", config.parentType, selection.Name, subSelection))
 
 				// overwrite the selection set for this selection
 				selection.SelectionSet = subSelection
 			} else {
-				log.Debug("found a scalar")
+				config.logger.Debug("found a scalar")
 			}
 			// the field is now safe to add to the parents selection set
 
@@ -467,10 +611,12 @@ func (p *MinQueriesPlanner) extractSelection(config *extractSelectionConfig) (as
 
 			// compute the actual selection set for the fragment coming from this location
 			subSelection, err := p.extractSelection(&extractSelectionConfig{
+				logger:         config.logger,
 				stepCh:         config.stepCh,
 				stepWg:         config.stepWg,
 				step:           config.step,
 				locations:      config.locations,
+				federation:     config.federation,
 				parentLocation: config.parentLocation,
 				insertionPoint: config.insertionPoint,
 				plan:           config.plan,
@@ -500,7 +646,7 @@ func (p *MinQueriesPlanner) extractSelection(config *extractSelectionConfig) (as
 			config.step.FragmentDefinitions.ForName(selection.Name).SelectionSet = subSelection
 
 		case *ast.InlineFragment:
-			log.Debug("found an inline fragment. extracting to ", config.insertionPoint, ". Parent insertion", config.insertionPoint)
+			config.logger.Debug("found an inline fragment. extracting to ", config.insertionPoint, ". Parent insertion", config.insertionPoint)
 
 			newWrapper := make(ast.SelectionSet, len(config.wrapper))
 			copy(newWrapper, config.wrapper)
@@ -508,10 +654,12 @@ func (p *MinQueriesPlanner) extractSelection(config *extractSelectionConfig) (as
 
 			// add any possible selections provided by selections
 			subSelection, err := p.extractSelection(&extractSelectionConfig{
+				logger:         config.logger,
 				stepCh:         config.stepCh,
 				stepWg:         config.stepWg,
 				step:           config.step,
 				locations:      config.locations,
+				federation:     config.federation,
 				parentLocation: config.parentLocation,
 				plan:           config.plan,
 				insertionPoint: config.insertionPoint,
@@ -538,7 +686,7 @@ func (p *MinQueriesPlanner) extractSelection(config *extractSelectionConfig) (as
 
 func (p *MinQueriesPlanner) wrapSelectionSet(config *extractSelectionConfig, locationFragments map[string]ast.FragmentDefinitionList, location string, selectionSet ast.SelectionSet) (ast.SelectionSet, error) {
 
-	log.Debug("wrapping selection", config.wrapper)
+	config.logger.Debug("wrapping selection", config.wrapper)
 
 	// pointers required to nest the
 	var selection ast.Selection
@@ -610,7 +758,7 @@ FieldLoop:
 		// each kind of selection contributes differently to the final selection set
 		switch selection := selection.(type) {
 		case *ast.Field:
-			log.Debug("Encountered field ", selection.Name)
+			config.logger.Debug("Encountered field ", selection.Name)
 
 			field := &ast.Field{
 				Name:             selection.Name,
@@ -647,18 +795,12 @@ FieldLoop:
 				}
 
 				// if we got here then this field can be found in multiple services and none of the top priority locations.
-				// for now, just use the first one
-
-				// do not use internalSchemaLocation if there are multiple possible locations
-				location := possibleLocations[0]
-				if location == internalSchemaLocation {
-					location = possibleLocations[1]
-				}
+				location := p.selectLocation(config.parentType, selection.Name, possibleLocations)
 				locationFields[location] = append(locationFields[location], field)
 			}
 
 		case *ast.FragmentSpread:
-			log.Debug("Encountered fragment spread ", selection.Name)
+			config.logger.Debug("Encountered fragment spread ", selection.Name)
 
 			// a fragments fields can span multiple services so a single fragment can result in many selections being added
 			fragmentLocations := map[string]ast.SelectionSet{}
@@ -697,7 +839,11 @@ FieldLoop:
 					}
 
 					// add the field to the location
-					fragmentLocations[fieldLocations[0]] = append(fragmentLocations[fieldLocations[0]], field)
+					location := fieldLocations[0]
+					if len(fieldLocations) > 1 {
+						location = p.selectLocation(defn.TypeCondition, field.Name, fieldLocations)
+					}
+					fragmentLocations[location] = append(fragmentLocations[location], field)
 
 				case *ast.FragmentSpread, *ast.InlineFragment:
 					// non-field selections will be handled in the next tick
@@ -724,7 +870,7 @@ FieldLoop:
 			}
 
 		case *ast.InlineFragment:
-			log.Debug("Encountered inline fragment on ", selection.TypeCondition)
+			config.logger.Debug("Encountered inline fragment on ", selection.TypeCondition)
 
 			// we need to split the inline fragment into an inline fragment for each location that this cover
 			// and then add those inline fragments to the final selection
@@ -742,7 +888,11 @@ FieldLoop:
 					}
 
 					// add the field to the location
-					fragmentLocations[fieldLocations[0]] = append(fragmentLocations[fieldLocations[0]], fragmentSelection)
+					location := fieldLocations[0]
+					if len(fieldLocations) > 1 {
+						location = p.selectLocation(selection.TypeCondition, fragmentSelection.Name, fieldLocations)
+					}
+					fragmentLocations[location] = append(fragmentLocations[location], fragmentSelection)
 
 				case *ast.FragmentSpread, *ast.InlineFragment:
 					// non-field selections will be handled in the next tick
@@ -766,11 +916,154 @@ FieldLoop:
 	return locationFields, locationFragments, nil
 }
 
+// extractMutationSelection adds the steps for the top-level fields of a mutation. Instead of one
+// step for each location, every run of fields from the same location gets a step of its own so
+// that the executor can send them one after another in the order of the document.
+func (p *MinQueriesPlanner) extractMutationSelection(config *extractSelectionConfig) (ast.SelectionSet, error) {
+	payloads := []*newQueryPlanStepPayload{}
+
+	// fragments can mix fields from different locations so we look at one field at a time
+	fields, err := p.mutationFields(config, config.selection, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, selection := range fields {
+		// find the location of the field on its own
+		locationFields, locationFragments, err := p.groupSelectionSet(&extractSelectionConfig{
+			logger:         config.logger,
+			locations:      config.locations,
+			federation:     config.federation,
+			parentLocation: config.parentLocation,
+			parentType:     config.parentType,
+			step:           config.step,
+			plan:           config.plan,
+			selection:      ast.SelectionSet{selection},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for location, selectionSet := range locationFields {
+			// if the previous step goes to the same location, the field can be sent along with it
+			if len(payloads) > 0 && payloads[len(payloads)-1].Location == location {
+				last := payloads[len(payloads)-1]
+				last.SelectionSet = append(last.SelectionSet, selectionSet...)
+				for _, fragment := range locationFragments[location] {
+					if last.Fragments.ForName(fragment.Name) == nil {
+						last.Fragments = append(last.Fragments, fragment)
+					}
+				}
+				continue
+			}
+
+			payloads = append(payloads, &newQueryPlanStepPayload{
+				Plan:           config.plan,
+				Parent:         config.step,
+				InsertionPoint: config.insertionPoint,
+				Wrapper:        config.wrapper,
+				ParentType:     config.parentType,
+				Ordered:        true,
+
+				Location:     location,
+				SelectionSet: selectionSet,
+				Fragments:    locationFragments[location],
+			})
+		}
+	}
+
+	// the steps are added to the root in the order they are sent. this is called while the
+	// channel is being drained so we can't block on it if there are more steps than it can hold
+	config.stepWg.Add(len(payloads))
+	go func() {
+		for _, payload := range payloads {
+			config.stepCh <- payload
+		}
+	}()
+
+	// the root step doesn't send a query of its own
+	return ast.SelectionSet{}, nil
+}
+
+// mutationFields returns the top-level fields of a mutation in the order of the document. Fields
+// inside of fragments are wrapped in an inline fragment of their own with the directives of every
+// fragment around them so each one still ends up in a single location.
+func (p *MinQueriesPlanner) mutationFields(config *extractSelectionConfig, selectionSet ast.SelectionSet, wrapper *ast.InlineFragment) (ast.SelectionSet, error) {
+	fields := ast.SelectionSet{}
+
+	for _, selection := range selectionSet {
+		switch selection := selection.(type) {
+		case *ast.Field:
+			if wrapper == nil {
+				fields = append(fields, selection)
+				continue
+			}
+
+			fields = append(fields, &ast.InlineFragment{
+				TypeCondition: wrapper.TypeCondition,
+				Directives:    wrapper.Directives,
+				SelectionSet:  ast.SelectionSet{selection},
+			})
+
+		case *ast.InlineFragment:
+			// fragments without a type condition are on the mutation type
+			typeCondition := selection.TypeCondition
+			if typeCondition == "" {
+				typeCondition = config.parentType
+			}
+
+			inner, err := p.mutationFields(config, selection.SelectionSet, mutationFragmentWrapper(wrapper, typeCondition, selection.Directives))
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, inner...)
+
+		case *ast.FragmentSpread:
+			defn := config.step.FragmentDefinitions.ForName(selection.Name)
+			if defn == nil {
+				defn = config.plan.FragmentDefinitions.ForName(selection.Name)
+				if defn == nil {
+					return nil, fmt.Errorf("Could not find definition for directive: %s", selection.Name)
+				}
+			}
+
+			inner, err := p.mutationFields(config, defn.SelectionSet, mutationFragmentWrapper(wrapper, defn.TypeCondition, selection.Directives))
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, inner...)
+		}
+	}
+
+	return fields, nil
+}
+
+// mutationFragmentWrapper returns the inline fragment that stands in for a fragment inside of the
+// wrapper. Every fragment at the top of a mutation is on the mutation type so only the directives
+// have to be kept.
+func mutationFragmentWrapper(wrapper *ast.InlineFragment, typeCondition string, directives ast.DirectiveList) *ast.InlineFragment {
+	if wrapper == nil {
+		return &ast.InlineFragment{TypeCondition: typeCondition, Directives: directives}
+	}
+
+	combined := ast.DirectiveList{}
+	combined = append(combined, wrapper.Directives...)
+	combined = append(combined, directives...)
+
+	return &ast.InlineFragment{TypeCondition: typeCondition, Directives: combined}
+}
+
 // This plan results in a query that has fields that were not explicitly asked for.
 // In order for the executor to know what to filter out of the final reply,
 // we have to leave behind paths to objects that need to be scrubbed.
-func (p *MinQueriesPlanner) generateScrubFields(plans []*QueryPlan, requestSelection ast.SelectionSet) error {
+func (p *MinQueriesPlanner) generateScrubFields(plans []*QueryPlan) error {
 	for _, plan := range plans {
+		// the selection set of the operation that this plan resolves
+		requestSelection, err := graphql.ApplyFragments(plan.Operation.SelectionSet, plan.FragmentDefinitions)
+		if err != nil {
+			return err
+		}
+
 		// the list of fields to scrub in this plan
 		fieldsToScrub := map[string][][]string{"id": {}}
 
@@ -822,19 +1115,34 @@ func (p *MinQueriesPlanner) generateScrubFieldsWalk(step *QueryPlanStep, selecti
 		}
 	}
 
-	// look through the selection for a field named id
+	// look through the selection for the field the step looks up its object with
+	key := executorEntityKey(step)
 	naturalID := false
 	for _, field := range graphql.SelectedFields(targetSelection) {
-		// if the field is for id
-		if field.Alias == "id" {
+		// if the field is for the key
+		if field.Alias == key {
 			naturalID = true
 		}
 	}
 
-	// if the id was not natural and we were going to be inserted somewhere
+	// if the key was not natural and we were going to be inserted somewhere
 	if !naturalID && len(insertionPoint) > 0 {
 		// we have to add this insertion point to the list places to scrub
-		acc["id"] = append(acc["id"], insertionPoint)
+		acc[key] = append(acc[key], insertionPoint)
+	}
+
+	// the same goes for the fields the step requires that weren't asked for
+	for _, required := range step.Requires {
+		natural := required == key
+		for _, field := range graphql.SelectedFields(targetSelection) {
+			if field.Alias == required {
+				natural = true
+			}
+		}
+
+		if !natural && len(insertionPoint) > 0 {
+			acc[required] = append(acc[required], insertionPoint)
+		}
 	}
 
 	// add all of the plans for the next step along with those from this step
@@ -853,6 +1161,73 @@ func (p *MinQueriesPlanner) generateScrubFieldsWalk(step *QueryPlanStep, selecti
 	return acc, nil
 }
 
+// selectOperation returns the operation in the list with the given name. If the name is empty, the list
+// must contain exactly one operation. These rules follow the GetOperation algorithm in the spec.
+func selectOperation(operations ast.OperationList, operationName string) (*ast.OperationDefinition, error) {
+	// if the user did not give us a name then there can only be one operation in the document
+	if operationName == "" {
+		if len(operations) == 0 {
+			return nil, errors.New("Must provide an operation.")
+		}
+		if len(operations) > 1 {
+			return nil, errors.New("Must provide operation name if query contains multiple operations.")
+		}
+
+		return operations[0], nil
+	}
+
+	// look for the operation with the matching name
+	var match *ast.OperationDefinition
+	for _, operation := range operations {
+		if operation.Name != operationName {
+			continue
+		}
+
+		// if we have already found an operation with this name, we can't tell which one to use
+		if match != nil {
+			return nil, fmt.Errorf("Operation name \"%s\" is ambiguous.", operationName)
+		}
+		match = operation
+	}
+
+	// if we didn't find an operation with the name
+	if match == nil {
+		return nil, fmt.Errorf("Unknown operation named \"%s\".", operationName)
+	}
+
+	return match, nil
+}
+
+// selectPlan returns the plan that resolves the operation with the given name
+func selectPlan(plans []*QueryPlan, operationName string) (*QueryPlan, error) {
+	// a single plan without a name is always the one to execute
+	if len(plans) == 1 && operationName == "" {
+		return plans[0], nil
+	}
+
+	// collect the operation of each plan so we can apply the same rules as the planner
+	operations := ast.OperationList{}
+	for _, plan := range plans {
+		if plan.Operation != nil {
+			operations = append(operations, plan.Operation)
+		}
+	}
+
+	operation, err := selectOperation(operations, operationName)
+	if err != nil {
+		return nil, err
+	}
+
+	// find the plan that corresponds to the operation
+	for _, plan := range plans {
+		if plan.Operation == operation {
+			return plan, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Unknown operation named \"%s\".", operationName)
+}
+
 func coreFieldType(source *ast.Field) *ast.Type {
 	// if we are looking at a
 	return source.Definition.Type
@@ -880,19 +1255,63 @@ func (set Set) Has(k string) bool {
 
 // GetQueryer returns the queryer that should be used to resolve the plan
 func (p *Planner) GetQueryer(ctx *PlanningContext, url string) graphql.Queryer {
+	// the gateway resolves the fields in its own schema
+	if url == internalSchemaLocation && ctx.Gateway != nil {
+		return ctx.Gateway
+	}
+
+	// the queryer for the url
+	var queryer graphql.Queryer = graphql.NewSingleRequestQueryer(url)
 
 	// if there is a queryer factory defined
 	if p.QueryerFactory != nil {
 		// use the factory
-		return (*p.QueryerFactory)(ctx, url)
+		queryer = (*p.QueryerFactory)(ctx, url)
 	}
 
-	// return the queryer for the url
-	return graphql.NewSingleRequestQueryer(url)
+	// if the location selector wants to know how the services are doing
+	if observer, ok := p.LocationSelector.(LocationSelectorWithObserver); ok && url != internalSchemaLocation {
+		queryer = &observedQueryer{url: url, queryer: queryer, observer: observer}
+	}
+
+	return queryer
+}
+
+// logger returns the logger to use while planning. Planners that aren't used by a gateway fall back
+// to their own logger.
+func (p *Planner) logger(ctx *PlanningContext) *Logger {
+	if ctx.Logger == nil && ctx.Gateway == nil {
+		return p.Logger
+	}
+
+	return ctx.logger()
+}
+
+// selectLocation picks the location of a field that can be found in multiple services
+func (p *Planner) selectLocation(parentType string, field string, locations []string) string {
+	// do not use internalSchemaLocation if there are multiple possible locations
+	candidates := []string{}
+	for _, location := range locations {
+		if location != internalSchemaLocation {
+			candidates = append(candidates, location)
+		}
+	}
+
+	// without a selector, just use the first one
+	if p.LocationSelector == nil {
+		return candidates[0]
+	}
+
+	return p.LocationSelector.SelectLocation(parentType, field, candidates)
 }
 
 func plannerBuildQuery(parentType string, variables ast.VariableDefinitionList, selectionSet ast.SelectionSet, fragmentDefinitions ast.FragmentDefinitionList) *ast.QueryDocument {
-	log.Debug("Building Query: \n"+"\tParentType: ", parentType, " ")
+	return plannerBuildEntityQuery(parentType, nil, nil, variables, selectionSet, fragmentDefinitions)
+}
+
+// plannerBuildEntityQuery builds the query for a step. If the step is inserted into an object that the
+// service looks up with an entity resolver, the resolver's field is used in place of node(id:).
+func plannerBuildEntityQuery(parentType string, entity *EntityResolver, keyType *ast.Type, variables ast.VariableDefinitionList, selectionSet ast.SelectionSet, fragmentDefinitions ast.FragmentDefinitionList) *ast.QueryDocument {
 	// build up an operation for the query
 	operation := &ast.OperationDefinition{
 		VariableDefinitions: variables,
@@ -923,12 +1342,20 @@ func plannerBuildQuery(parentType string, variables ast.VariableDefinitionList,
 		//	 		}
 		//	 	}
 		// }
+		field, argument := "node", "id"
+		if entity != nil {
+			field, argument = entity.Field, entity.Argument
+		}
+		if keyType == nil {
+			keyType = ast.NonNullNamedType("ID", &ast.Position{})
+		}
+
 		operation.SelectionSet = ast.SelectionSet{
 			&ast.Field{
-				Name: "node",
+				Name: field,
 				Arguments: ast.ArgumentList{
 					&ast.Argument{
-						Name: "id",
+						Name: argument,
 						Value: &ast.Value{
 							Kind: ast.Variable,
 							Raw:  "id",
@@ -948,7 +1375,7 @@ func plannerBuildQuery(parentType string, variables ast.VariableDefinitionList,
 		if variables.ForName("id") == nil {
 			operation.VariableDefinitions = append(operation.VariableDefinitions, &ast.VariableDefinition{
 				Variable: "id",
-				Type:     ast.NonNullNamedType("ID", &ast.Position{}),
+				Type:     keyType,
 			})
 		}
 	}
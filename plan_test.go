@@ -1483,6 +1483,232 @@ func TestPlannerBuildQuery_node(t *testing.T) {
 	assert.Equal(t, selection, fragment.SelectionSet)
 }
 
+func TestPlanQuery_multipleOperations(t *testing.T) {
+	// the location map for fields for this query
+	locations := FieldURLMap{}
+	locations.RegisterURL("Query", "foo", "url1")
+	locations.RegisterURL("Query", "bar", "url2")
+
+	schema, _ := graphql.LoadSchema(`
+		type Query {
+			foo: Boolean
+			bar: Boolean
+		}
+	`)
+
+	// a document with two named operations
+	query := `
+		query Foo { foo }
+		query Bar { bar }
+	`
+
+	t.Run("plans every operation", func(t *testing.T) {
+		plans, err := (&MinQueriesPlanner{}).Plan(&PlanningContext{
+			Query:         query,
+			OperationName: "Bar",
+			Schema:        schema,
+			Locations:     locations,
+		})
+		if !assert.Nil(t, err) {
+			return
+		}
+
+		// there should be one plan for each operation
+		if !assert.Len(t, plans, 2) {
+			return
+		}
+
+		// make sure we can pull out the plan for the second operation
+		plan, err := selectPlan(plans, "Bar")
+		if !assert.Nil(t, err) {
+			return
+		}
+		assert.Equal(t, "Bar", plan.Operation.Name)
+
+		// and that its step goes to the right service
+		queryer := plan.RootStep.Then[0].Queryer.(*graphql.SingleRequestQueryer)
+		assert.Equal(t, "url2", queryer.URL())
+	})
+
+	t.Run("missing operation name", func(t *testing.T) {
+		_, err := (&MinQueriesPlanner{}).Plan(&PlanningContext{
+			Query:     query,
+			Schema:    schema,
+			Locations: locations,
+		})
+		if !assert.NotNil(t, err) {
+			return
+		}
+		assert.Equal(t, "Must provide operation name if query contains multiple operations.", err.Error())
+	})
+
+	t.Run("unknown operation name", func(t *testing.T) {
+		_, err := (&MinQueriesPlanner{}).Plan(&PlanningContext{
+			Query:         query,
+			OperationName: "Baz",
+			Schema:        schema,
+			Locations:     locations,
+		})
+		if !assert.NotNil(t, err) {
+			return
+		}
+		assert.Equal(t, `Unknown operation named "Baz".`, err.Error())
+	})
+}
+
+func TestSelectOperation(t *testing.T) {
+	foo := &ast.OperationDefinition{Name: "Foo", Operation: ast.Query}
+	bar := &ast.OperationDefinition{Name: "Bar", Operation: ast.Query}
+	anonymous := &ast.OperationDefinition{Operation: ast.Query}
+
+	// a single anonymous operation can be selected without a name
+	operation, err := selectOperation(ast.OperationList{anonymous}, "")
+	if assert.Nil(t, err) {
+		assert.Equal(t, anonymous, operation)
+	}
+
+	// so can a single named operation
+	operation, err = selectOperation(ast.OperationList{foo}, "")
+	if assert.Nil(t, err) {
+		assert.Equal(t, foo, operation)
+	}
+
+	// the name picks the operation out of the list
+	operation, err = selectOperation(ast.OperationList{foo, bar}, "Bar")
+	if assert.Nil(t, err) {
+		assert.Equal(t, bar, operation)
+	}
+
+	// two operations with the same name are ambiguous
+	_, err = selectOperation(ast.OperationList{foo, foo}, "Foo")
+	assert.NotNil(t, err)
+
+	// an empty document has nothing to select
+	_, err = selectOperation(ast.OperationList{}, "")
+	assert.NotNil(t, err)
+}
+
 func TestPlanQuery_mutationsInSeries(t *testing.T) {
-	t.Skip("Not implemented")
+	schema, _ := graphql.LoadSchema(`
+		type Post {
+			id: ID!
+			title: String!
+			likes: Int!
+		}
+
+		type Query {
+			post: Post
+		}
+
+		type Mutation {
+			createPost: Post!
+			likePost: Boolean!
+			publishPost: Boolean!
+		}
+	`)
+
+	locations := FieldURLMap{}
+	locations.RegisterURL("Query", "post", "posts")
+	locations.RegisterURL("Mutation", "createPost", "posts")
+	locations.RegisterURL("Mutation", "publishPost", "posts")
+	locations.RegisterURL("Mutation", "likePost", "likes")
+	locations.RegisterURL("Post", "id", "posts", "likes")
+	locations.RegisterURL("Post", "title", "posts")
+	locations.RegisterURL("Post", "likes", "likes")
+
+	plans, err := (&MinQueriesPlanner{}).Plan(&PlanningContext{
+		Query:     "mutation { createPost { title likes } publishPost likePost other: publishPost }",
+		Schema:    schema,
+		Locations: locations,
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// a field from another service splits up the fields of the same one
+	steps := plans[0].RootStep.Then
+	if !assert.Len(t, steps, 3) {
+		return
+	}
+
+	expected := []struct {
+		URL    string
+		Fields []string
+	}{
+		{"posts", []string{"createPost", "publishPost"}},
+		{"likes", []string{"likePost"}},
+		{"posts", []string{"publishPost"}},
+	}
+	for i, row := range expected {
+		assert.Equal(t, row.URL, steps[i].URL)
+		assert.True(t, steps[i].Ordered)
+
+		fields := []string{}
+		for _, field := range graphql.SelectedFields(steps[i].SelectionSet) {
+			fields = append(fields, field.Name)
+		}
+		assert.Equal(t, row.Fields, fields)
+	}
+
+	// the fields under a mutation are still looked up once it's done
+	if assert.Len(t, steps[0].Then, 1) {
+		assert.Equal(t, "likes", steps[0].Then[0].URL)
+		assert.Equal(t, []string{"createPost"}, steps[0].Then[0].InsertionPoint)
+		assert.False(t, steps[0].Then[0].Ordered)
+	}
+
+	// fields in fragments keep their place in the document
+	plans, err = (&MinQueriesPlanner{}).Plan(&PlanningContext{
+		Query: `
+			mutation {
+				... on Mutation { publishPost likePost }
+				...CreatePost
+			}
+
+			fragment CreatePost on Mutation {
+				createPost { title }
+			}
+		`,
+		Schema:    schema,
+		Locations: locations,
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	steps = plans[0].RootStep.Then
+	if !assert.Len(t, steps, 3) {
+		return
+	}
+	for i, row := range []struct {
+		URL    string
+		Fields []string
+	}{
+		{"posts", []string{"publishPost"}},
+		{"likes", []string{"likePost"}},
+		{"posts", []string{"createPost"}},
+	} {
+		assert.Equal(t, row.URL, steps[i].URL)
+
+		selection, err := graphql.ApplyFragments(steps[i].SelectionSet, steps[i].FragmentDefinitions)
+		if !assert.Nil(t, err) {
+			return
+		}
+		fields := []string{}
+		for _, field := range graphql.SelectedFields(selection) {
+			fields = append(fields, field.Name)
+		}
+		assert.Equal(t, row.Fields, fields)
+	}
+
+	// queries don't have to wait for each other
+	plans, err = (&MinQueriesPlanner{}).Plan(&PlanningContext{
+		Query:     "{ post { title likes } }",
+		Schema:    schema,
+		Locations: locations,
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.False(t, plans[0].RootStep.Then[0].Ordered)
 }
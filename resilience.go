@@ -0,0 +1,287 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nautilus/graphql"
+	"github.com/vektah/gqlparser/ast"
+)
+
+// ServiceConfig controls how the gateway talks to one of its services
+type ServiceConfig struct {
+	// Timeout is the deadline for a single request to the service. Zero means no deadline.
+	Timeout time.Duration
+
+	// Retries is the number of times a query that couldn't reach the service is sent again.
+	// Mutations are never retried.
+	Retries int
+	// RetryBackoff is how long to wait before the first retry. The wait doubles after every attempt.
+	RetryBackoff time.Duration
+
+	// BreakerThreshold is the number of failures in a row that opens the circuit breaker. While
+	// the breaker is open, requests to the service fail immediately. Zero disables the breaker.
+	BreakerThreshold int
+	// BreakerCooldown is how long the breaker stays open before a request is let through to
+	// check if the service has recovered.
+	BreakerCooldown time.Duration
+}
+
+// CircuitOpenError is returned instead of sending a request to a service whose circuit breaker is open
+type CircuitOpenError struct {
+	URL string
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker for %s is open", e.URL)
+}
+
+// WithServiceConfig returns an Option that configures the timeout, retries, and circuit breaker
+// of the service at the given url
+func WithServiceConfig(url string, config ServiceConfig) Option {
+	return func(g *Gateway) {
+		if g.serviceConfigs == nil {
+			g.serviceConfigs = map[string]ServiceConfig{}
+		}
+		g.serviceConfigs[url] = config
+	}
+}
+
+// WithDefaultServiceConfig returns an Option that configures the timeout, retries, and circuit
+// breaker of every service without its own config
+func WithDefaultServiceConfig(config ServiceConfig) Option {
+	return func(g *Gateway) {
+		g.defaultServiceConfig = &config
+	}
+}
+
+// serviceQueryerFactory wraps the queryers created by the factory so that they follow
+// the config of their service
+func serviceQueryerFactory(factory *QueryerFactory, defaults *ServiceConfig, configs map[string]ServiceConfig) *QueryerFactory {
+	// the breakers have to outlive the plans that hold onto the queryers
+	breakers := map[string]*circuitBreaker{}
+	breakersLock := &sync.Mutex{}
+
+	wrapped := QueryerFactory(func(ctx *PlanningContext, url string) graphql.Queryer {
+		// the queryer we would have used without a config
+		var queryer graphql.Queryer
+		if factory != nil {
+			queryer = (*factory)(ctx, url)
+		} else {
+			queryer = graphql.NewSingleRequestQueryer(url)
+		}
+
+		// the gateway doesn't need to protect itself from itself
+		if url == internalSchemaLocation {
+			return queryer
+		}
+
+		// find the config for the service
+		config, ok := configs[url]
+		if !ok {
+			if defaults == nil {
+				return queryer
+			}
+			config = *defaults
+		}
+
+		// find the breaker for the service
+		breakersLock.Lock()
+		breaker, ok := breakers[url]
+		if !ok {
+			breaker = &circuitBreaker{threshold: config.BreakerThreshold, cooldown: config.BreakerCooldown}
+			breakers[url] = breaker
+		}
+		breakersLock.Unlock()
+
+		return &serviceQueryer{
+			url:     url,
+			queryer: queryer,
+			config:  config,
+			breaker: breaker,
+		}
+	})
+
+	return &wrapped
+}
+
+// serviceQueryer applies a ServiceConfig to the requests sent by another queryer
+type serviceQueryer struct {
+	url     string
+	queryer graphql.Queryer
+	config  ServiceConfig
+	breaker *circuitBreaker
+}
+
+func (q *serviceQueryer) Query(ctx context.Context, input *graphql.QueryInput, receiver interface{}) error {
+	// only queries are safe to send more than once
+	attempts := 1
+	if serviceQueryIsIdempotent(input) {
+		attempts += q.config.Retries
+	}
+
+	backoff := q.config.RetryBackoff
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		// wait before trying again
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		err = q.query(ctx, input, receiver)
+		// there's no point in trying again for a client that has given up
+		if !serviceErrorIsRetryable(err) || ctx.Err() != nil {
+			return err
+		}
+	}
+
+	return err
+}
+
+// query sends a single request to the service
+func (q *serviceQueryer) query(ctx context.Context, input *graphql.QueryInput, receiver interface{}) error {
+	if !q.breaker.allow() {
+		return &CircuitOpenError{URL: q.url}
+	}
+
+	requestCtx := ctx
+	if q.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		requestCtx, cancel = context.WithTimeout(ctx, q.config.Timeout)
+		defer cancel()
+	}
+
+	err := q.queryer.Query(requestCtx, input, receiver)
+
+	// if the client gave up on the request, we didn't learn anything about the service. running
+	// out of our own timeout still counts against it
+	if err != nil && ctx.Err() != nil {
+		q.breaker.skip()
+		return err
+	}
+
+	// a graphql error means the service is up and said no
+	_, isGraphQLError := err.(graphql.ErrorList)
+	q.breaker.record(err == nil || isGraphQLError)
+
+	return err
+}
+
+// WithMiddlewares passes the middlewares on to the wrapped queryer
+func (q *serviceQueryer) WithMiddlewares(wares []graphql.NetworkMiddleware) graphql.Queryer {
+	inner, ok := q.queryer.(graphql.QueryerWithMiddlewares)
+	if !ok {
+		return q
+	}
+
+	return &serviceQueryer{
+		url:     q.url,
+		queryer: inner.WithMiddlewares(wares),
+		config:  q.config,
+		breaker: q.breaker,
+	}
+}
+
+// serviceQueryIsIdempotent returns true if the input can be sent more than once
+func serviceQueryIsIdempotent(input *graphql.QueryInput) bool {
+	if input.QueryDocument == nil {
+		return false
+	}
+
+	for _, operation := range input.QueryDocument.Operations {
+		if operation.Operation != ast.Query {
+			return false
+		}
+	}
+
+	return true
+}
+
+// serviceErrorIsRetryable returns true if sending the request again could succeed
+func serviceErrorIsRetryable(err error) bool {
+	switch err.(type) {
+	case nil, graphql.ErrorList, *CircuitOpenError:
+		return false
+	}
+
+	// a canceled request was canceled by the client
+	return !errors.Is(err, context.Canceled)
+}
+
+// circuitBreaker stops requests to a service after too many failures in a row
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	failures int
+	openedAt time.Time
+	// true while a request is checking if the service has recovered
+	probing bool
+	lock    sync.Mutex
+}
+
+// allow returns true if a request can be sent to the service
+func (b *circuitBreaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// the breaker is closed
+	if b.failures < b.threshold {
+		return true
+	}
+
+	// once the cooldown has passed, let a single request through
+	if !b.probing && time.Since(b.openedAt) >= b.cooldown {
+		b.probing = true
+		return true
+	}
+
+	return false
+}
+
+// skip lets another request check if the service has recovered without counting the result of this one
+func (b *circuitBreaker) skip() {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.probing = false
+}
+
+// record tracks the result of a request
+func (b *circuitBreaker) record(success bool) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.probing = false
+
+	if success {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openedAt = time.Now()
+	}
+}
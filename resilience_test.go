@@ -0,0 +1,202 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nautilus/graphql"
+	"github.com/stretchr/testify/assert"
+	"github.com/vektah/gqlparser/ast"
+)
+
+// countingQueryer counts the requests it receives and fails the first few
+type countingQueryer struct {
+	calls    int
+	failures int
+	err      error
+}
+
+func (q *countingQueryer) Query(ctx context.Context, input *graphql.QueryInput, receiver interface{}) error {
+	q.calls++
+	if q.calls <= q.failures {
+		return q.err
+	}
+
+	return nil
+}
+
+func testServiceQueryer(inner graphql.Queryer, config ServiceConfig) graphql.Queryer {
+	factory := QueryerFactory(func(ctx *PlanningContext, url string) graphql.Queryer {
+		return inner
+	})
+
+	return (*serviceQueryerFactory(&factory, &config, nil))(&PlanningContext{}, "url1")
+}
+
+func testServiceInput(operation ast.Operation) *graphql.QueryInput {
+	return &graphql.QueryInput{
+		QueryDocument: &ast.QueryDocument{
+			Operations: ast.OperationList{{Operation: operation}},
+		},
+	}
+}
+
+func TestServiceQueryer_timeout(t *testing.T) {
+	// a service that never responds
+	queryer := testServiceQueryer(&contextQueryer{}, ServiceConfig{Timeout: 10 * time.Millisecond})
+
+	start := time.Now()
+	err := queryer.Query(context.Background(), testServiceInput(ast.Query), &map[string]interface{}{})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+// contextQueryer waits for the context to be done before responding
+type contextQueryer struct{}
+
+func (q *contextQueryer) Query(ctx context.Context, input *graphql.QueryInput, receiver interface{}) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestServiceQueryer_retries(t *testing.T) {
+	testCases := []struct {
+		Message   string
+		Operation ast.Operation
+		Err       error
+		Calls     int
+		Succeeded bool
+	}{
+		{"queries are retried", ast.Query, errors.New("connection refused"), 3, true},
+		{"mutations are not retried", ast.Mutation, errors.New("connection refused"), 1, false},
+		{"graphql errors are not retried", ast.Query, graphql.ErrorList{errors.New("not allowed")}, 1, false},
+	}
+
+	for _, row := range testCases {
+		t.Run(row.Message, func(t *testing.T) {
+			inner := &countingQueryer{failures: 2, err: row.Err}
+			queryer := testServiceQueryer(inner, ServiceConfig{Retries: 2, RetryBackoff: time.Millisecond})
+
+			err := queryer.Query(context.Background(), testServiceInput(row.Operation), &map[string]interface{}{})
+			assert.Equal(t, row.Succeeded, err == nil)
+			assert.Equal(t, row.Calls, inner.calls)
+		})
+	}
+}
+
+func TestServiceQueryer_circuitBreaker(t *testing.T) {
+	inner := &countingQueryer{failures: 2, err: errors.New("connection refused")}
+	queryer := testServiceQueryer(inner, ServiceConfig{BreakerThreshold: 2, BreakerCooldown: 20 * time.Millisecond})
+	input := testServiceInput(ast.Query)
+
+	// the first failures go through to the service
+	assert.NotNil(t, queryer.Query(context.Background(), input, &map[string]interface{}{}))
+	assert.NotNil(t, queryer.Query(context.Background(), input, &map[string]interface{}{}))
+	assert.Equal(t, 2, inner.calls)
+
+	// after that, we fail without contacting the service
+	err := queryer.Query(context.Background(), input, &map[string]interface{}{})
+	if _, ok := err.(*CircuitOpenError); !ok {
+		t.Errorf("expected a CircuitOpenError, got %v", err)
+	}
+	assert.Equal(t, 2, inner.calls)
+
+	// once the cooldown has passed, a request is let through and closes the breaker
+	time.Sleep(30 * time.Millisecond)
+	assert.Nil(t, queryer.Query(context.Background(), input, &map[string]interface{}{}))
+	assert.Nil(t, queryer.Query(context.Background(), input, &map[string]interface{}{}))
+	assert.Equal(t, 4, inner.calls)
+}
+
+func TestServiceQueryer_canceledByClient(t *testing.T) {
+	// a service that never responds
+	inner := &contextQueryer{}
+	queryer := testServiceQueryer(inner, ServiceConfig{
+		Retries:          2,
+		RetryBackoff:     time.Millisecond,
+		BreakerThreshold: 1,
+		BreakerCooldown:  time.Hour,
+	})
+
+	// a client giving up isn't retried
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := queryer.Query(ctx, testServiceInput(ast.Query), &map[string]interface{}{})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < time.Second)
+
+	canceledCtx, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	assert.Equal(t, context.Canceled, queryer.Query(canceledCtx, testServiceInput(ast.Query), &map[string]interface{}{}))
+	assert.False(t, serviceErrorIsRetryable(context.Canceled))
+
+	// and doesn't open the breaker
+	breakerCtx, cancelBreaker := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelBreaker()
+	err = queryer.Query(breakerCtx, testServiceInput(ast.Query), &map[string]interface{}{})
+	if _, ok := err.(*CircuitOpenError); ok {
+		t.Error("the circuit breaker counted a request the client gave up on")
+	}
+}
+
+func TestGateway_serviceConfig(t *testing.T) {
+	schema, _ := graphql.LoadSchema(`
+		type Query {
+			posts: [Post]
+		}
+
+		type Post {
+			id: ID!
+			title: String!
+		}
+	`)
+
+	// the service fails once before responding
+	calls := 0
+	factory := QueryerFactory(func(ctx *PlanningContext, url string) graphql.Queryer {
+		return graphql.QueryerFunc(func(input *graphql.QueryInput) (interface{}, error) {
+			calls++
+			if calls == 1 {
+				return nil, errors.New("connection refused")
+			}
+
+			return map[string]interface{}{
+				"posts": []interface{}{
+					map[string]interface{}{"title": "hello"},
+				},
+			}, nil
+		})
+	})
+
+	gateway, err := New([]*graphql.RemoteSchema{{Schema: schema, URL: "posts"}},
+		WithQueryerFactory(&factory),
+		WithServiceConfig("posts", ServiceConfig{Retries: 1}),
+	)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	ctx := &RequestContext{
+		Context: context.Background(),
+		Query:   "{ posts { title } }",
+	}
+
+	plans, err := gateway.GetPlan(ctx)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	result, err := gateway.Execute(ctx, plans)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, map[string]interface{}{
+		"posts": []interface{}{
+			map[string]interface{}{"title": "hello"},
+		},
+	}, result)
+}
@@ -0,0 +1,723 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nautilus/graphql"
+	"github.com/vektah/gqlparser/ast"
+)
+
+// Subscriptions are handled over long-lived websocket connections. There are two protocols
+// in common use and the gateway speaks both of them, to its clients and to the services it wraps:
+//
+// graphql-ws:
+//		- the protocol defined by the subscriptions-transport-ws library
+//		- operations are started with "start", results come back as "data"
+//
+// graphql-transport-ws:
+//		- the protocol defined by the graphql-ws library
+//		- operations are started with "subscribe", results come back as "next"
+//		- the connection is closed if an operation is started before connection_init
+//
+// Subscriptions are planned like any other operation. The root step is sent to the service that
+// owns the subscription field and every event that comes back is treated as the response to that
+// step so that the dependent steps can fill in the fields owned by other services.
+
+// wsProtocol holds the message types that make up a particular websocket protocol
+type wsProtocol struct {
+	Name string
+
+	// sent by the client
+	Start     string
+	Stop      string
+	Terminate string
+
+	// sent by the server
+	Data     string
+	Error    string
+	Complete string
+
+	// sent by either side to keep the connection alive
+	Ping string
+	Pong string
+
+	// operations can only be started once the client has sent connection_init
+	RequiresInit bool
+}
+
+var (
+	protocolGraphQLWS = &wsProtocol{
+		Name:      "graphql-ws",
+		Start:     "start",
+		Stop:      "stop",
+		Terminate: "connection_terminate",
+		Data:      "data",
+		Error:     "error",
+		Complete:  "complete",
+	}
+
+	protocolGraphQLTransportWS = &wsProtocol{
+		Name:     "graphql-transport-ws",
+		Start:    "subscribe",
+		Stop:     "complete",
+		Data:     "next",
+		Error:    "error",
+		Complete: "complete",
+		Ping:     "ping",
+		Pong:     "pong",
+
+		RequiresInit: true,
+	}
+)
+
+// the messages that are shared by both protocols
+const (
+	wsMessageConnectionInit  = "connection_init"
+	wsMessageConnectionAck   = "connection_ack"
+	wsMessageConnectionError = "connection_error"
+)
+
+// the code graphql-transport-ws closes the connection with when an operation is started before connection_init
+const wsCloseUnauthorized = 4401
+
+// wsMessage is the envelope for every message sent over a websocket connection
+type wsMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// wsProtocolFor returns the protocol with the given name. graphql-ws is the default
+func wsProtocolFor(name string) *wsProtocol {
+	if name == protocolGraphQLTransportWS.Name {
+		return protocolGraphQLTransportWS
+	}
+
+	return protocolGraphQLWS
+}
+
+// Subscriber is responsible for opening a subscription against a remote service
+type Subscriber interface {
+	// Subscribe sends the query to the service and pushes the data of every event onto the channel.
+	// It blocks until the service closes the subscription or the context is cancelled.
+	Subscribe(ctx context.Context, input *graphql.QueryInput, events chan<- map[string]interface{}) error
+}
+
+// SubscriberWithMiddlewares is a subscriber that can apply request middlewares when it connects to a service
+type SubscriberWithMiddlewares interface {
+	WithMiddlewares(wares []graphql.NetworkMiddleware) Subscriber
+}
+
+// SubscriberFactory returns the subscriber to use when opening a subscription against the given url
+type SubscriberFactory func(url string) Subscriber
+
+// SubscriberFunc wraps a function to be used as a subscriber
+type SubscriberFunc func(ctx context.Context, input *graphql.QueryInput, events chan<- map[string]interface{}) error
+
+// Subscribe invokes the wrapped function
+func (s SubscriberFunc) Subscribe(ctx context.Context, input *graphql.QueryInput, events chan<- map[string]interface{}) error {
+	return s(ctx, input, events)
+}
+
+// Subscribe follows the plan for the named operation and sends a response over the channel for every event
+// that the subscription produces. Queries and mutations produce a single response. Subscribe returns once the
+// remote service closes the subscription or the request context is cancelled.
+func (g *Gateway) Subscribe(ctx *RequestContext, plans []*QueryPlan, responses chan<- map[string]interface{}) error {
+	// find the plan for the operation that the user asked for
+	plan, err := selectPlan(plans, ctx.OperationName)
+	if err != nil {
+		return err
+	}
+
+	// queries and mutations sent over a long-lived connection resolve to a single response
+	if plan.Operation == nil || plan.Operation.Operation != ast.Subscription {
+		result, err := g.executePlan(ctx, plan)
+		if err != nil && result == nil {
+			return err
+		}
+
+		responses <- subscriptionResponse(result, err)
+		return nil
+	}
+
+	// a subscription has a single root field which means a single root step
+	if len(plan.RootStep.Then) != 1 {
+		return errors.New("subscriptions must select exactly one root field")
+	}
+	root := plan.RootStep.Then[0]
+
+	// the subscriber we will use to talk to the service that owns the subscription
+	subscriber := g.subscriberFactory(root.URL)
+	if len(g.requestMiddlewares) > 0 {
+		if mSubscriber, ok := subscriber.(SubscriberWithMiddlewares); ok {
+			subscriber = mSubscriber.WithMiddlewares(g.requestMiddlewares)
+		}
+	}
+
+	// the root step only needs the variables that it uses
+	variables := map[string]interface{}{}
+	for variable := range root.Variables {
+		if value, ok := ctx.Variables[variable]; ok {
+			variables[variable] = value
+		}
+	}
+
+	// open the subscription in the background and turn every event into a response
+	events := make(chan map[string]interface{})
+	errCh := make(chan error, 1)
+	go func() {
+		defer close(events)
+
+		errCh <- subscriber.Subscribe(ctx.Context, &graphql.QueryInput{
+			Query:         root.QueryString,
+			QueryDocument: root.QueryDocument,
+			Variables:     variables,
+		}, events)
+	}()
+
+	for event := range events {
+		result, err := g.executePlan(ctx, subscriptionEventPlan(plan, root, event))
+		responses <- subscriptionResponse(result, err)
+	}
+
+	return <-errCh
+}
+
+// subscriptionResponse builds the payload for a single response, which could hold part of the data alongside errors
+func subscriptionResponse(result map[string]interface{}, err error) map[string]interface{} {
+	if err != nil {
+		return formatErrors(result, err)
+	}
+
+	return map[string]interface{}{"data": result}
+}
+
+// subscriptionEventPlan returns a copy of the plan whose root step resolves to the provided event instead
+// of sending a query to the service. This lets the executor treat every event like the response to a query
+// and kick off the steps that depend on it.
+func subscriptionEventPlan(plan *QueryPlan, root *QueryPlanStep, event map[string]interface{}) *QueryPlan {
+	// copy the root step so we don't modify the plan that is shared between requests
+	step := *root
+	step.Queryer = graphql.QueryerFunc(func(*graphql.QueryInput) (interface{}, error) {
+		return event, nil
+	})
+
+	eventPlan := *plan
+	eventPlan.RootStep = &QueryPlanStep{
+		Then: []*QueryPlanStep{&step},
+	}
+
+	return &eventPlan
+}
+
+// WithSubscriptionOrigins returns an Option that lets pages from the given origins (like
+// "https://app.example.com") open websocket connections with the gateway. Browsers send cookies
+// along with websocket requests from any site and CORS doesn't apply to them, so by default only
+// pages served from the same host as the gateway can connect. "*" allows every origin.
+func WithSubscriptionOrigins(origins ...string) Option {
+	return func(g *Gateway) {
+		g.subscriptionOrigins = append(g.subscriptionOrigins, origins...)
+	}
+}
+
+// checkOrigin returns true if the page that opened the websocket request is allowed to connect
+func (g *Gateway) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	// clients that aren't browsers don't send an origin and can't be tricked into sending cookies
+	if origin == "" {
+		return true
+	}
+
+	for _, allowed := range g.subscriptionOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+
+	parsed, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(parsed.Host, r.Host)
+}
+
+// SubscriptionHandler is a http.HandlerFunc that upgrades the request to a websocket connection and
+// executes the operations sent over it. GraphQLHandler and PlaygroundHandler defer to this handler
+// for websocket requests.
+func (g *Gateway) SubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{
+		Subprotocols: []string{protocolGraphQLTransportWS.Name, protocolGraphQLWS.Name},
+		CheckOrigin:  g.checkOrigin,
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has already responded to the client
+		g.logger.Warn("Encountered error upgrading connection: ", err.Error())
+		return
+	}
+
+	connection := &wsConnection{
+		gateway:    g,
+		conn:       conn,
+		protocol:   wsProtocolFor(conn.Subprotocol()),
+		operations: map[string]*wsOperation{},
+	}
+
+	connection.serve(r.Context())
+}
+
+// wsConnection holds the state of a single websocket connection with a client
+type wsConnection struct {
+	gateway  *Gateway
+	conn     *websocket.Conn
+	protocol *wsProtocol
+
+	// the websocket connection does not support concurrent writers
+	writeLock sync.Mutex
+
+	// the operations that are currently running, by id
+	operations     map[string]*wsOperation
+	operationsLock sync.Mutex
+
+	// set once the client has sent connection_init. only the serve loop touches it
+	initialized bool
+}
+
+// wsOperation is an operation running over a websocket connection. Clients can reuse the id of an
+// operation once it's done so the entry for an id has to be told apart from the ones before it.
+type wsOperation struct {
+	cancel context.CancelFunc
+}
+
+func (c *wsConnection) serve(ctx context.Context) {
+	// when the connection is closed we have to stop every operation
+	ctx, cancel := context.WithCancel(ctx)
+	operationsWg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		operationsWg.Wait()
+		c.conn.Close()
+	}()
+
+	for {
+		// wait for the next message from the client
+		message := &wsMessage{}
+		if err := c.conn.ReadJSON(message); err != nil {
+			return
+		}
+
+		switch {
+		case message.Type == wsMessageConnectionInit:
+			c.initialized = true
+			c.send(&wsMessage{Type: wsMessageConnectionAck})
+
+		case message.Type == c.protocol.Start:
+			// the client has to introduce itself before it can start anything
+			if c.protocol.RequiresInit && !c.initialized {
+				c.close(wsCloseUnauthorized, "Unauthorized")
+				return
+			}
+
+			// the payload of the message is the same as a http request
+			operation := &HTTPOperation{}
+			if err := json.Unmarshal(message.Payload, operation); err != nil {
+				c.sendError(message.ID, fmt.Errorf("encountered error parsing payload: %s", err.Error()))
+				continue
+			}
+
+			// every operation gets its own context so it can be stopped by the client
+			opCtx, opCancel := context.WithCancel(ctx)
+			op := &wsOperation{cancel: opCancel}
+			if !c.startOperation(message.ID, op) {
+				opCancel()
+				c.sendError(message.ID, fmt.Errorf("an operation with id %s is already running", message.ID))
+				continue
+			}
+
+			operationsWg.Add(1)
+			go func(id string) {
+				defer operationsWg.Done()
+				defer c.finishOperation(id, op)
+
+				c.execute(opCtx, id, operation)
+			}(message.ID)
+
+		case message.Type == c.protocol.Stop:
+			c.stopOperation(message.ID)
+
+		case c.protocol.Terminate != "" && message.Type == c.protocol.Terminate:
+			return
+
+		case c.protocol.Ping != "" && message.Type == c.protocol.Ping:
+			c.send(&wsMessage{Type: c.protocol.Pong})
+		}
+	}
+}
+
+// startOperation registers the operation with the connection. It returns false if there is
+// already an operation running with the same id
+func (c *wsConnection) startOperation(id string, op *wsOperation) bool {
+	c.operationsLock.Lock()
+	defer c.operationsLock.Unlock()
+
+	if _, ok := c.operations[id]; ok {
+		return false
+	}
+	c.operations[id] = op
+
+	return true
+}
+
+// stopOperation cancels the operation with the given id
+func (c *wsConnection) stopOperation(id string) {
+	c.operationsLock.Lock()
+	defer c.operationsLock.Unlock()
+
+	if op, ok := c.operations[id]; ok {
+		op.cancel()
+		delete(c.operations, id)
+	}
+}
+
+// finishOperation cleans up after the operation once it's done. If the client already stopped it
+// and started a new operation with the same id, the new one is left alone.
+func (c *wsConnection) finishOperation(id string, op *wsOperation) {
+	c.operationsLock.Lock()
+	defer c.operationsLock.Unlock()
+
+	op.cancel()
+	if c.operations[id] == op {
+		delete(c.operations, id)
+	}
+}
+
+// execute plans the operation and sends every response back to the client
+func (c *wsConnection) execute(ctx context.Context, id string, operation *HTTPOperation) {
+	// there might be a query plan cache key embedded in the operation
+	cacheKey := ""
+	if operation.Extensions.QueryPlanCache != nil {
+		cacheKey = operation.Extensions.QueryPlanCache.Hash
+	}
+
+	requestContext := &RequestContext{
+		Context:       ctx,
+		Query:         operation.Query,
+		OperationName: operation.OperationName,
+		Variables:     operation.Variables,
+		CacheKey:      cacheKey,
+	}
+
+	if err := operation.validatePersistedQuery(); err != nil {
+		c.sendError(id, err)
+		return
+	}
+
+	plans, err := c.gateway.GetPlan(requestContext)
+	if err != nil {
+		c.sendError(id, err)
+		return
+	}
+
+	// send every response to the client as it comes in
+	responses := make(chan map[string]interface{})
+	errCh := make(chan error, 1)
+	go func() {
+		defer close(responses)
+		errCh <- c.gateway.Subscribe(requestContext, plans, responses)
+	}()
+
+	for response := range responses {
+		payload, err := json.Marshal(response)
+		if err != nil {
+			c.sendError(id, err)
+			continue
+		}
+
+		c.send(&wsMessage{ID: id, Type: c.protocol.Data, Payload: payload})
+	}
+
+	// if the client stopped the operation there's nothing left to say
+	if ctx.Err() != nil {
+		return
+	}
+
+	if err := <-errCh; err != nil {
+		c.sendError(id, err)
+		return
+	}
+
+	c.send(&wsMessage{ID: id, Type: c.protocol.Complete})
+}
+
+func (c *wsConnection) send(message *wsMessage) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if err := c.conn.WriteJSON(message); err != nil {
+		c.gateway.logger.Warn("Encountered error writing to websocket: ", err.Error())
+	}
+}
+
+// close tells the client why the connection is being closed. The connection itself is closed when
+// the serve loop returns.
+func (c *wsConnection) close(code int, text string) {
+	message := websocket.FormatCloseMessage(code, text)
+	if err := c.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second)); err != nil {
+		c.gateway.logger.Warn("Encountered error closing websocket: ", err.Error())
+	}
+}
+
+func (c *wsConnection) sendError(id string, err error) {
+	// both protocols accept a list of errors as the payload
+	payload, marshalErr := json.Marshal(formatErrors(nil, err)["errors"])
+	if marshalErr != nil {
+		payload, _ = json.Marshal(formatErrors(nil, marshalErr)["errors"])
+	}
+
+	c.send(&wsMessage{ID: id, Type: c.protocol.Error, Payload: payload})
+}
+
+// wsDefaultAckTimeout is how long a WebSocketSubscriber waits for the service to acknowledge the
+// connection if it wasn't given a timeout of its own
+const wsDefaultAckTimeout = 10 * time.Second
+
+// WebSocketSubscriber opens subscriptions against a remote service over a websocket connection
+type WebSocketSubscriber struct {
+	URL string
+	// Protocol is the name of the websocket protocol to speak with the service (graphql-ws or graphql-transport-ws)
+	Protocol    string
+	Dialer      *websocket.Dialer
+	Middlewares []graphql.NetworkMiddleware
+	// AckTimeout is how long to wait for the service to acknowledge the connection. It defaults to 10 seconds.
+	AckTimeout time.Duration
+}
+
+// NewWebSocketSubscriber returns a WebSocketSubscriber pointed at the given url that speaks graphql-ws
+func NewWebSocketSubscriber(url string) *WebSocketSubscriber {
+	return &WebSocketSubscriber{
+		URL:      url,
+		Protocol: protocolGraphQLWS.Name,
+		Dialer:   websocket.DefaultDialer,
+	}
+}
+
+// WithMiddlewares returns a copy of the subscriber that applies the middlewares to the request that opens the connection
+func (s *WebSocketSubscriber) WithMiddlewares(wares []graphql.NetworkMiddleware) Subscriber {
+	return &WebSocketSubscriber{
+		URL:         s.URL,
+		Protocol:    s.Protocol,
+		Dialer:      s.Dialer,
+		Middlewares: wares,
+		AckTimeout:  s.AckTimeout,
+	}
+}
+
+// Subscribe opens a connection with the service, sends the query, and forwards the data of every event
+func (s *WebSocketSubscriber) Subscribe(ctx context.Context, input *graphql.QueryInput, events chan<- map[string]interface{}) error {
+	protocol := wsProtocolFor(s.Protocol)
+
+	// services are usually addressed by their http url so we have to point at the websocket equivalent
+	url := s.URL
+	if strings.HasPrefix(url, "http") {
+		url = "ws" + strings.TrimPrefix(url, "http")
+	}
+
+	// the request middlewares get a chance to modify the request that opens the connection
+	req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	for _, mware := range s.Middlewares {
+		if err := mware(req); err != nil {
+			return err
+		}
+	}
+	req.Header.Set("Sec-WebSocket-Protocol", protocol.Name)
+
+	dialer := s.Dialer
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+
+	conn, _, err := dialer.DialContext(ctx, url, req.Header)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// the connection does not support concurrent writers
+	writeLock := &sync.Mutex{}
+	write := func(message *wsMessage) error {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+
+		return conn.WriteJSON(message)
+	}
+
+	// the id of the operation we are going to start
+	id := "1"
+
+	// reading from the connection blocks so we have to close it in order to stop when the context is cancelled
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// let the service know we are no longer interested before we hang up
+			write(&wsMessage{ID: id, Type: protocol.Stop})
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	// initialize the connection
+	if err := write(&wsMessage{Type: wsMessageConnectionInit}); err != nil {
+		return err
+	}
+
+	// the service has to acknowledge the connection before we can start the operation
+	timeout := s.AckTimeout
+	if timeout == 0 {
+		timeout = wsDefaultAckTimeout
+	}
+	if err := wsAwaitAck(conn, protocol, timeout, write); err != nil {
+		// if we closed the connection then there's no error to report
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+
+	// start the operation
+	payload, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	if err := write(&wsMessage{ID: id, Type: protocol.Start, Payload: payload}); err != nil {
+		return err
+	}
+
+	for {
+		message := &wsMessage{}
+		if err := conn.ReadJSON(message); err != nil {
+			// if we closed the connection then there's no error to report
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		switch {
+		case message.Type == protocol.Data:
+			result := struct {
+				Data   map[string]interface{} `json:"data"`
+				Errors json.RawMessage        `json:"errors"`
+			}{}
+			if err := json.Unmarshal(message.Payload, &result); err != nil {
+				return err
+			}
+
+			// an event without any data is skipped unless it carries errors, which end the subscription
+			if result.Data == nil {
+				if err := wsPayloadErrors(result.Errors); err != nil {
+					return err
+				}
+				continue
+			}
+
+			select {
+			case events <- result.Data:
+			case <-ctx.Done():
+				return nil
+			}
+
+		case message.Type == protocol.Error, message.Type == wsMessageConnectionError:
+			if err := wsPayloadErrors(message.Payload); err != nil {
+				return err
+			}
+			return errors.New("encountered error in subscription")
+
+		case message.Type == protocol.Complete:
+			return nil
+
+		case protocol.Ping != "" && message.Type == protocol.Ping:
+			if err := write(&wsMessage{Type: protocol.Pong}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// wsAwaitAck waits for the service to acknowledge the connection. Anything the service sends before
+// the acknowledgement, other than pings and connection errors, is ignored.
+func wsAwaitAck(conn *websocket.Conn, protocol *wsProtocol, timeout time.Duration, write func(*wsMessage) error) error {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	for {
+		message := &wsMessage{}
+		if err := conn.ReadJSON(message); err != nil {
+			return fmt.Errorf("did not receive %s: %s", wsMessageConnectionAck, err.Error())
+		}
+
+		switch {
+		case message.Type == wsMessageConnectionAck:
+			// the rest of the subscription can take as long as it needs
+			return conn.SetReadDeadline(time.Time{})
+
+		case message.Type == wsMessageConnectionError:
+			if err := wsPayloadErrors(message.Payload); err != nil {
+				return err
+			}
+			return errors.New("service refused the connection")
+
+		case protocol.Ping != "" && message.Type == protocol.Ping:
+			if err := write(&wsMessage{Type: protocol.Pong}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// wsPayloadErrors turns the payload of an error message into an error. Services send either a single
+// error or a list of them.
+func wsPayloadErrors(payload json.RawMessage) error {
+	if len(payload) == 0 || string(payload) == "null" {
+		return nil
+	}
+
+	// try the list first
+	list := []*graphql.Error{}
+	if err := json.Unmarshal(payload, &list); err != nil {
+		// it could be a single error
+		single := &graphql.Error{}
+		if err := json.Unmarshal(payload, single); err != nil {
+			return fmt.Errorf("encountered invalid error payload: %s", string(payload))
+		}
+		list = append(list, single)
+	}
+
+	if len(list) == 0 {
+		return nil
+	}
+
+	errList := graphql.ErrorList{}
+	for _, err := range list {
+		errList = append(errList, err)
+	}
+
+	return errList
+}
@@ -0,0 +1,357 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nautilus/graphql"
+	"github.com/stretchr/testify/assert"
+)
+
+// subscriptionService returns a server that speaks graphql-ws and responds to every subscription with the events
+func subscriptionService(t *testing.T, events []map[string]interface{}) *httptest.Server {
+	upgrader := websocket.Upgrader{Subprotocols: []string{"graphql-ws"}}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		defer conn.Close()
+
+		for {
+			message := &wsMessage{}
+			if err := conn.ReadJSON(message); err != nil {
+				return
+			}
+
+			switch message.Type {
+			case "connection_init":
+				conn.WriteJSON(&wsMessage{Type: "connection_ack"})
+			case "start":
+				for _, event := range events {
+					payload, _ := json.Marshal(map[string]interface{}{"data": event})
+					conn.WriteJSON(&wsMessage{ID: message.ID, Type: "data", Payload: payload})
+				}
+				conn.WriteJSON(&wsMessage{ID: message.ID, Type: "complete"})
+			}
+		}
+	}))
+}
+
+func TestGateway_subscription(t *testing.T) {
+	// the service that owns the subscription sends two events
+	service := subscriptionService(t, []map[string]interface{}{
+		{"postAdded": map[string]interface{}{"id": "1", "title": "hello"}},
+		{"postAdded": map[string]interface{}{"id": "2", "title": "world"}},
+	})
+	defer service.Close()
+
+	postSchema, _ := graphql.LoadSchema(`
+		type Post {
+			id: ID!
+			title: String!
+		}
+
+		type Subscription {
+			postAdded: Post!
+		}
+	`)
+	ratingSchema, _ := graphql.LoadSchema(`
+		type Post {
+			id: ID!
+			rating: Int!
+		}
+	`)
+
+	// the rating service looks up posts by id
+	factory := QueryerFactory(func(ctx *PlanningContext, url string) graphql.Queryer {
+		return graphql.QueryerFunc(func(input *graphql.QueryInput) (interface{}, error) {
+			rating := 1
+			if input.Variables["id"] == "2" {
+				rating = 2
+			}
+
+			return map[string]interface{}{"node": map[string]interface{}{"rating": rating}}, nil
+		})
+	})
+
+	gateway, err := New([]*graphql.RemoteSchema{
+		{Schema: postSchema, URL: service.URL},
+		{Schema: ratingSchema, URL: "ratings"},
+	}, WithQueryerFactory(&factory))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(gateway.GraphQLHandler))
+	defer server.Close()
+
+	// open a connection with the gateway using graphql-transport-ws
+	dialer := &websocket.Dialer{Subprotocols: []string{"graphql-transport-ws"}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+	assert.Equal(t, "graphql-transport-ws", conn.Subprotocol())
+
+	// initialize the connection
+	if !assert.Nil(t, conn.WriteJSON(&wsMessage{Type: "connection_init"})) {
+		return
+	}
+	ack := &wsMessage{}
+	if !assert.Nil(t, conn.ReadJSON(ack)) {
+		return
+	}
+	assert.Equal(t, "connection_ack", ack.Type)
+
+	// start the subscription
+	payload, _ := json.Marshal(map[string]interface{}{"query": "subscription { postAdded { title rating } }"})
+	if !assert.Nil(t, conn.WriteJSON(&wsMessage{ID: "1", Type: "subscribe", Payload: payload})) {
+		return
+	}
+
+	// every event should come back with the fields from both services
+	for _, expected := range []string{
+		`{"data":{"postAdded":{"rating":1,"title":"hello"}}}`,
+		`{"data":{"postAdded":{"rating":2,"title":"world"}}}`,
+	} {
+		message := &wsMessage{}
+		if !assert.Nil(t, conn.ReadJSON(message)) {
+			return
+		}
+
+		assert.Equal(t, "1", message.ID)
+		assert.Equal(t, "next", message.Type)
+		assert.JSONEq(t, expected, string(message.Payload))
+	}
+
+	// the subscription is over once the service completes it
+	message := &wsMessage{}
+	if !assert.Nil(t, conn.ReadJSON(message)) {
+		return
+	}
+	assert.Equal(t, "1", message.ID)
+	assert.Equal(t, "complete", message.Type)
+}
+
+func TestGateway_subscriptionStop(t *testing.T) {
+	stopped := make(chan string, 1)
+
+	// a subscriber that waits until the subscription is cancelled
+	subscriber := SubscriberFunc(func(ctx context.Context, input *graphql.QueryInput, events chan<- map[string]interface{}) error {
+		events <- map[string]interface{}{"postAdded": map[string]interface{}{"title": "hello"}}
+		<-ctx.Done()
+		stopped <- input.Query
+		return nil
+	})
+
+	schema, _ := graphql.LoadSchema(`
+		type Post {
+			title: String!
+		}
+
+		type Subscription {
+			postAdded: Post!
+		}
+	`)
+
+	gateway, err := New([]*graphql.RemoteSchema{{Schema: schema, URL: "url1"}}, WithSubscriberFactory(func(url string) Subscriber {
+		return subscriber
+	}))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(gateway.GraphQLHandler))
+	defer server.Close()
+
+	// open a connection with the gateway using the default protocol
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	payload, _ := json.Marshal(map[string]interface{}{"query": "subscription { postAdded { title } }"})
+	if !assert.Nil(t, conn.WriteJSON(&wsMessage{ID: "1", Type: "start", Payload: payload})) {
+		return
+	}
+
+	message := &wsMessage{}
+	if !assert.Nil(t, conn.ReadJSON(message)) {
+		return
+	}
+	assert.Equal(t, "data", message.Type)
+	assert.JSONEq(t, `{"data":{"postAdded":{"title":"hello"}}}`, string(message.Payload))
+
+	// stopping the operation should cancel the subscription with the service
+	if !assert.Nil(t, conn.WriteJSON(&wsMessage{ID: "1", Type: "stop"})) {
+		return
+	}
+	assert.Contains(t, <-stopped, "postAdded")
+}
+
+func TestGateway_subscriptionBeforeInit(t *testing.T) {
+	schema, _ := graphql.LoadSchema(`
+		type Post {
+			title: String!
+		}
+
+		type Subscription {
+			postAdded: Post!
+		}
+	`)
+
+	gateway, err := New([]*graphql.RemoteSchema{{Schema: schema, URL: "url1"}}, WithSubscriberFactory(func(url string) Subscriber {
+		return SubscriberFunc(func(ctx context.Context, input *graphql.QueryInput, events chan<- map[string]interface{}) error {
+			t.Error("the subscription should not have been opened")
+			return nil
+		})
+	}))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(gateway.SubscriptionHandler))
+	defer server.Close()
+
+	dialer := &websocket.Dialer{Subprotocols: []string{"graphql-transport-ws"}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	// subscribe without sending connection_init first
+	payload, _ := json.Marshal(map[string]interface{}{"query": "subscription { postAdded { title } }"})
+	if !assert.Nil(t, conn.WriteJSON(&wsMessage{ID: "1", Type: "subscribe", Payload: payload})) {
+		return
+	}
+
+	// the gateway should hang up on us
+	err = conn.ReadJSON(&wsMessage{})
+	closeErr, ok := err.(*websocket.CloseError)
+	if !assert.True(t, ok, "connection was not closed") {
+		return
+	}
+	assert.Equal(t, 4401, closeErr.Code)
+	assert.Equal(t, "Unauthorized", closeErr.Text)
+}
+
+func TestGateway_subscriptionOrigin(t *testing.T) {
+	schema, _ := graphql.LoadSchema(`
+		type Query {
+			hello: String
+		}
+	`)
+
+	gateway, err := New([]*graphql.RemoteSchema{{Schema: schema, URL: "url1"}}, WithSubscriptionOrigins("https://app.example.com"))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(gateway.SubscriptionHandler))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	for origin, allowed := range map[string]bool{
+		// clients that aren't browsers
+		"": true,
+		// pages served by the gateway
+		server.URL: true,
+		// pages from the origins we were told about
+		"https://app.example.com": true,
+		// any other site
+		"https://evil.example.com": false,
+	} {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+
+		conn, _, err := websocket.DefaultDialer.Dial(url, header)
+		if allowed {
+			if assert.Nil(t, err, origin) {
+				conn.Close()
+			}
+		} else {
+			assert.Equal(t, websocket.ErrBadHandshake, err, origin)
+		}
+	}
+}
+
+func TestWebSocketSubscriber_waitsForAck(t *testing.T) {
+	upgrader := websocket.Upgrader{Subprotocols: []string{"graphql-transport-ws"}}
+
+	// a service that takes its time to acknowledge the connection and hangs up on anyone who doesn't wait
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		defer conn.Close()
+
+		acked := false
+		for {
+			message := &wsMessage{}
+			if err := conn.ReadJSON(message); err != nil {
+				return
+			}
+
+			switch message.Type {
+			case "connection_init":
+				time.Sleep(50 * time.Millisecond)
+				conn.WriteJSON(&wsMessage{Type: "connection_ack"})
+				acked = true
+			case "subscribe":
+				if !acked {
+					conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4401, "Unauthorized"))
+					return
+				}
+				payload, _ := json.Marshal(map[string]interface{}{"data": map[string]interface{}{"hello": "world"}})
+				conn.WriteJSON(&wsMessage{ID: message.ID, Type: "next", Payload: payload})
+				conn.WriteJSON(&wsMessage{ID: message.ID, Type: "complete"})
+			}
+		}
+	}))
+	defer service.Close()
+
+	subscriber := &WebSocketSubscriber{URL: service.URL, Protocol: "graphql-transport-ws"}
+
+	events := make(chan map[string]interface{}, 1)
+	err := subscriber.Subscribe(context.Background(), &graphql.QueryInput{Query: "subscription { hello }"}, events)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, map[string]interface{}{"hello": "world"}, <-events)
+}
+
+func TestWsConnection_reusedOperationID(t *testing.T) {
+	connection := &wsConnection{operations: map[string]*wsOperation{}}
+
+	// the client stops the first operation and starts another with the same id before the first is done
+	first, firstCancel := context.WithCancel(context.Background())
+	firstOp := &wsOperation{cancel: firstCancel}
+	assert.True(t, connection.startOperation("1", firstOp))
+	connection.stopOperation("1")
+
+	second, secondCancel := context.WithCancel(context.Background())
+	secondOp := &wsOperation{cancel: secondCancel}
+	assert.True(t, connection.startOperation("1", secondOp))
+
+	// cleaning up after the first operation leaves the second one running
+	connection.finishOperation("1", firstOp)
+	assert.NotNil(t, first.Err())
+	assert.Nil(t, second.Err())
+	assert.Equal(t, secondOp, connection.operations["1"])
+}
@@ -0,0 +1,311 @@
+package gateway
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nautilus/graphql"
+)
+
+// the names of the spans recorded in a Trace
+const (
+	// TraceSpanRequest covers the entire request
+	TraceSpanRequest = "request"
+	// TraceSpanParsing covers parsing and validating the query. It is only recorded when the plan isn't cached.
+	TraceSpanParsing = "parsing"
+	// TraceSpanPlanning covers retrieving the plan for the query, including the time spent parsing it
+	TraceSpanPlanning = "planning"
+	// TraceSpanStep covers a single request sent to a service while executing the plan
+	TraceSpanStep = "step"
+	// TraceSpanMiddlewares covers the response middlewares
+	TraceSpanMiddlewares = "middlewares"
+)
+
+// TraceSpan is a timed section of a request. The ids follow the W3C trace context format so
+// the spans can be forwarded to OpenTelemetry and connected to the spans of the services.
+type TraceSpan struct {
+	Name      string
+	StartTime time.Time
+	EndTime   time.Time
+
+	// TraceID is shared by every span of the request
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	// TraceFlags are the flags of the trace, 01 means it's sampled
+	TraceFlags string
+
+	// the following are only set for steps
+	ServiceURL     string
+	ParentType     string
+	InsertionPoint []string
+	// Path is where the result of the step ends up in the response
+	Path []interface{}
+	Err  error
+}
+
+// TraceHook is called with every span of a traced request as soon as it ends. The context is
+// the one the request was made with.
+type TraceHook func(ctx context.Context, span *TraceSpan)
+
+// SpanExporter receives every span of a traced request as soon as it ends
+type SpanExporter interface {
+	ExportSpan(ctx context.Context, span *TraceSpan)
+}
+
+// InMemorySpanExporter holds onto the spans it's given. It's meant for tests.
+type InMemorySpanExporter struct {
+	spans []*TraceSpan
+	lock  sync.Mutex
+}
+
+// ExportSpan saves the span
+func (e *InMemorySpanExporter) ExportSpan(ctx context.Context, span *TraceSpan) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.spans = append(e.spans, span)
+}
+
+// Spans returns the spans that have been exported
+func (e *InMemorySpanExporter) Spans() []*TraceSpan {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return append([]*TraceSpan{}, e.spans...)
+}
+
+// Reset drops the spans that have been exported
+func (e *InMemorySpanExporter) Reset() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.spans = nil
+}
+
+// Trace records how long each phase of a request took. All of the methods are safe to call
+// on a nil Trace so requests that aren't traced don't have to check.
+type Trace struct {
+	StartTime time.Time
+	EndTime   time.Time
+
+	ctx     context.Context
+	hooks   []TraceHook
+	request *TraceSpan
+	spans   []*TraceSpan
+	lock    sync.Mutex
+}
+
+// NewTrace starts a trace of a request made with the given context. The hooks are called with
+// every span as soon as it ends.
+func NewTrace(ctx context.Context, hooks ...TraceHook) *Trace {
+	start := time.Now()
+
+	return &Trace{
+		StartTime: start,
+		ctx:       ctx,
+		hooks:     hooks,
+		request: &TraceSpan{
+			Name:       TraceSpanRequest,
+			StartTime:  start,
+			TraceID:    traceRandomID(16),
+			SpanID:     traceRandomID(8),
+			TraceFlags: "01",
+		},
+	}
+}
+
+// WithTracing returns an Option that adds timings of the request to the response in
+// extensions.tracing, following the Apollo tracing format
+func WithTracing() Option {
+	return func(g *Gateway) {
+		g.tracing = true
+	}
+}
+
+// WithTraceHook returns an Option that calls the hook with every span of every request
+// the gateway handles. Use this to forward the spans to your own tracing system.
+func WithTraceHook(hook TraceHook) Option {
+	return func(g *Gateway) {
+		g.traceHooks = append(g.traceHooks, hook)
+	}
+}
+
+// WithSpanExporter returns an Option that sends every span of every request the gateway handles
+// to the exporter. Requests to the services carry a traceparent header pointing to the span of
+// their step and requests to the gateway with a traceparent header continue the caller's trace.
+func WithSpanExporter(exporter SpanExporter) Option {
+	return WithTraceHook(exporter.ExportSpan)
+}
+
+// TraceParent returns the W3C traceparent header that points to the span
+func (span *TraceSpan) TraceParent() string {
+	return fmt.Sprintf("00-%s-%s-%s", span.TraceID, span.SpanID, span.TraceFlags)
+}
+
+// traceParentMiddleware returns a request middleware that points the request to the span
+func (span *TraceSpan) traceParentMiddleware() graphql.NetworkMiddleware {
+	return func(r *http.Request) error {
+		r.Header.Set("traceparent", span.TraceParent())
+		return nil
+	}
+}
+
+// continueFrom makes the trace part of the trace in the W3C traceparent header. Invalid
+// headers are ignored and the trace starts from scratch.
+func (t *Trace) continueFrom(traceParent string) {
+	if t == nil {
+		return
+	}
+
+	// version-traceid-parentid-flags
+	parts := strings.Split(strings.TrimSpace(traceParent), "-")
+	if len(parts) < 4 || !traceValidID(parts[1], 16) || !traceValidID(parts[2], 8) || !traceValidID(parts[3], 1) {
+		return
+	}
+
+	t.request.TraceID = parts[1]
+	t.request.ParentSpanID = parts[2]
+	t.request.TraceFlags = parts[3]
+}
+
+// traceRandomID returns a random hex id of the given number of bytes
+func traceRandomID(size int) string {
+	id := make([]byte, size)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// traceValidID returns true if the id is a non-zero hex id of the given number of bytes
+func traceValidID(id string, size int) bool {
+	decoded, err := hex.DecodeString(id)
+	if err != nil || len(decoded) != size || id != strings.ToLower(id) {
+		return false
+	}
+
+	// ids of all zeros are invalid but the flags can be 00
+	if size == 1 {
+		return true
+	}
+	return strings.Trim(id, "0") != ""
+}
+
+// Spans returns the spans that have ended so far
+func (t *Trace) Spans() []*TraceSpan {
+	if t == nil {
+		return nil
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return append([]*TraceSpan{}, t.spans...)
+}
+
+// startSpan starts timing a section of the request
+func (t *Trace) startSpan(name string) *TraceSpan {
+	if t == nil {
+		return nil
+	}
+
+	return &TraceSpan{
+		Name:         name,
+		StartTime:    time.Now(),
+		TraceID:      t.request.TraceID,
+		SpanID:       traceRandomID(8),
+		ParentSpanID: t.request.SpanID,
+		TraceFlags:   t.request.TraceFlags,
+	}
+}
+
+// startStep starts timing the request for a step of the plan
+func (t *Trace) startStep(step *QueryPlanStep, insertionPoint []string) *TraceSpan {
+	span := t.startSpan(TraceSpanStep)
+	if span == nil {
+		return nil
+	}
+
+	span.ServiceURL = step.URL
+	span.ParentType = step.ParentType
+	span.InsertionPoint = insertionPoint
+	span.Path = executorResponsePath(insertionPoint)
+	if fields := executorStepFields(step); len(fields) > 0 {
+		span.Path = append(span.Path, fields[0])
+	}
+
+	return span
+}
+
+// finishSpan records the end of the span and passes it to the hooks
+func (t *Trace) finishSpan(span *TraceSpan, err error) {
+	if t == nil || span == nil {
+		return
+	}
+
+	span.EndTime = time.Now()
+	span.Err = err
+
+	t.lock.Lock()
+	t.spans = append(t.spans, span)
+	t.lock.Unlock()
+
+	for _, hook := range t.hooks {
+		hook(t.ctx, span)
+	}
+}
+
+// finish records the end of the request
+func (t *Trace) finish() {
+	if t == nil {
+		return
+	}
+
+	t.finishSpan(t.request, nil)
+	t.EndTime = t.request.EndTime
+}
+
+// Extension returns the trace in the Apollo tracing format. Each step is reported as a resolver
+// for the first field it was responsible for and the planning phase and the response
+// middlewares are reported next to parsing.
+func (t *Trace) Extension() map[string]interface{} {
+	if t == nil {
+		return nil
+	}
+
+	extension := map[string]interface{}{
+		"version":   1,
+		"startTime": t.StartTime.UTC().Format(time.RFC3339Nano),
+		"endTime":   t.EndTime.UTC().Format(time.RFC3339Nano),
+		"duration":  t.EndTime.Sub(t.StartTime).Nanoseconds(),
+	}
+
+	resolvers := []map[string]interface{}{}
+	for _, span := range t.Spans() {
+		timing := map[string]interface{}{
+			"startOffset": span.StartTime.Sub(t.StartTime).Nanoseconds(),
+			"duration":    span.EndTime.Sub(span.StartTime).Nanoseconds(),
+		}
+
+		switch span.Name {
+		case TraceSpanParsing, TraceSpanPlanning, TraceSpanMiddlewares:
+			extension[span.Name] = timing
+		case TraceSpanStep:
+			timing["path"] = span.Path
+			timing["parentType"] = span.ParentType
+			timing["serviceURL"] = span.ServiceURL
+			if len(span.Path) > 0 {
+				timing["fieldName"] = span.Path[len(span.Path)-1]
+			}
+			resolvers = append(resolvers, timing)
+		}
+	}
+	extension["execution"] = map[string]interface{}{"resolvers": resolvers}
+
+	return extension
+}
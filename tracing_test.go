@@ -0,0 +1,273 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nautilus/graphql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGraphQLHandler_tracing(t *testing.T) {
+	// collect the spans that are sent to the hook
+	spans := []*TraceSpan{}
+	spansLock := &sync.Mutex{}
+
+	gateway := inspectTestGateway(t,
+		WithTracing(),
+		WithTraceHook(func(ctx context.Context, span *TraceSpan) {
+			spansLock.Lock()
+			defer spansLock.Unlock()
+
+			spans = append(spans, span)
+		}),
+	)
+
+	request := httptest.NewRequest("POST", "/graphql", strings.NewReader(`{"query": "{ posts { title rating } }"}`))
+	responseRecorder := httptest.NewRecorder()
+
+	gateway.GraphQLHandler(responseRecorder, request)
+	assert.Equal(t, http.StatusOK, responseRecorder.Result().StatusCode)
+
+	response := struct {
+		Extensions struct {
+			Tracing struct {
+				Version     int                    `json:"version"`
+				StartTime   string                 `json:"startTime"`
+				EndTime     string                 `json:"endTime"`
+				Duration    int64                  `json:"duration"`
+				Parsing     map[string]interface{} `json:"parsing"`
+				Planning    map[string]interface{} `json:"planning"`
+				Middlewares map[string]interface{} `json:"middlewares"`
+				Execution   struct {
+					Resolvers []map[string]interface{} `json:"resolvers"`
+				} `json:"execution"`
+			} `json:"tracing"`
+		} `json:"extensions"`
+	}{}
+	if !assert.Nil(t, json.NewDecoder(responseRecorder.Body).Decode(&response)) {
+		return
+	}
+	tracing := response.Extensions.Tracing
+
+	assert.Equal(t, 1, tracing.Version)
+	assert.NotEmpty(t, tracing.StartTime)
+	assert.NotEmpty(t, tracing.EndTime)
+	assert.True(t, tracing.Duration > 0)
+	assert.NotNil(t, tracing.Parsing["duration"])
+	assert.NotNil(t, tracing.Planning["duration"])
+	assert.NotNil(t, tracing.Middlewares["duration"])
+
+	// there should be a resolver for each step
+	resolvers := map[string]map[string]interface{}{}
+	for _, resolver := range tracing.Execution.Resolvers {
+		resolvers[resolver["serviceURL"].(string)] = resolver
+	}
+	if !assert.Len(t, resolvers, 2) {
+		return
+	}
+	assert.Equal(t, []interface{}{"posts"}, resolvers["posts"]["path"])
+	assert.Equal(t, "Query", resolvers["posts"]["parentType"])
+	assert.Equal(t, []interface{}{"posts", float64(0), "rating"}, resolvers["reviews"]["path"])
+	assert.Equal(t, "Post", resolvers["reviews"]["parentType"])
+	assert.Equal(t, "rating", resolvers["reviews"]["fieldName"])
+
+	// the hook should have seen every span
+	names := []string{}
+	for _, span := range spans {
+		names = append(names, span.Name)
+	}
+	assert.ElementsMatch(t, []string{
+		TraceSpanParsing,
+		TraceSpanPlanning,
+		TraceSpanStep,
+		TraceSpanStep,
+		TraceSpanMiddlewares,
+		TraceSpanRequest,
+	}, names)
+}
+
+func TestGraphQLHandler_tracingEarlyExits(t *testing.T) {
+	// count the request spans that are sent to the hook
+	requests := 0
+	gateway := inspectTestGateway(t,
+		WithTraceHook(func(ctx context.Context, span *TraceSpan) {
+			if span.Name == TraceSpanRequest {
+				requests++
+			}
+		}),
+	)
+
+	// operations that never get planned still finish their trace
+	bodies := []string{
+		`{"query": ""}`,
+		`{"query": "{ posts { title } }", "extensions": {"persistedQuery": {"version": 1, "sha256Hash": "nope"}}}`,
+	}
+	for _, body := range bodies {
+		request := httptest.NewRequest("POST", "/graphql", strings.NewReader(body))
+		gateway.GraphQLHandler(httptest.NewRecorder(), request)
+	}
+
+	assert.Equal(t, len(bodies), requests)
+}
+
+func TestGraphQLHandler_tracingDisabled(t *testing.T) {
+	gateway := inspectTestGateway(t)
+
+	request := httptest.NewRequest("POST", "/graphql", strings.NewReader(`{"query": "{ posts { title rating } }"}`))
+	responseRecorder := httptest.NewRecorder()
+
+	gateway.GraphQLHandler(responseRecorder, request)
+
+	response := map[string]interface{}{}
+	if !assert.Nil(t, json.NewDecoder(responseRecorder.Body).Decode(&response)) {
+		return
+	}
+	assert.Nil(t, response["extensions"])
+}
+
+func TestTrace_nil(t *testing.T) {
+	// requests that aren't traced shouldn't have to check
+	var trace *Trace
+
+	span := trace.startSpan(TraceSpanPlanning)
+	trace.finishSpan(span, nil)
+	trace.finish()
+
+	assert.Nil(t, span)
+	assert.Nil(t, trace.Spans())
+	assert.Nil(t, trace.Extension())
+}
+
+// traceParentQueryer records the traceparent header that the middlewares put on the request
+type traceParentQueryer struct {
+	response    map[string]interface{}
+	middlewares []graphql.NetworkMiddleware
+	record      func(traceParent string)
+}
+
+func (q *traceParentQueryer) Query(ctx context.Context, input *graphql.QueryInput, receiver interface{}) error {
+	request := httptest.NewRequest("POST", "/graphql", nil)
+	for _, middleware := range q.middlewares {
+		if err := middleware(request); err != nil {
+			return err
+		}
+	}
+	q.record(request.Header.Get("traceparent"))
+
+	return (&graphql.MockSuccessQueryer{q.response}).Query(ctx, input, receiver)
+}
+
+func (q *traceParentQueryer) WithMiddlewares(middlewares []graphql.NetworkMiddleware) graphql.Queryer {
+	return &traceParentQueryer{response: q.response, middlewares: middlewares, record: q.record}
+}
+
+func TestGraphQLHandler_traceContext(t *testing.T) {
+	// the trace parent of every request sent to the services
+	traceParents := []string{}
+	traceParentsLock := &sync.Mutex{}
+	record := func(traceParent string) {
+		traceParentsLock.Lock()
+		defer traceParentsLock.Unlock()
+
+		traceParents = append(traceParents, traceParent)
+	}
+
+	factory := QueryerFactory(func(ctx *PlanningContext, url string) graphql.Queryer {
+		if url == "reviews" {
+			return &traceParentQueryer{record: record, response: map[string]interface{}{
+				"node": map[string]interface{}{"rating": 5},
+			}}
+		}
+
+		return &traceParentQueryer{record: record, response: map[string]interface{}{
+			"posts": []interface{}{
+				map[string]interface{}{"id": "1", "title": "hello"},
+			},
+		}}
+	})
+
+	exporter := &InMemorySpanExporter{}
+	gateway := inspectTestGateway(t, WithQueryerFactory(&factory), WithSpanExporter(exporter))
+
+	// the caller is part of a trace
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	callerSpanID := "00f067aa0ba902b7"
+
+	request := httptest.NewRequest("POST", "/graphql", strings.NewReader(`{"query": "{ posts { title rating } }"}`))
+	request.Header.Set("traceparent", "00-"+traceID+"-"+callerSpanID+"-01")
+	responseRecorder := httptest.NewRecorder()
+
+	gateway.GraphQLHandler(responseRecorder, request)
+	assert.Equal(t, http.StatusOK, responseRecorder.Result().StatusCode)
+
+	spans := exporter.Spans()
+	if !assert.Len(t, spans, 6) {
+		return
+	}
+
+	// find the span for the request
+	var requestSpan *TraceSpan
+	for _, span := range spans {
+		if span.Name == TraceSpanRequest {
+			requestSpan = span
+		}
+	}
+	if !assert.NotNil(t, requestSpan) {
+		return
+	}
+	assert.Equal(t, callerSpanID, requestSpan.ParentSpanID)
+
+	// every span is part of the caller's trace and a child of the request
+	expectedTraceParents := []string{}
+	for _, span := range spans {
+		assert.Equal(t, traceID, span.TraceID)
+		assert.Len(t, span.SpanID, 16)
+
+		if span.Name != TraceSpanRequest {
+			assert.Equal(t, requestSpan.SpanID, span.ParentSpanID)
+		}
+		if span.Name == TraceSpanStep {
+			expectedTraceParents = append(expectedTraceParents, span.TraceParent())
+		}
+	}
+
+	// the services were told about the span of their step
+	assert.ElementsMatch(t, expectedTraceParents, traceParents)
+}
+
+func TestTrace_continueFrom(t *testing.T) {
+	testCases := []struct {
+		Message     string
+		TraceParent string
+		Continued   bool
+	}{
+		{"valid", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"missing", "", false},
+		{"too short", "00-4bf92f3577b34da6a3ce929d0e0e4736-01", false},
+		{"bad trace id", "00-4bf92f3577b34da6-00f067aa0ba902b7-01", false},
+		{"zero trace id", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"zero span id", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"upper case", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00F067AA0BA902B7-01", false},
+	}
+
+	for _, row := range testCases {
+		t.Run(row.Message, func(t *testing.T) {
+			trace := NewTrace(context.Background())
+			trace.continueFrom(row.TraceParent)
+
+			if row.Continued {
+				assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", trace.request.TraceID)
+				assert.Equal(t, "00f067aa0ba902b7", trace.request.ParentSpanID)
+			} else {
+				assert.Len(t, trace.request.TraceID, 32)
+				assert.Equal(t, "", trace.request.ParentSpanID)
+			}
+		})
+	}
+}
@@ -0,0 +1,507 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/nautilus/graphql"
+)
+
+// the default limits on the files sent in a multipart request
+const (
+	DefaultMaxUploadFiles = 10
+	DefaultMaxUploadSize  = 32 << 20
+)
+
+// UploadConfig enables multipart requests and bounds the files that can be sent to the gateway in
+// them. Zero values mean the default.
+type UploadConfig struct {
+	// MaxFiles is the number of files a single request can send
+	MaxFiles int
+	// MaxFileSize is the size in bytes of the largest file a request can send
+	MaxFileSize int64
+	// Client sends the files on to the services. It should be the client the queryers of the gateway
+	// use since queries with files are sent with it instead. http.DefaultClient is used if it's nil.
+	Client *http.Client
+}
+
+// WithUploads returns an Option that lets clients send files to the gateway with multipart requests.
+// Browsers can send multipart forms to any site so the requests also have to set the
+// Apollo-Require-Preflight or X-Requested-With header, which forms can't.
+func WithUploads(config UploadConfig) Option {
+	return func(g *Gateway) {
+		g.uploads = &config
+	}
+}
+
+func (l UploadConfig) maxFiles() int {
+	if l.MaxFiles <= 0 {
+		return DefaultMaxUploadFiles
+	}
+	return l.MaxFiles
+}
+
+func (l UploadConfig) maxFileSize() int64 {
+	if l.MaxFileSize <= 0 {
+		return DefaultMaxUploadSize
+	}
+	return l.MaxFileSize
+}
+
+func (l UploadConfig) client() *http.Client {
+	if l.Client == nil {
+		return http.DefaultClient
+	}
+	return l.Client
+}
+
+// Upload is the value of a variable that holds a file sent in a multipart request. The contents are
+// kept in a temporary file until the request is done. Uploads are sent to the services as null in
+// JSON payloads so the service that owns the field has to be sent a multipart request of its own.
+type Upload struct {
+	Filename    string
+	ContentType string
+	Size        int64
+
+	file *os.File
+}
+
+// Open returns a reader for the contents of the file. Each reader starts at the beginning of the
+// file so the same upload can be sent more than once.
+func (u *Upload) Open() io.Reader {
+	return io.NewSectionReader(u.file, 0, u.Size)
+}
+
+// MarshalJSON leaves the contents of the file out of JSON payloads
+func (u *Upload) MarshalJSON() ([]byte, error) {
+	return []byte("null"), nil
+}
+
+// close removes the file from disk
+func (u *Upload) close() {
+	u.file.Close()
+	os.Remove(u.file.Name())
+}
+
+// isMultipartRequest returns true if the request follows the GraphQL multipart request spec
+func isMultipartRequest(r *http.Request) bool {
+	return r.Method == http.MethodPost && strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data")
+}
+
+// isPreflightedRequest returns true if the request sets a header that a browser would only send after
+// asking the gateway with a CORS preflight, which means it didn't come from a form on another site
+func isPreflightedRequest(r *http.Request) bool {
+	return r.Header.Get("Apollo-Require-Preflight") != "" || r.Header.Get("X-Requested-With") != ""
+}
+
+// parseMultipartRequest pulls the operations out of a multipart request. The operations field holds
+// the same JSON as a regular POST, the map field points each file to the variables it fills in, and
+// the files come last. Any files that were saved are removed if the request is invalid.
+func parseMultipartRequest(r *http.Request, config *UploadConfig) ([]*HTTPOperation, bool, error) {
+	if config == nil {
+		return nil, false, errors.New("file uploads are not enabled")
+	}
+	if !isPreflightedRequest(r) {
+		return nil, false, errors.New("multipart requests must set the Apollo-Require-Preflight or X-Requested-With header")
+	}
+	limits := *config
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, false, err
+	}
+
+	operations := []*HTTPOperation{}
+
+	// the first two fields have to be the operations and the map
+	operationsJSON, err := multipartField(reader, "operations")
+	if err != nil {
+		return nil, false, err
+	}
+	mapJSON, err := multipartField(reader, "map")
+	if err != nil {
+		return nil, false, err
+	}
+
+	// the operations can be a single object or a list
+	batchMode := len(strings.TrimSpace(string(operationsJSON))) > 0 && strings.TrimSpace(string(operationsJSON))[0] == '['
+	if batchMode {
+		err = json.Unmarshal(operationsJSON, &operations)
+	} else {
+		operation := &HTTPOperation{}
+		err = json.Unmarshal(operationsJSON, operation)
+		operations = []*HTTPOperation{operation}
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("encountered error parsing operations: %s", err.Error())
+	}
+
+	fileMap := map[string][]string{}
+	if err := json.Unmarshal(mapJSON, &fileMap); err != nil {
+		return nil, false, fmt.Errorf("encountered error parsing map: %s", err.Error())
+	}
+	if len(fileMap) > limits.maxFiles() {
+		return nil, false, fmt.Errorf("a request can upload at most %d files", limits.maxFiles())
+	}
+
+	// if anything goes wrong, we have to clean up the files we saved
+	if err := readUploads(reader, operations, batchMode, fileMap, limits); err != nil {
+		closeUploads(operations)
+		return nil, false, err
+	}
+
+	return operations, batchMode, nil
+}
+
+// readUploads saves each file in the request and points the variables in the map to it
+func readUploads(reader *multipart.Reader, operations []*HTTPOperation, batchMode bool, fileMap map[string][]string, limits UploadConfig) error {
+	for len(fileMap) > 0 {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		paths, ok := fileMap[part.FormName()]
+		if !ok {
+			part.Close()
+			continue
+		}
+		delete(fileMap, part.FormName())
+
+		upload, err := saveUpload(part, limits.maxFileSize())
+		part.Close()
+		if err != nil {
+			return err
+		}
+
+		// the first path holds onto the upload so it's cleaned up with the others
+		for i, path := range paths {
+			if err := insertUpload(operations, batchMode, path, upload); err != nil {
+				if i == 0 {
+					upload.close()
+				}
+				return err
+			}
+		}
+	}
+
+	// every file in the map has to be sent
+	for name := range fileMap {
+		return fmt.Errorf("could not find file %s", name)
+	}
+
+	return nil
+}
+
+// multipartField reads the next part of the request which has to be the field with the given name
+func multipartField(reader *multipart.Reader, name string) ([]byte, error) {
+	part, err := reader.NextPart()
+	if err != nil {
+		return nil, fmt.Errorf("could not find %s field: %s", name, err.Error())
+	}
+	defer part.Close()
+
+	if part.FormName() != name {
+		return nil, fmt.Errorf("expected %s field but found %s", name, part.FormName())
+	}
+
+	return ioutil.ReadAll(part)
+}
+
+// saveUpload copies the file to disk as long as it's under the size limit
+func saveUpload(part *multipart.Part, maxSize int64) (*Upload, error) {
+	file, err := ioutil.TempFile("", "gateway-upload-")
+	if err != nil {
+		return nil, err
+	}
+	upload := &Upload{
+		Filename:    part.FileName(),
+		ContentType: part.Header.Get("Content-Type"),
+		file:        file,
+	}
+
+	// copy one byte more than we allow so we know if the file is too big
+	size, err := io.Copy(file, io.LimitReader(part, maxSize+1))
+	if err != nil {
+		upload.close()
+		return nil, err
+	}
+	if size > maxSize {
+		upload.close()
+		return nil, fmt.Errorf("file %s is larger than the maximum of %d bytes", part.FileName(), maxSize)
+	}
+	upload.Size = size
+
+	return upload, nil
+}
+
+// insertUpload sets the variable at the path to the upload. Paths look like variables.file or
+// variables.files.0 and are prefixed with the index of the operation in batch mode.
+func insertUpload(operations []*HTTPOperation, batchMode bool, path string, upload *Upload) error {
+	keys := strings.Split(path, ".")
+
+	// find the operation the path points to
+	operation := operations[0]
+	if batchMode {
+		index, err := strconv.Atoi(keys[0])
+		if err != nil || index < 0 || index >= len(operations) {
+			return fmt.Errorf("invalid path for upload: %s", path)
+		}
+		operation = operations[index]
+		keys = keys[1:]
+	}
+
+	// files can only fill in variables
+	if operation == nil || len(keys) < 2 || keys[0] != "variables" || operation.Variables == nil {
+		return fmt.Errorf("invalid path for upload: %s", path)
+	}
+
+	// walk down to the value that holds the last key
+	var parent interface{} = operation.Variables
+	for _, key := range keys[1 : len(keys)-1] {
+		next, err := uploadPathValue(parent, key)
+		if err != nil || next == nil {
+			return fmt.Errorf("invalid path for upload: %s", path)
+		}
+		parent = next
+	}
+
+	last := keys[len(keys)-1]
+	if _, err := uploadPathValue(parent, last); err != nil {
+		return fmt.Errorf("invalid path for upload: %s", path)
+	}
+
+	switch parent := parent.(type) {
+	case map[string]interface{}:
+		parent[last] = upload
+	case []interface{}:
+		index, _ := strconv.Atoi(last)
+		parent[index] = upload
+	}
+
+	return nil
+}
+
+// uploadPathValue returns the value under the key of an object or list in the variables
+func uploadPathValue(value interface{}, key string) (interface{}, error) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		child, ok := value[key]
+		if !ok {
+			return nil, errors.New("missing key")
+		}
+		return child, nil
+	case []interface{}:
+		index, err := strconv.Atoi(key)
+		if err != nil || index < 0 || index >= len(value) {
+			return nil, errors.New("invalid index")
+		}
+		return value[index], nil
+	}
+
+	return nil, errors.New("not an object or list")
+}
+
+// closeUploads removes every file that was saved for the operations
+func closeUploads(operations []*HTTPOperation) {
+	for _, operation := range operations {
+		if operation == nil {
+			continue
+		}
+		for _, upload := range findUploads(operation.Variables, "variables") {
+			upload.Upload.close()
+		}
+	}
+}
+
+// uploadPath is an upload found in a set of variables along with where it was found
+type uploadPath struct {
+	Path   string
+	Upload *Upload
+}
+
+// findUploads returns every upload in the value and the path to it
+func findUploads(value interface{}, path string) []uploadPath {
+	uploads := []uploadPath{}
+
+	switch value := value.(type) {
+	case *Upload:
+		uploads = append(uploads, uploadPath{Path: path, Upload: value})
+	case map[string]interface{}:
+		for key, child := range value {
+			uploads = append(uploads, findUploads(child, path+"."+key)...)
+		}
+	case []interface{}:
+		for i, child := range value {
+			uploads = append(uploads, findUploads(child, path+"."+strconv.Itoa(i))...)
+		}
+	}
+
+	return uploads
+}
+
+// uploadQueryerFactory wraps the queryers made by the factory so that queries with files are sent
+// to the service as multipart requests with the client in the config
+func uploadQueryerFactory(factory *QueryerFactory, config UploadConfig) *QueryerFactory {
+	wrapped := QueryerFactory(func(ctx *PlanningContext, url string) graphql.Queryer {
+		// the queryer we would have used otherwise
+		var queryer graphql.Queryer
+		if factory != nil {
+			queryer = (*factory)(ctx, url)
+		} else {
+			queryer = graphql.NewSingleRequestQueryer(url)
+		}
+
+		// the gateway resolves its own fields
+		if url == internalSchemaLocation {
+			return queryer
+		}
+
+		return &uploadQueryer{url: url, queryer: queryer, client: config.client()}
+	})
+
+	return &wrapped
+}
+
+// uploadQueryer sends queries with files in their variables as multipart requests and leaves
+// everything else to the queryer it wraps
+type uploadQueryer struct {
+	url         string
+	queryer     graphql.Queryer
+	client      *http.Client
+	middlewares []graphql.NetworkMiddleware
+}
+
+// Query sends the query to the service
+func (q *uploadQueryer) Query(ctx context.Context, input *graphql.QueryInput, receiver interface{}) error {
+	uploads := findUploads(input.Variables, "variables")
+	if len(uploads) == 0 {
+		return q.queryer.Query(ctx, input, receiver)
+	}
+
+	// the operation goes first with every file set to null
+	operations, err := json.Marshal(map[string]interface{}{
+		"query":         input.Query,
+		"operationName": input.OperationName,
+		"variables":     input.Variables,
+	})
+	if err != nil {
+		return err
+	}
+
+	// the map points each file to where it goes
+	fileMap := map[string][]string{}
+	for i, upload := range uploads {
+		fileMap[strconv.Itoa(i)] = []string{upload.Path}
+	}
+	mapJSON, err := json.Marshal(fileMap)
+	if err != nil {
+		return err
+	}
+
+	// stream the body so we never hold the files in memory
+	body, bodyWriter := io.Pipe()
+	writer := multipart.NewWriter(bodyWriter)
+	go func() {
+		bodyWriter.CloseWithError(writeUploadBody(writer, operations, mapJSON, uploads))
+	}()
+
+	request, err := http.NewRequest(http.MethodPost, q.url, body)
+	if err != nil {
+		body.Close()
+		return err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+
+	for _, middleware := range q.middlewares {
+		if err := middleware(request); err != nil {
+			body.Close()
+			return err
+		}
+	}
+
+	response, err := q.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	result := struct {
+		Data   json.RawMessage  `json:"data"`
+		Errors []*graphql.Error `json:"errors"`
+	}{}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return fmt.Errorf("response from %s was not valid json (status %d): %s", q.url, response.StatusCode, err.Error())
+	}
+
+	if len(result.Errors) > 0 {
+		errs := graphql.ErrorList{}
+		for _, err := range result.Errors {
+			errs = append(errs, err)
+		}
+		return errs
+	}
+
+	if len(result.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(result.Data, receiver)
+}
+
+// uploadQuoteEscaper escapes file names the same way mime/multipart does
+var uploadQuoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// writeUploadBody writes the parts of a multipart request
+func writeUploadBody(writer *multipart.Writer, operations []byte, fileMap []byte, uploads []uploadPath) error {
+	if err := writer.WriteField("operations", string(operations)); err != nil {
+		return err
+	}
+	if err := writer.WriteField("map", string(fileMap)); err != nil {
+		return err
+	}
+
+	for i, upload := range uploads {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%d"; filename="%s"`, i, uploadQuoteEscaper.Replace(upload.Upload.Filename)))
+		contentType := upload.Upload.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		header.Set("Content-Type", contentType)
+
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(part, upload.Upload.Open()); err != nil {
+			return err
+		}
+	}
+
+	return writer.Close()
+}
+
+// WithMiddlewares passes the middlewares on to the queryer it wraps and keeps them for the
+// requests it sends itself
+func (q *uploadQueryer) WithMiddlewares(middlewares []graphql.NetworkMiddleware) graphql.Queryer {
+	queryer := q.queryer
+	if withMiddlewares, ok := queryer.(graphql.QueryerWithMiddlewares); ok {
+		queryer = withMiddlewares.WithMiddlewares(middlewares)
+	}
+
+	return &uploadQueryer{url: q.url, queryer: queryer, client: q.client, middlewares: middlewares}
+}
@@ -0,0 +1,264 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nautilus/graphql"
+	"github.com/stretchr/testify/assert"
+)
+
+// multipartRequest builds a request that follows the multipart request spec with the given files
+func multipartRequest(t *testing.T, operations string, fileMap string, files map[string]string) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	writer.WriteField("operations", operations)
+	writer.WriteField("map", fileMap)
+	for name, contents := range files {
+		part, err := writer.CreateFormFile(name, name+".txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(contents))
+	}
+	writer.Close()
+
+	request := httptest.NewRequest("POST", "/graphql", body)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	request.Header.Set("Apollo-Require-Preflight", "true")
+	return request
+}
+
+// uploadTestTransport counts the requests sent through a client
+type uploadTestTransport struct {
+	requests int
+}
+
+func (t *uploadTestTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.requests++
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestGraphQLHandler_upload(t *testing.T) {
+	// what the service was sent
+	received := struct {
+		Operations map[string]interface{}
+		Map        map[string][]string
+		Filename   string
+		Contents   string
+	}{}
+
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Error(err)
+			return
+		}
+
+		json.Unmarshal([]byte(r.FormValue("operations")), &received.Operations)
+		json.Unmarshal([]byte(r.FormValue("map")), &received.Map)
+
+		file, header, err := r.FormFile("0")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		contents, _ := ioutil.ReadAll(file)
+		received.Filename = header.Filename
+		received.Contents = string(contents)
+
+		w.Write([]byte(`{"data": {"setPicture": true}}`))
+	}))
+	defer service.Close()
+
+	schema, _ := graphql.LoadSchema(`
+		scalar Upload
+
+		type Query {
+			picture: String
+		}
+
+		type Mutation {
+			setPicture(caption: String, picture: Upload!): Boolean!
+		}
+	`)
+
+	// the files are sent with the client the gateway was given
+	transport := &uploadTestTransport{}
+	gateway, err := New(
+		[]*graphql.RemoteSchema{{Schema: schema, URL: service.URL}},
+		WithUploads(UploadConfig{Client: &http.Client{Transport: transport}}),
+	)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	request := multipartRequest(t,
+		`{"query": "mutation ($caption: String, $picture: Upload!) { setPicture(caption: $caption, picture: $picture) }", "variables": {"caption": "me", "picture": null}}`,
+		`{"0": ["variables.picture"]}`,
+		map[string]string{"0": "hello world"},
+	)
+	responseRecorder := httptest.NewRecorder()
+
+	gateway.GraphQLHandler(responseRecorder, request)
+	if !assert.Equal(t, http.StatusOK, responseRecorder.Result().StatusCode, responseRecorder.Body.String()) {
+		return
+	}
+
+	response := map[string]interface{}{}
+	if !assert.Nil(t, json.NewDecoder(responseRecorder.Body).Decode(&response)) {
+		return
+	}
+	assert.Equal(t, map[string]interface{}{"setPicture": true}, response["data"])
+
+	// the service got the file and the rest of the variables
+	assert.Equal(t, map[string]interface{}{"caption": "me", "picture": nil}, received.Operations["variables"])
+	assert.Equal(t, map[string][]string{"0": {"variables.picture"}}, received.Map)
+	assert.Equal(t, "0.txt", received.Filename)
+	assert.Equal(t, "hello world", received.Contents)
+	assert.Equal(t, 1, transport.requests)
+}
+
+func TestParseRequest_multipartNotAllowed(t *testing.T) {
+	newRequest := func() *http.Request {
+		return multipartRequest(t,
+			`{"query": "mutation ($picture: Upload!) { setPicture(picture: $picture) }", "variables": {"picture": null}}`,
+			`{"0": ["variables.picture"]}`,
+			map[string]string{"0": "hello world"},
+		)
+	}
+
+	// uploads have to be turned on
+	_, _, err := parseRequest(newRequest(), nil)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "file uploads are not enabled", err.Error())
+	}
+
+	// and a form on another site can't send them
+	request := newRequest()
+	request.Header.Del("Apollo-Require-Preflight")
+	_, _, err = parseRequest(request, &UploadConfig{})
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "multipart requests must set the Apollo-Require-Preflight or X-Requested-With header", err.Error())
+	}
+
+	request = newRequest()
+	request.Header.Del("Apollo-Require-Preflight")
+	request.Header.Set("X-Requested-With", "XMLHttpRequest")
+	operations, _, err := parseRequest(request, &UploadConfig{})
+	assert.Nil(t, err)
+	closeUploads(operations)
+}
+
+func TestParseRequest_multipart(t *testing.T) {
+	request := multipartRequest(t,
+		`[
+			{"query": "{ picture }"},
+			{"query": "mutation ($pictures: [Upload!]!) { setPictures(pictures: $pictures) }", "variables": {"pictures": [null, null]}}
+		]`,
+		`{"a": ["1.variables.pictures.0"], "b": ["1.variables.pictures.1"]}`,
+		map[string]string{"a": "first", "b": "second"},
+	)
+
+	operations, batchMode, err := parseRequest(request, &UploadConfig{})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer closeUploads(operations)
+
+	assert.True(t, batchMode)
+	if !assert.Len(t, operations, 2) {
+		return
+	}
+
+	pictures, ok := operations[1].Variables["pictures"].([]interface{})
+	if !assert.True(t, ok) || !assert.Len(t, pictures, 2) {
+		return
+	}
+
+	for i, expected := range []string{"first", "second"} {
+		upload, ok := pictures[i].(*Upload)
+		if !assert.True(t, ok) {
+			return
+		}
+
+		// the contents can be read more than once
+		for j := 0; j < 2; j++ {
+			contents, err := ioutil.ReadAll(upload.Open())
+			assert.Nil(t, err)
+			assert.Equal(t, expected, string(contents))
+		}
+		assert.Equal(t, int64(len(expected)), upload.Size)
+	}
+
+	// uploads are left out of json payloads
+	payload, err := json.Marshal(operations[1].Variables)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"pictures":[null,null]}`, string(payload))
+}
+
+func TestParseRequest_multipartErrors(t *testing.T) {
+	testCases := []struct {
+		Message string
+		Config  UploadConfig
+		Map     string
+		Files   map[string]string
+		Error   string
+	}{
+		{
+			"too many files",
+			UploadConfig{MaxFiles: 1},
+			`{"0": ["variables.picture"], "1": ["variables.picture"]}`,
+			map[string]string{"0": "first", "1": "second"},
+			"a request can upload at most 1 files",
+		},
+		{
+			"file too large",
+			UploadConfig{MaxFileSize: 4},
+			`{"0": ["variables.picture"]}`,
+			map[string]string{"0": "hello world"},
+			"file 0.txt is larger than the maximum of 4 bytes",
+		},
+		{
+			"missing file",
+			UploadConfig{},
+			`{"0": ["variables.picture"]}`,
+			map[string]string{},
+			"could not find file 0",
+		},
+		{
+			"path outside of the variables",
+			UploadConfig{},
+			`{"0": ["query"]}`,
+			map[string]string{"0": "hello world"},
+			"invalid path for upload: query",
+		},
+		{
+			"path to a missing variable",
+			UploadConfig{},
+			`{"0": ["variables.other"]}`,
+			map[string]string{"0": "hello world"},
+			"invalid path for upload: variables.other",
+		},
+	}
+
+	for _, row := range testCases {
+		t.Run(row.Message, func(t *testing.T) {
+			request := multipartRequest(t,
+				`{"query": "mutation ($picture: Upload!) { setPicture(picture: $picture) }", "variables": {"picture": null}}`,
+				row.Map,
+				row.Files,
+			)
+
+			_, _, err := parseRequest(request, &row.Config)
+			if assert.NotNil(t, err) {
+				assert.Equal(t, row.Error, err.Error())
+			}
+		})
+	}
+}